@@ -0,0 +1,130 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package activator
+
+//
+// This package defines how text activator messages are encoded when saved with a chunk.
+// It doesn't depend on the server, and can be used by external tools that inspect or
+// create activators.
+//
+// All integers are unsigned, stored LSB first. Strings are UTF-8.
+//
+//	uint8   Format version, currently 1
+//	uint32  Number of activators
+//	For every activator:
+//	  uint8   X, Y, Z  Position of the BT_Text block inside the chunk
+//	  uint32  Number of lines in the message
+//	  For every line:
+//	    uint32  Length of the line, in bytes
+//	    []byte  The line
+//
+// Older chunk files used encoding/gob for the list of activators. Use DecodeGob to read them.
+//
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+const Version = 1 // The format version used by Encode
+
+// One text activator, and the message it generates
+type Activator struct {
+	X, Y, Z uint8    // Position of the BT_Text inside the chunk
+	Message []string // The multi line message
+}
+
+var ErrTruncated = errors.New("activator: data truncated")
+
+func putUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func getUint32(b []byte) (uint32, []byte, error) {
+	if len(b) < 4 {
+		return 0, b, ErrTruncated
+	}
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24, b[4:], nil
+}
+
+// Encode a list of activators, using the current format version.
+func Encode(list []Activator) []byte {
+	b := []byte{Version}
+	b = putUint32(b, uint32(len(list)))
+	for _, act := range list {
+		b = append(b, act.X, act.Y, act.Z)
+		b = putUint32(b, uint32(len(act.Message)))
+		for _, line := range act.Message {
+			b = putUint32(b, uint32(len(line)))
+			b = append(b, line...)
+		}
+	}
+	return b
+}
+
+// Decode a list of activators that was encoded with Encode.
+func Decode(b []byte) ([]Activator, error) {
+	if len(b) < 1 {
+		return nil, ErrTruncated
+	}
+	if b[0] != Version {
+		return nil, fmt.Errorf("activator: unsupported version %d", b[0])
+	}
+	num, b, err := getUint32(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	var list []Activator
+	for i := uint32(0); i < num; i++ {
+		if len(b) < 3 {
+			return nil, ErrTruncated
+		}
+		act := Activator{X: b[0], Y: b[1], Z: b[2]}
+		var lines uint32
+		lines, b, err = getUint32(b[3:])
+		if err != nil {
+			return nil, err
+		}
+		for j := uint32(0); j < lines; j++ {
+			var length uint32
+			length, b, err = getUint32(b)
+			if err != nil {
+				return nil, err
+			}
+			if uint32(len(b)) < length {
+				return nil, ErrTruncated
+			}
+			act.Message = append(act.Message, string(b[:length]))
+			b = b[length:]
+		}
+		list = append(list, act)
+	}
+	if len(b) != 0 {
+		return nil, fmt.Errorf("activator: %d bytes of extra data", len(b))
+	}
+	return list, nil
+}
+
+// Decode a list of activators saved with encoding/gob, as done by older versions of the server.
+func DecodeGob(b []byte) ([]Activator, error) {
+	var list []Activator
+	err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(&list)
+	return list, err
+}
@@ -0,0 +1,71 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package activator
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testList = []Activator{
+	{1, 2, 3, []string{"Hello", "/addkey:1:Bronze key"}},
+	{31, 0, 17, nil},
+}
+
+func TestEncodeDecode(t *testing.T) {
+	b := Encode(testList)
+	list, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, testList) {
+		t.Error("Got", list, "expected", testList)
+	}
+	if _, err = Decode(b[:len(b)-1]); err == nil {
+		t.Error("Truncated data shall fail")
+	}
+	b[0] = Version + 1
+	if _, err = Decode(b); err == nil {
+		t.Error("Unknown version shall fail")
+	}
+}
+
+// The same layout as the server used when activators were saved with gob.
+type legacyActivator struct {
+	X, Y, Z uint8
+	Message []string
+	inhibit time.Time
+}
+
+func TestDecodeGob(t *testing.T) {
+	legacy := []legacyActivator{{1, 2, 3, []string{"Hello", "/addkey:1:Bronze key"}, time.Now()}, {31, 0, 17, nil, time.Now()}}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&legacy); err != nil {
+		t.Fatal(err)
+	}
+	list, err := DecodeGob(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, testList) {
+		t.Error("Got", list, "expected", testList)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Import of a dump of the old MySQL database. The tables "users" and "avatars" are merged
+// into the "avatars" collection, "chunkdata" is copied to the "chunkdata" collection and
+// gives the territory of every avatar, and "friends" is used for the listeners.
+//
+// The import can be done more than once, documents are replaced using the same id.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Same as chunkdb.CC, as saved in the database
+type importCC struct {
+	X, Y, Z int32
+}
+
+type importCoord struct {
+	X, Y, Z float64
+}
+
+type importObject struct {
+	Type  string
+	Level uint32
+	Count uint32
+}
+
+// Helper functions to get typed values from a row. Missing or bad values give 0.
+func (row sqlRow) Float(col string) float64 {
+	v, _ := strconv.ParseFloat(row[col], 64)
+	return v
+}
+
+func (row sqlRow) Int(col string) int64 {
+	v, _ := strconv.ParseInt(row[col], 10, 64)
+	return v
+}
+
+func (row sqlRow) Bool(col string) bool {
+	return row.Int(col) != 0
+}
+
+func (row sqlRow) Coord(prefix string) importCoord {
+	return importCoord{row.Float(prefix + "X"), row.Float(prefix + "Y"), row.Float(prefix + "Z")}
+}
+
+// The inventory blob is expected to be a JSON list of objects. Return nil if it can't be used.
+func importInventory(data string) []importObject {
+	if data == "" {
+		return nil
+	}
+	var inv []importObject
+	if err := json.Unmarshal([]byte(data), &inv); err != nil {
+		return nil
+	}
+	return inv
+}
+
+// Create an avatar document from the old tables.
+func importAvatar(row sqlRow, user sqlRow, territory []importCC, listeners []uint32) bson.M {
+	doc := bson.M{
+		"_id":           uint32(row.Int("id")),
+		"name":          row["name"],
+		"email":         row["owner"],
+		"head":          uint16(row.Int("HeadType")),
+		"body":          uint16(row.Int("BodyType")),
+		"coord":         row.Coord("Position"),
+		"flying":        row.Bool("isFlying"),
+		"climbing":      row.Bool("isClimbing"),
+		"dead":          row.Bool("isDead"),
+		"dirhor":        float32(row.Float("DirHor")),
+		"dirvert":       float32(row.Float("DirVert")),
+		"adminlevel":    uint8(row.Int("AdminLevel")),
+		"level":         uint32(row.Int("Level")),
+		"exp":           float32(row.Float("Experience")),
+		"hitpoints":     float32(row.Float("HitPoints")),
+		"mana":          float32(row.Float("Mana")),
+		"numkill":       uint32(row.Int("Kills")),
+		"blockadd":      uint32(row.Int("BlocksAdded")),
+		"blockrem":      uint32(row.Int("BlocksRemoved")),
+		"homesp":        row.Coord("Home"),
+		"targetcoor":    row.Coord("Target"),
+		"revivesp":      row.Coord("Revive"),
+		"timeonline":    uint32(row.Int("TimeOnline")),
+		"territory":     territory,
+		"listeners":     listeners,
+		"tscoretotal":   row.Float("TScoreTotal"),
+		"tscorebalance": row.Float("TScoreBalance"),
+		"tscoretime":    uint32(row.Int("TScoreTime")),
+	}
+	if max := row.Int("maxchunks"); max > 0 {
+		// -1 was used for the default. The server will initialize it when not defined.
+		doc["maxchunks"] = int(max)
+	}
+	if t, err := time.Parse("2006-01-02", row["lastseen"]); err == nil {
+		doc["lastseen"] = t
+	}
+	if inv := importInventory(row["Inventory"]); inv != nil {
+		doc["inventory"] = inv
+	} else if row["Inventory"] != "" {
+		log.Println("Import avatar", row["name"], "inventory can't be decoded, ignored")
+	}
+	if user != nil {
+		doc["password"] = user["password"]
+		doc["license"] = user["licensekey"]
+	} else {
+		log.Println("Import avatar", row["name"], "has no user", row["owner"])
+	}
+	return doc
+}
+
+// Import a dump file from the old MySQL database.
+func importSQLDump(fileName string, db *mgo.Database) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	tables, err := parseSQLDump(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	rows := func(name string) []sqlRow {
+		if t, ok := tables[name]; ok {
+			return t.Rows
+		}
+		log.Println("Import: no table", name, "in", fileName)
+		return nil
+	}
+
+	userRows, avatarRows, chunkRows, friendRows := rows("users"), rows("avatars"), rows("chunkdata"), rows("friends")
+	users := make(map[string]sqlRow)
+	for _, row := range userRows {
+		users[row["email"]] = row
+	}
+
+	territory := make(map[uint32][]importCC)
+	c := db.C("chunkdata")
+	for _, row := range chunkRows {
+		cc := importCC{int32(row.Int("x")), int32(row.Int("y")), int32(row.Int("z"))}
+		uid := uint32(row.Int("avatarID"))
+		_, err = c.Upsert(bson.M{"x": cc.X, "y": cc.Y, "z": cc.Z}, bson.M{"x": cc.X, "y": cc.Y, "z": cc.Z, "avatarID": uid})
+		if err != nil {
+			return fmt.Errorf("chunkdata: %v", err)
+		}
+		if uid != 0 {
+			territory[uid] = append(territory[uid], cc)
+		}
+	}
+
+	// A friend is someone you want to know when they log in and out. That means you are a listener of your friend.
+	listeners := make(map[uint32][]uint32)
+	for _, row := range friendRows {
+		friend := uint32(row.Int("friend"))
+		listeners[friend] = append(listeners[friend], uint32(row.Int("avatar")))
+	}
+
+	var maxId uint32
+	c = db.C("avatars")
+	for _, row := range avatarRows {
+		doc := importAvatar(row, users[row["owner"]], territory[uint32(row.Int("id"))], listeners[uint32(row.Int("id"))])
+		id := doc["_id"].(uint32)
+		if _, err = c.UpsertId(id, doc); err != nil {
+			return fmt.Errorf("avatar %s: %v", row["name"], err)
+		}
+		if id > maxId {
+			maxId = id
+		}
+	}
+
+	// Make sure new avatars get an id that is not used
+	var counter struct {
+		C uint32
+	}
+	c = db.C("counters")
+	err = c.FindId("avatarId").One(&counter)
+	if err != nil && err != mgo.ErrNotFound {
+		return fmt.Errorf("counters: %v", err)
+	}
+	if counter.C < maxId {
+		if _, err = c.UpsertId("avatarId", bson.M{"$set": bson.M{"c": maxId}}); err != nil {
+			return fmt.Errorf("counters: %v", err)
+		}
+	}
+	log.Printf("Imported %d avatars, %d users, %d chunks and %d friends from %s\n",
+		len(avatarRows), len(userRows), len(chunkRows), len(friendRows), fileName)
+	return nil
+}
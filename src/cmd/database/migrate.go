@@ -0,0 +1,113 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Migrations of the avatar documents. Every migration updates documents to a new schema version,
+// and they are applied in order. Only documents with an older version are updated, which means
+// it doesn't matter if the migrations are run more than once. To add a migration, add it last in
+// the list, and increment ephenationdb.SchemaVersion.
+//
+
+import (
+	"ephenationdb"
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+)
+
+type migration struct {
+	version int
+	descr   string
+	// Return the fields that shall be updated in the document. It can be empty.
+	update func(doc bson.M) bson.M
+}
+
+const defaultMaxChunks = 10 // Same as CnfgMaxOwnChunk in the server
+
+var migrations = []migration{
+	{1, "Initialize max number of chunks", func(doc bson.M) bson.M {
+		if toFloat(doc["maxchunks"]) != 0 {
+			return nil
+		}
+		return bson.M{"maxchunks": defaultMaxChunks}
+	}},
+	{2, "Initialize revive and home spawn points", func(doc bson.M) bson.M {
+		if isZeroCoord(doc["revivesp"]) && doc["coord"] != nil {
+			return bson.M{"revivesp": doc["coord"], "homesp": doc["coord"]}
+		}
+		return nil
+	}},
+}
+
+// Get a number from a document, regardless of the type used. Missing values give 0.
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// Test if a coordinate in a document is missing or 0,0,0.
+func isZeroCoord(v interface{}) bool {
+	coord, ok := v.(bson.M)
+	if !ok {
+		return true
+	}
+	return toFloat(coord["x"]) == 0 && toFloat(coord["y"]) == 0 && toFloat(coord["z"]) == 0
+}
+
+// Apply all migrations that are needed. Return the number of updated documents.
+func migrate(c *mgo.Collection) (int, error) {
+	if len(migrations) == 0 || migrations[len(migrations)-1].version != ephenationdb.SchemaVersion {
+		return 0, fmt.Errorf("the last migration doesn't match schema version %d", ephenationdb.SchemaVersion)
+	}
+	var total int
+	for _, m := range migrations {
+		var n int
+		var doc bson.M
+		iter := c.Find(ephenationdb.OlderThan(m.version)).Iter()
+		for iter.Next(&doc) {
+			set := m.update(doc)
+			if set == nil {
+				set = bson.M{}
+			}
+			set[ephenationdb.SchemaVersionField] = m.version
+			if err := c.UpdateId(doc["_id"], bson.M{"$set": set}); err != nil {
+				iter.Close()
+				return total, fmt.Errorf("migration %d, avatar %v: %v", m.version, doc["_id"], err)
+			}
+			n++
+			doc = nil
+		}
+		if err := iter.Close(); err != nil {
+			return total, fmt.Errorf("migration %d: %v", m.version, err)
+		}
+		if n > 0 {
+			log.Printf("Migration %d (%s): %d avatars updated\n", m.version, m.descr, n)
+		}
+		total += n
+	}
+	return total, nil
+}
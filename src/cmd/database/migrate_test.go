@@ -0,0 +1,59 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"ephenationdb"
+	"labix.org/v2/mgo/bson"
+	"testing"
+)
+
+func TestMigrationOrder(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Migration %d has version %d", i+1, m.version)
+		}
+	}
+	if migrations[len(migrations)-1].version != ephenationdb.SchemaVersion {
+		t.Errorf("The last migration doesn't match schema version %d", ephenationdb.SchemaVersion)
+	}
+}
+
+// Every migration shall give the same result when applied again.
+func TestMigrationIdempotent(t *testing.T) {
+	doc := bson.M{"_id": 1, "coord": bson.M{"x": 1.0, "y": 2.0, "z": 3.0}}
+	for _, m := range migrations {
+		set := m.update(doc)
+		for k, v := range set {
+			doc[k] = v
+		}
+		if again := m.update(doc); len(again) != 0 {
+			t.Errorf("Migration %d not idempotent: %v", m.version, again)
+		}
+	}
+	if toFloat(doc["maxchunks"]) != defaultMaxChunks || isZeroCoord(doc["revivesp"]) {
+		t.Errorf("Bad migrated document %v", doc)
+	}
+	// Already defined values shall not change
+	doc = bson.M{"maxchunks": 20, "revivesp": bson.M{"x": 0, "y": 0, "z": int64(5)}}
+	for _, m := range migrations {
+		if set := m.update(doc); len(set) != 0 {
+			t.Errorf("Migration %d changed %v", m.version, set)
+		}
+	}
+}
@@ -20,6 +20,7 @@ package main
 import (
 	"ephenationdb"
 	"flag"
+	"fmt"
 	"github.com/larspensjo/config"
 	"log"
 	"os"
@@ -29,9 +30,12 @@ var (
 	configFileName = flag.String("configfile", "config.ini", "General configuration file")
 	logOnStdout    = flag.Bool("s", false, "Send log file to standard otput")
 	logFileName    = flag.String("log", "database.log", "Log file name")
+	importFile     = flag.String("import", "", "Import a dump file from the old MySQL database, like dumpfile.sql")
+	migrateFlag    = flag.Bool("migrate", false, "Update all avatars to the current schema version")
 )
 
 func main() {
+	flag.Parse()
 	if !*logOnStdout {
 		logFile, _ := os.OpenFile(*logFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
 		log.SetOutput(logFile)
@@ -63,4 +67,21 @@ func main() {
 	}
 	db := ephenationdb.New()
 	chunkdata(db.C("chunkdata"))
+	if *importFile != "" {
+		if err = importSQLDump(*importFile, db); err != nil {
+			log.Println("Import failed:", err)
+			fmt.Println("Import failed:", err)
+			os.Exit(1)
+		}
+	}
+	// Imported avatars always need to be migrated
+	if *migrateFlag || *importFile != "" {
+		n, err := migrate(db.C("avatars"))
+		if err != nil {
+			log.Println("Migration failed:", err)
+			fmt.Println("Migration failed:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d avatars migrated to schema version %d\n", n, ephenationdb.SchemaVersion)
+	}
 }
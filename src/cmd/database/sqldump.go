@@ -0,0 +1,294 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// A parser for dump files created by mysqldump. Only what is needed to get the data out of the
+// dump is supported: "CREATE TABLE" gives the column names, and "INSERT INTO" gives the rows.
+// All other statements and comments are ignored.
+//
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	tokWord   = iota // Keywords, numbers and other unquoted words
+	tokIdent         // Identifier quoted with `
+	tokString        // String quoted with ' or "
+	tokPunct         // A single character, like '(' or ','
+)
+
+type sqlToken struct {
+	kind int
+	text string
+}
+
+// A row is a map from column name to value. NULL values are not included.
+type sqlRow map[string]string
+
+type sqlTable struct {
+	Columns []string
+	Rows    []sqlRow
+}
+
+// Split the dump into tokens. Comments are skipped, including the "/*!40101 ... */" conditional
+// statements used by mysqldump.
+func sqlTokenize(s string) ([]sqlToken, error) {
+	var list []sqlToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#' || (c == '-' && strings.HasPrefix(s[i:], "-- ")) || strings.HasPrefix(s[i:], "--\n"):
+			end := strings.IndexByte(s[i:], '\n')
+			if end == -1 {
+				return list, nil
+			}
+			i += end + 1
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			i += end + 4
+		case c == '`':
+			end := strings.IndexByte(s[i+1:], '`')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated identifier")
+			}
+			list = append(list, sqlToken{tokIdent, s[i+1 : i+1+end]})
+			i += end + 2
+		case c == '\'' || c == '"':
+			str, n, err := sqlUnquote(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, sqlToken{tokString, str})
+			i += n
+		case c == '-' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9', isWordChar(c):
+			start := i
+			for i++; i < len(s) && (isWordChar(s[i]) || s[i] == '.' || ((s[i] == '-' || s[i] == '+') && (s[i-1] == 'e' || s[i-1] == 'E'))); i++ {
+			}
+			list = append(list, sqlToken{tokWord, s[start:i]})
+		default:
+			list = append(list, sqlToken{tokPunct, s[i : i+1]})
+			i++
+		}
+	}
+	return list, nil
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '@'
+}
+
+// Decode a quoted string at the beginning of 's'. Return the string and the number of bytes used.
+func sqlUnquote(s string) (string, int, error) {
+	quote := s[0]
+	var b []byte
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case '0':
+				b = append(b, 0)
+			case 'b':
+				b = append(b, '\b')
+			case 'n':
+				b = append(b, '\n')
+			case 'r':
+				b = append(b, '\r')
+			case 't':
+				b = append(b, '\t')
+			case 'Z':
+				b = append(b, 26)
+			default:
+				b = append(b, s[i])
+			}
+		case c == quote && i+1 < len(s) && s[i+1] == quote:
+			b = append(b, quote)
+			i++
+		case c == quote:
+			return string(b), i + 1, nil
+		default:
+			b = append(b, c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// Parse a complete dump. Return all tables found, by name.
+func parseSQLDump(dump string) (map[string]*sqlTable, error) {
+	tokens, err := sqlTokenize(dump)
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string]*sqlTable)
+	for len(tokens) > 0 {
+		// Find the end of the statement
+		end := 0
+		for end < len(tokens) && !(tokens[end].kind == tokPunct && tokens[end].text == ";") {
+			end++
+		}
+		stmt := tokens[:end]
+		if end < len(tokens) {
+			end++
+		}
+		tokens = tokens[end:]
+
+		switch {
+		case len(stmt) > 3 && isKeyword(stmt[0], "CREATE") && isKeyword(stmt[1], "TABLE"):
+			err = parseCreateTable(tables, stmt[2:])
+		case len(stmt) > 3 && isKeyword(stmt[0], "INSERT") && isKeyword(stmt[1], "INTO"):
+			err = parseInsert(tables, stmt[2:])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
+func isKeyword(t sqlToken, keyword string) bool {
+	return t.kind == tokWord && strings.EqualFold(t.text, keyword)
+}
+
+func isPunct(t sqlToken, p string) bool {
+	return t.kind == tokPunct && t.text == p
+}
+
+// Split a list of tokens, starting with '(', into the elements separated by commas. Nested
+// parentheses are kept. Return the elements and the number of tokens used, including ')'.
+func splitParenthesis(stmt []sqlToken) ([][]sqlToken, int, error) {
+	if len(stmt) == 0 || !isPunct(stmt[0], "(") {
+		return nil, 0, fmt.Errorf("expected '('")
+	}
+	var list [][]sqlToken
+	depth, start := 0, 1
+	for i, t := range stmt {
+		switch {
+		case isPunct(t, "("):
+			depth++
+		case isPunct(t, ")"):
+			depth--
+			if depth == 0 {
+				list = append(list, stmt[start:i])
+				return list, i + 1, nil
+			}
+		case isPunct(t, ",") && depth == 1:
+			list = append(list, stmt[start:i])
+			start = i + 1
+		}
+	}
+	return nil, 0, fmt.Errorf("unbalanced parenthesis")
+}
+
+func parseCreateTable(tables map[string]*sqlTable, stmt []sqlToken) error {
+	if len(stmt) > 3 && isKeyword(stmt[0], "IF") {
+		stmt = stmt[3:] // "IF NOT EXISTS"
+	}
+	name := stmt[0].text
+	elements, _, err := splitParenthesis(stmt[1:])
+	if err != nil {
+		return fmt.Errorf("CREATE TABLE %s: %v", name, err)
+	}
+	table := &sqlTable{}
+	for _, e := range elements {
+		if len(e) == 0 {
+			continue
+		}
+		if e[0].kind == tokWord {
+			switch strings.ToUpper(e[0].text) {
+			case "PRIMARY", "UNIQUE", "KEY", "INDEX", "CONSTRAINT", "FOREIGN", "FULLTEXT", "SPATIAL":
+				continue
+			}
+		}
+		table.Columns = append(table.Columns, e[0].text)
+	}
+	tables[name] = table
+	return nil
+}
+
+func parseInsert(tables map[string]*sqlTable, stmt []sqlToken) error {
+	name := stmt[0].text
+	table, ok := tables[name]
+	if !ok {
+		table = &sqlTable{}
+		tables[name] = table
+	}
+	stmt = stmt[1:]
+	columns := table.Columns
+	if len(stmt) > 0 && isPunct(stmt[0], "(") {
+		// Explicit list of columns
+		elements, n, err := splitParenthesis(stmt)
+		if err != nil {
+			return fmt.Errorf("INSERT INTO %s: %v", name, err)
+		}
+		columns = nil
+		for _, e := range elements {
+			if len(e) != 1 {
+				return fmt.Errorf("INSERT INTO %s: bad column list", name)
+			}
+			columns = append(columns, e[0].text)
+		}
+		stmt = stmt[n:]
+	}
+	if len(stmt) == 0 || !(isKeyword(stmt[0], "VALUES") || isKeyword(stmt[0], "VALUE")) {
+		return fmt.Errorf("INSERT INTO %s: expected VALUES", name)
+	}
+	stmt = stmt[1:]
+	for len(stmt) > 0 {
+		elements, n, err := splitParenthesis(stmt)
+		if err != nil {
+			return fmt.Errorf("INSERT INTO %s: %v", name, err)
+		}
+		if len(elements) != len(columns) {
+			return fmt.Errorf("INSERT INTO %s: %d values, but %d columns", name, len(elements), len(columns))
+		}
+		row := make(sqlRow)
+		for i, e := range elements {
+			if len(e) != 1 {
+				return fmt.Errorf("INSERT INTO %s: bad value for %s", name, columns[i])
+			}
+			switch t := e[0]; {
+			case isKeyword(t, "NULL"):
+			case t.kind == tokWord && (strings.HasPrefix(t.text, "0x") || strings.HasPrefix(t.text, "0X")):
+				// Binary data, from "mysqldump --hex-blob"
+				b, err := hex.DecodeString(t.text[2:])
+				if err != nil {
+					return fmt.Errorf("INSERT INTO %s: %v", name, err)
+				}
+				row[columns[i]] = string(b)
+			default:
+				row[columns[i]] = t.text
+			}
+		}
+		table.Rows = append(table.Rows, row)
+		stmt = stmt[n:]
+		if len(stmt) > 0 && isPunct(stmt[0], ",") {
+			stmt = stmt[1:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+const testDump = `
+-- MySQL dump
+/*!40101 SET NAMES utf8 */;
+DROP TABLE IF EXISTS ` + "`friends`" + `;
+CREATE TABLE ` + "`friends`" + ` (
+  ` + "`avatar`" + ` int(1) NOT NULL,
+  ` + "`friend`" + ` int(1) NOT NULL,
+  KEY ` + "`avatar`" + ` (` + "`avatar`" + `)
+) ENGINE=MyISAM DEFAULT CHARSET=latin1;
+INSERT INTO ` + "`friends`" + ` VALUES (1,2),(2,-1);
+INSERT INTO ` + "`other`" + ` (` + "`a`" + `,` + "`b`" + `) VALUES ('it''s;\n',NULL),(0x4142,1.5e-3);
+`
+
+func TestParseSQLDump(t *testing.T) {
+	tables, err := parseSQLDump(testDump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	friends := tables["friends"]
+	if friends == nil || len(friends.Columns) != 2 || friends.Columns[1] != "friend" {
+		t.Fatalf("Bad table friends: %#v", friends)
+	}
+	if len(friends.Rows) != 2 || friends.Rows[0]["friend"] != "2" || friends.Rows[1].Int("friend") != -1 {
+		t.Errorf("Bad rows in friends: %v", friends.Rows)
+	}
+	other := tables["other"]
+	if other == nil || len(other.Rows) != 2 {
+		t.Fatalf("Bad table other: %#v", other)
+	}
+	if v, ok := other.Rows[0]["b"]; ok {
+		t.Errorf("NULL gave '%s'", v)
+	}
+	if other.Rows[0]["a"] != "it's;\n" || other.Rows[1]["a"] != "AB" || other.Rows[1].Float("b") != 1.5e-3 {
+		t.Errorf("Bad rows in other: %v", other.Rows)
+	}
+}
+
+// The dump file in the repository has the table definitions.
+func TestParseDumpFile(t *testing.T) {
+	data, err := ioutil.ReadFile("../../../dumpfile.sql")
+	if err != nil {
+		t.Skip(err)
+	}
+	tables, err := parseSQLDump(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"avatars", "users", "friends", "chunkdata"} {
+		if tables[name] == nil || len(tables[name].Columns) == 0 {
+			t.Errorf("Missing table %s", name)
+		}
+	}
+	if n := len(tables["avatars"].Columns); n != 38 {
+		t.Errorf("Expected 38 columns in avatars, got %d", n)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Restore a server directory from a snapshot, created by the server with "-snapshot" or "/snapshot".
+// The chunk and super chunk files are restored into the target directory. The database collections
+// are only restored if requested, as that will replace the current content. The player journals are
+// then removed, as they are newer than the restored players, and would partly undo the restore.
+// The server must not be running while restoring.
+//
+
+import (
+	"ephenationdb"
+	"flag"
+	"fmt"
+	"github.com/larspensjo/config"
+	"labix.org/v2/mgo"
+	"os"
+	"path/filepath"
+	"snapshot"
+)
+
+const journalFolder = "JDB" // The same as CnfgJournalFolder of the server
+
+var (
+	configFileName = flag.String("configfile", "config.ini", "General configuration file")
+	targetDir      = flag.String("dir", ".", "The server directory to restore into")
+	restoreDB      = flag.Bool("db", false, "Also restore the database collections, replacing the current content")
+	verboseFlag    = flag.Bool("v", false, "Report every restored file")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: restore [options] snapshotfile")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	var db *mgo.Database
+	if *restoreDB {
+		cnfg, err := config.ReadDefault(*configFileName)
+		if err != nil {
+			fmt.Println("Fail to find", *configFileName, err)
+			os.Exit(1)
+		}
+		const configSection = "db"
+		if !cnfg.HasSection(configSection) {
+			fmt.Println("Config file", *configFileName, "missing section", configSection)
+			os.Exit(1)
+		}
+		f := func(key string) string {
+			value, err := cnfg.String(configSection, key)
+			if err != nil {
+				fmt.Println("Config file", *configFileName, "Failt to find key", key, err)
+				return ""
+			}
+			return value
+		}
+		if err = ephenationdb.SetConnection(f); err != nil {
+			fmt.Println("Open DB:", err)
+			os.Exit(1)
+		}
+		db = ephenationdb.New()
+	}
+
+	var files int
+	report := func(name string, count int) {
+		switch {
+		case count >= 0:
+			fmt.Println("Restored", count, "documents into collection", name)
+		case *verboseFlag:
+			fmt.Println("Restored", name)
+			fallthrough
+		default:
+			files++
+		}
+	}
+	err := snapshot.Restore(flag.Arg(0), *targetDir, db, report)
+	if err != nil {
+		fmt.Println("Restore failed:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Restored", files, "files into", *targetDir)
+	if db != nil {
+		if err = os.RemoveAll(filepath.Join(*targetDir, journalFolder)); err != nil {
+			fmt.Println("Remove player journals failed:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Removed the player journals")
+	}
+}
@@ -83,6 +83,8 @@ func (up *user) CheckAndActivateTriggers_WLwWLuWLqWLmWLc(bl block) {
 		inhibitDelta int      // Number of seconds until next inhibitor
 	}
 	list := make([]localActivatorList, 0, 5) // Allocate a number of pointers, to avoid unneccesary reallocation to grow the vector.
+	var spawners []user_coord                // Monster spawn activators
+	var spawnTriggers []int                  // The index of the triggers of the spawners
 	now := time.Now()
 	cp.RLock()
 	ch_coord := cp.Coord
@@ -91,8 +93,17 @@ func (up *user) CheckAndActivateTriggers_WLwWLuWLqWLmWLc(bl block) {
 		if trig.x != x_off || trig.y != y_off || trig.z != z_off {
 			continue // Wrong trigger
 		}
-		if cp.rc[trig.x2][trig.y2][trig.z2] != BT_Text {
-			log.Println("Error: No text activator", cp.rc[trig.x2][trig.y2][trig.z2], trig)
+		switch bl := cp.raw()[trig.x2][trig.y2][trig.z2]; bl {
+		case BT_Text:
+		case BT_Spawn:
+			if trig.inhibit.Before(now) {
+				spawners = append(spawners, user_coord{float64(ch_coord.X)*CHUNK_SIZE + float64(trig.x2),
+					float64(ch_coord.Y)*CHUNK_SIZE + float64(trig.y2), float64(ch_coord.Z)*CHUNK_SIZE + float64(trig.z2)})
+				spawnTriggers = append(spawnTriggers, i)
+			}
+			continue
+		default:
+			log.Println("Error: No text activator", bl, trig)
 			continue
 		}
 		msg := trig.msg
@@ -112,6 +123,25 @@ func (up *user) CheckAndActivateTriggers_WLwWLuWLqWLmWLc(bl block) {
 	}
 	cp.RUnlock()
 
+	// Spawn a monster at every spawn activator, unless there are already enough monsters near.
+	// The activator is then inhibited, the same way as text activators.
+	if len(spawners) > 0 {
+		cp.Lock()
+		for _, i := range spawnTriggers {
+			// The list may have been recomputed while the chunk was unlocked
+			if i < len(cp.blTriggers) && cp.blTriggers[i].x == x_off && cp.blTriggers[i].y == y_off && cp.blTriggers[i].z == z_off {
+				cp.blTriggers[i].inhibit = now.Add(CnfgDefaultTriggerBlockTime * time.Second)
+			}
+		}
+		cp.Unlock()
+	}
+	for i := range spawners {
+		ac := &spawners[i]
+		if CountNearMonsters_RLq(&TwoF{ac.X, ac.Y}) < MonsterLimitForRespawn {
+			ActivatorMessageMonster_WLuWLqWLm([]quadtree.Object{up}, ":0", ac)
+		}
+	}
+
 	// Now that there is a list of activators, possibly empty, the chunk no longer need to be locked.
 	for i, _ := range list {
 		msg := &list[i]
@@ -369,6 +399,7 @@ func ActivatorMessageAddKey_WLu(recepients []quadtree.Object, owner uint32, modi
 			key := keys.Make(owner, uint(keyId), name, uint(viewId))
 			up.Lock()
 			up.Keys = up.Keys.Add(key)
+			up.Journal("key " + name)
 			up.Unlock()
 		} else {
 			log.Println("Bad modifier", modifier, err1, err2)
@@ -443,7 +474,7 @@ func (ch *chunk) ComputeLinks() {
 	for x := 0; x < CHUNK_SIZE; x++ {
 		for y := 0; y < CHUNK_SIZE; y++ {
 			for z := 0; z < CHUNK_SIZE; z++ {
-				bl := ch.rc[x][y][z]
+				bl := ch.raw()[x][y][z]
 				if bl == BT_Text {
 					// Add an empty trigger message for this text block.
 					tm := textMsgActivator{uint8(x), uint8(y), uint8(z), nil, time.Unix(0, 0)}
@@ -521,7 +552,7 @@ func (ch *chunk) FollowLink_WLwWLc(x, y, z int, tested map[uint32]bool) {
 		// This block has already been visited
 		return
 	}
-	bl := ch.rc[x][y][z]
+	bl := ch.raw()[x][y][z]
 	if bl == BT_Spawn || bl == BT_Text {
 		// Found an activator.
 		// fmt.Printf("FollowLink: Activator %d at %d,%d,%d (chunk %v,)\n", bl, x, y, z, ch.Coord)
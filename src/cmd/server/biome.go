@@ -0,0 +1,260 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// A world generator with biomes. Two low frequency noise fields, temperature and humidity, decide
+// the biome of every column. Each biome has its own height profile, surface blocks and vegetation.
+// The height profiles of all biomes are mixed, weighted on how near the column is to the biome
+// in the temperature and humidity space, so there are no cliffs where the biome changes.
+//
+
+import (
+	"chunkdb"
+	"math"
+)
+
+type biome struct {
+	name                  string
+	temperature, humidity float64 // The climate where this biome is most common, in the range -1 to 1
+	base, highAmp, lowAmp float64 // The height profile
+	surface, subsurface   block   // The top block, and the blocks below it down to the stone
+	water, beach          block   // Used below the water level, and at the water level
+	tree3, tree2, tree1   float64 // Vegetation densities, the probability of every type on a surface block
+	flowers, tuft         float64
+}
+
+var biomes = []biome{
+	{name: "plains", temperature: 0.1, humidity: -0.2, base: 3, highAmp: 8, lowAmp: 8,
+		surface: BT_Soil, subsurface: BT_Soil, water: BT_Water, beach: BT_Sand,
+		tree3: 0.0001, tree2: 0.0004, tree1: 0.003, flowers: 0.008, tuft: 0.02},
+	{name: "forest", temperature: 0.1, humidity: 0.4, base: 4, highAmp: 20, lowAmp: 15,
+		surface: BT_Soil, subsurface: BT_Soil, water: BT_Water, beach: BT_Sand,
+		tree3: 0.002, tree2: 0.02, tree1: 0.01, flowers: 0.003, tuft: 0.01},
+	{name: "desert", temperature: 0.6, humidity: -0.6, base: 3, highAmp: 6, lowAmp: 10,
+		surface: BT_Sand, subsurface: BT_Sand, water: BT_Water, beach: BT_Sand,
+		tree1: 0.0005, tuft: 0.0005},
+	{name: "swamp", temperature: 0.5, humidity: 0.6, base: 0.5, highAmp: 2, lowAmp: 2,
+		surface: BT_Soil, subsurface: BT_Gravel, water: BT_BrownWater, beach: BT_Soil,
+		tree2: 0.002, tree1: 0.015, flowers: 0.002, tuft: 0.02},
+	{name: "tundra", temperature: -0.6, humidity: 0, base: 6, highAmp: 25, lowAmp: 15,
+		surface: BT_Snow, subsurface: BT_Gravel, water: BT_Water, beach: BT_Gravel,
+		tree2: 0.001, tree1: 0.001, tuft: 0.002},
+}
+
+const (
+	biomeClimateScale = 0.0007 // The frequency of the temperature and humidity fields. A lower number gives bigger biomes.
+	biomeBlend        = 0.1    // How wide the transition of height profiles between biomes is, in climate units
+)
+
+type biomeGenerator struct {
+	*simplexGenerator // Used for the noise functions and parameters
+}
+
+func newBiomeGenerator(params WorldParams) WorldGenerator {
+	return biomeGenerator{newSimplexGenerator(params).(*simplexGenerator)}
+}
+
+// Get the temperature and humidity of a column, in the range -1 to 1.
+func (g biomeGenerator) climate(xf, yf float64) (temperature, humidity float64) {
+	// Use offsets to get fields that are independent of each other, and of the terrain.
+	temperature = g.noise2(xf*biomeClimateScale+1000, yf*biomeClimateScale)
+	humidity = g.noise2(xf*biomeClimateScale, yf*biomeClimateScale+2000)
+	return
+}
+
+// Find the biome of a column, and the height of the stone. The height is a mix of the height profiles
+// of all biomes, to make it continuous.
+func (g biomeGenerator) column(xf, yf float64) (*biome, float64) {
+	t, h := g.climate(xf, yf)
+	highFreq := g.noise2(xf*0.016, yf*0.016)
+	f := g.noise2(xf*0.0025, yf*0.0025)
+	lowFreq := g.noise2(xf*0.0013, yf*0.0013)
+	var best *biome
+	var bestWeight, sumWeight, height float64
+	for i := range biomes {
+		b := &biomes[i]
+		dt, dh := t-b.temperature, h-b.humidity
+		w := math.Exp(-(dt*dt + dh*dh) / (biomeBlend * biomeBlend))
+		if best == nil || w > bestWeight {
+			best, bestWeight = b, w
+		}
+		sumWeight += w
+		height += w * (b.base + b.highAmp*highFreq*f*f + b.lowAmp*lowFreq)
+	}
+	if sumWeight > 0 {
+		height /= sumWeight
+	}
+	return best, math.Floor(height)
+}
+
+// Select a plant, or BT_Air, for a surface block.
+func (g biomeGenerator) vegetation(b *biome, xf, yf float64) block {
+	rnd := math.Abs(g.noise2(xf*422.34, yf*234.123)) // Without scaling, there is a line where xf+yf==0 gives rnd=0
+	// Use a low frequency function to make less plants for some areas, the same way as the original world.
+	lowFreq := 1 - math.Abs(g.noise2(xf*0.002, yf*0.002))
+	lowFreq = 1 - lowFreq*lowFreq
+	limit := 0.0
+	for _, p := range []struct {
+		prob float64
+		bl   block
+	}{{b.tree3, BT_Tree3}, {b.tree2, BT_Tree2}, {b.tree1, BT_Tree1}, {b.flowers, BT_Flowers}, {b.tuft, BT_Tuft}} {
+		limit += p.prob
+		if rnd < limit*lowFreq {
+			return p.bl
+		}
+	}
+	return BT_Air
+}
+
+func (g biomeGenerator) Generate(c chunkdb.CC, rc *raw_chunk) {
+	z1 := int(c.Z * CHUNK_SIZE)
+	for x := int32(0); x < CHUNK_SIZE; x++ {
+		xf := float64(x + c.X*CHUNK_SIZE)
+		for y := int32(0); y < CHUNK_SIZE; y++ {
+			yf := float64(y + c.Y*CHUNK_SIZE)
+			b, stoneheight := g.column(xf, yf)
+			surface, subsurface := g.surfaceBlocks(b, stoneheight)
+			soildepth := math.Floor(2*g.noise2(xf*0.012, yf*0.012) + 2.8)
+
+			// Iterate from high 'z' to low, to enable tests that depends on the block above.
+			for z := CHUNK_SIZE - 1; z >= 0; z-- {
+				zf := float64(z + z1)
+				if zf > g.FloatingIslandsLim {
+					g.floatingIsland(rc, x, y, z, xf, yf, zf)
+					continue
+				}
+				var bl block = BT_Air
+				switch depth := stoneheight - zf; {
+				case depth < 0:
+					if zf <= 0 {
+						bl = b.water
+					}
+				case depth == 0 && zf > 24:
+					bl = BT_Snow
+				case depth == 0:
+					bl = surface
+				case depth <= soildepth:
+					bl = subsurface
+				default:
+					bl = BT_Stone
+				}
+
+				// Excavate some holes and caves in the ground. Below the water level, they are filled with water.
+				if bl != BT_Air && bl != b.water && g.excavate(xf, yf, zf) {
+					bl = BT_Air
+					if zf <= 0 {
+						bl = b.water
+					}
+				}
+				rc[x][y][z] = bl
+			}
+		}
+	}
+}
+
+// Add vegetation to the surface of the base terrain. The surface can be in the chunk below.
+func (g biomeGenerator) Decorate(c chunkdb.CC, rc *raw_chunk, base *baseTerrain) {
+	z1 := int(c.Z * CHUNK_SIZE)
+	for x := int32(0); x < CHUNK_SIZE; x++ {
+		xf := float64(x + c.X*CHUNK_SIZE)
+		for y := int32(0); y < CHUNK_SIZE; y++ {
+			yf := float64(y + c.Y*CHUNK_SIZE)
+			var b *biome // Only computed when needed, as it is expensive
+			var stoneheight float64
+			for z := 0; z < CHUNK_SIZE; z++ {
+				if rc[x][y][z] != BT_Air {
+					continue
+				}
+				var below block
+				if z > 0 {
+					below = rc[x][y][z-1]
+				} else {
+					below = base.Block(c, int(x), int(y), -1)
+				}
+				if below != BT_Soil && below != BT_Sand && below != BT_Snow {
+					continue
+				}
+				if b == nil {
+					b, stoneheight = g.column(xf, yf)
+				}
+				if surface, _ := g.surfaceBlocks(b, stoneheight); float64(z+z1-1) != stoneheight || below != surface || surface != b.surface {
+					continue // Not the natural surface of the biome
+				}
+				rc[x][y][z] = g.vegetation(b, xf, yf)
+			}
+		}
+	}
+	if g.Ores {
+		addOres(g.Seed, c, rc)
+	}
+}
+
+// Get the surface block, and the blocks below it, of a column.
+func (g biomeGenerator) surfaceBlocks(b *biome, stoneheight float64) (surface, subsurface block) {
+	surface, subsurface = b.surface, b.subsurface
+	if surface == BT_Soil && stoneheight > g.SoilLevel {
+		surface, subsurface = BT_Stone, BT_Stone // No soil on the mountains
+	}
+	if stoneheight == 0 {
+		surface = b.beach
+	}
+	return
+}
+
+// Floating islands, the same way as the original world.
+func (g biomeGenerator) floatingIsland(rc *raw_chunk, x, y int32, z int, xf, yf, zf float64) {
+	// Use a gradial transient, or all islands would have a hard cut off.
+	f := (1-g.FloatingIslandsProb)/CHUNK_SIZE*(zf-g.FloatingIslandsLim) + g.FloatingIslandsProb
+	if f > 1 {
+		f = 1
+	}
+	rc[x][y][z] = BT_Air
+	if f*g.density(xf/2, yf/2, zf) > g.FloatingIslandsProb {
+		if z != CHUNK_SIZE-1 && rc[x][y][z+1].Invisible() {
+			rc[x][y][z] = BT_Soil // Put grass on top
+		} else {
+			rc[x][y][z] = BT_Stone
+		}
+	}
+}
+
+// The level of the top of the ground, not counting holes and caves.
+func (g biomeGenerator) GroundHeight(xf, yf float64) float64 {
+	_, stoneheight := g.column(xf, yf)
+	return stoneheight
+}
+
+func (g biomeGenerator) IsCave(xf, yf, zf float64) bool {
+	return zf <= g.GroundHeight(xf, yf) && g.isCave(xf, yf, zf)
+}
+
+// Test if a block in the ground shall be removed to make holes and caves.
+func (g biomeGenerator) excavate(xf, yf, zf float64) bool {
+	const HOLEDEPTH = 50 // Max depth of hole
+	if zf > -HOLEDEPTH && zf < HOLEDEPTH {
+		fadeoff := 1.0
+		if zf <= 0 {
+			fadeoff = (HOLEDEPTH + zf) / HOLEDEPTH
+		}
+		if g.density(xf, yf, zf)*fadeoff > 0.7 {
+			return true
+		}
+	}
+	return g.isCave(xf, yf, zf)
+}
@@ -0,0 +1,142 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// The registry of block types. Every block type declares its properties here, and all other code
+// shall use the properties instead of testing for specific block types. Block types that are not
+// registered can't be added by players.
+//
+
+import (
+	"log"
+)
+
+// The properties of a block type.
+type blockType struct {
+	name          string
+	solid         bool       // Players and monsters can't pass through it
+	invisible     bool       // Not shown by the client
+	transparent   bool       // Light passes through it
+	liquid        bool       // Players swim in it
+	climbable     bool       // Players can climb when they are next to it
+	light         uint8      // The light emitted, 0 for none and 15 for the most
+	breakable     bool       // Players can remove it. Admins can always remove blocks.
+	ownerOnly     bool       // Only the owner of the chunk can remove it
+	drops         ObjectCode // The resource a player gets when removing it, if any
+	generatedOnly bool       // Only created by the world generator, players can't add it
+	virtual       bool       // Never stored in a chunk
+	hidden        bool       // Only sent to the owner of the chunk, other players see air
+}
+
+var blockTypes = [256]blockType{
+	BT_Stone:         {name: "stone", solid: true, breakable: true, ownerOnly: true, drops: ItemStoneID},
+	BT_Water:         {name: "water", transparent: true, liquid: true, breakable: true, ownerOnly: true},
+	BT_Air:           {name: "air", invisible: true, transparent: true},
+	BT_Brick:         {name: "brick", solid: true, breakable: true, ownerOnly: true},
+	BT_Soil:          {name: "soil", solid: true, breakable: true, ownerOnly: true, drops: ItemSoilID},
+	BT_Logs:          {name: "logs", solid: true, breakable: true, ownerOnly: true},
+	BT_Sand:          {name: "sand", solid: true, breakable: true, ownerOnly: true, drops: ItemSandID},
+	BT_Tree1:         {name: "bush", transparent: true, breakable: true, ownerOnly: true, drops: ItemWoodID},
+	BT_Tree2:         {name: "tree", transparent: true, breakable: true, ownerOnly: true, drops: ItemWoodID},
+	BT_Tree3:         {name: "big tree", transparent: true, breakable: true, ownerOnly: true, drops: ItemWoodID},
+	BT_Lamp1:         {name: "lamp", transparent: true, light: 8, breakable: true, ownerOnly: true},
+	BT_Lamp2:         {name: "big lamp", transparent: true, light: 14, breakable: true, ownerOnly: true},
+	BT_Cobblestone:   {name: "cobblestone", solid: true, breakable: true, ownerOnly: true},
+	BT_Ladder:        {name: "ladder", solid: true, climbable: true, breakable: true, ownerOnly: true},
+	BT_Hedge:         {name: "hedge", solid: true, breakable: true, ownerOnly: true},
+	BT_Window:        {name: "window", solid: true, transparent: true, breakable: true, ownerOnly: true},
+	BT_Snow:          {name: "snow", solid: true, breakable: true, ownerOnly: true},
+	BT_BrownWater:    {name: "brown water", transparent: true, liquid: true, breakable: true, ownerOnly: true},
+	BT_Black:         {name: "black", solid: true, breakable: true, ownerOnly: true},
+	BT_Concrete:      {name: "concrete", solid: true, breakable: true, ownerOnly: true},
+	BT_WhiteConcrete: {name: "white concrete", solid: true, breakable: true, ownerOnly: true},
+	BT_Gravel:        {name: "gravel", solid: true, breakable: true, ownerOnly: true, drops: ItemGravelID},
+	BT_TiledStone:    {name: "tiled stone", solid: true, breakable: true, ownerOnly: true},
+	BT_SmallFog:      {name: "small fog", invisible: true, transparent: true, breakable: true, ownerOnly: true},
+	BT_BigFog:        {name: "big fog", invisible: true, transparent: true, breakable: true, ownerOnly: true},
+	BT_Treasure:      {name: "treasure", transparent: true, breakable: true, ownerOnly: true},
+	BT_Quest:         {name: "quest", transparent: true, breakable: true, ownerOnly: true},
+	BT_Tuft:          {name: "tuft", transparent: true, breakable: true, ownerOnly: true},
+	BT_Flowers:       {name: "flowers", transparent: true, breakable: true, ownerOnly: true},
+	BT_Bark:          {name: "bark", solid: true, breakable: true, ownerOnly: true},
+	BT_RedLight:      {name: "red light", invisible: true, transparent: true, light: 10, breakable: true, ownerOnly: true},
+	BT_GreenLight:    {name: "green light", invisible: true, transparent: true, light: 10, breakable: true, ownerOnly: true},
+	BT_BlueLight:     {name: "blue light", invisible: true, transparent: true, light: 10, breakable: true, ownerOnly: true},
+	BT_Coal:          {name: "coal", solid: true, breakable: true, ownerOnly: true, drops: ItemCoalID, generatedOnly: true},
+	BT_IronOre:       {name: "iron ore", solid: true, breakable: true, ownerOnly: true, drops: ItemIronOreID, generatedOnly: true},
+	BT_GoldOre:       {name: "gold ore", solid: true, breakable: true, ownerOnly: true, drops: ItemGoldOreID, generatedOnly: true},
+
+	BT_Stone2:   {name: "stone2", solid: true, breakable: true, ownerOnly: true},
+	BT_Topsoil:  {name: "topsoil", solid: true, virtual: true},
+	BT_Teleport: {name: "teleport", solid: true, breakable: true, ownerOnly: true, virtual: true},
+
+	BT_Text:      {name: "text", invisible: true, transparent: true, breakable: true, ownerOnly: true, hidden: true},
+	BT_DeTrigger: {name: "detrigger", invisible: true, transparent: true, breakable: true, ownerOnly: true, hidden: true},
+	BT_Spawn:     {name: "spawn", invisible: true, transparent: true, breakable: true, ownerOnly: true, hidden: true},
+	BT_Link:      {name: "link", invisible: true, transparent: true, breakable: true, ownerOnly: true, hidden: true},
+	BT_Trigger:   {name: "trigger", invisible: true, transparent: true, breakable: true, ownerOnly: true, hidden: true},
+}
+
+func (bl block) Registered() bool  { return blockTypes[bl].name != "" }
+func (bl block) Invisible() bool   { return blockTypes[bl].invisible }
+func (bl block) Transparent() bool { return blockTypes[bl].transparent }
+func (bl block) Liquid() bool      { return blockTypes[bl].liquid }
+func (bl block) Climbable() bool   { return blockTypes[bl].climbable }
+func (bl block) Light() uint8      { return blockTypes[bl].light }
+
+// Block types that are not registered are solid, to be on the safe side.
+func (bl block) Solid() bool {
+	t := &blockTypes[bl]
+	return t.solid || t.name == ""
+}
+
+// Test if a player may remove a block of type 'bl' in chunk 'cp'. A message is sent to the player if not.
+func (up *user) mayRemove_Bl(cp *chunk, bl block) bool {
+	t := &blockTypes[bl]
+	switch {
+	case up.AdminLevel > 0:
+		return true
+	case !t.breakable:
+		up.Printf_Bl("#FAIL Can't be removed")
+		return false
+	case t.ownerOnly && cp.owner != up.Id:
+		up.Printf_Bl("#FAIL Not owner of chunk. See help for territory")
+		return false
+	}
+	return true
+}
+
+// Test if a player may add a block of type 'bl'. A message is sent to the player if not.
+func (up *user) mayAdd(bl block) bool {
+	t := &blockTypes[bl]
+	switch {
+	case !bl.Registered() || t.virtual || bl == BT_Air:
+		log.Println("Player", up.Name, "tried to add block type", bl)
+		return false
+	case t.generatedOnly && up.AdminLevel < 1:
+		up.Printf("#FAIL %s can only be found, not added", t.name)
+		return false
+	}
+	return true
+}
+
+// True if player 'up' shall see the hidden blocks of chunk 'cp'.
+func (cp *chunk) showHidden(up *user) bool {
+	return cp.owner == up.Id || up.AdminLevel > 0
+}
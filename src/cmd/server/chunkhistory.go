@@ -0,0 +1,248 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// The last versions of every modified chunk are saved, which makes it possible to roll back
+// a chunk to an earlier state. The versions are kept some time apart, so that a chunk that is
+// edited all the time still has a history that goes back more than a few saves. Every version
+// is a complete copy of the chunk file, including the activator messages. They are stored in
+// a sub folder for each chunk, in the history folder, with the time of the save (in nanoseconds)
+// as the file name.
+//
+
+import (
+	"chunkdb"
+	"ephenationdb"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	chunkHistorySize     = CnfgChunkHistorySize                    // Number of versions saved for every chunk. 0 to disable.
+	chunkHistoryInterval = time.Duration(CnfgChunkHistoryInterval) // Min time between two saved versions
+)
+
+func chunkHistoryFolder(cc chunkdb.CC) string {
+	return fmt.Sprintf(CnfgChunkHistoryFolder+"/%d,%d,%d", cc.X, cc.Y, cc.Z)
+}
+
+func chunkVersionFileName(cc chunkdb.CC, t time.Time) string {
+	return filepath.Join(chunkHistoryFolder(cc), strconv.FormatInt(t.UnixNano(), 10))
+}
+
+// Save a copy of a chunk file in the history, and remove the oldest versions if there are too many.
+// The versions are kept at least chunkHistoryInterval apart, except the newest one. It is replaced
+// when it is too close to the version before it.
+func saveChunkHistory(cc chunkdb.CC, data []byte) {
+	if chunkHistorySize <= 0 {
+		return
+	}
+	if err := os.MkdirAll(chunkHistoryFolder(cc), 0777); err != nil {
+		log.Println("saveChunkHistory:", err)
+		return
+	}
+	fn := chunkVersionFileName(cc, time.Now())
+	if err := ioutil.WriteFile(fn, data, 0666); err != nil {
+		log.Println("saveChunkHistory:", err)
+		return
+	}
+	versions := chunkHistory(cc)
+	if len(versions) > 2 && versions[1].Sub(versions[2]) < chunkHistoryInterval {
+		os.Remove(chunkVersionFileName(cc, versions[1]))
+		versions = append(versions[:1], versions[2:]...)
+	}
+	for i := chunkHistorySize; i < len(versions); i++ {
+		os.Remove(chunkVersionFileName(cc, versions[i]))
+	}
+}
+
+type timeList []time.Time
+
+func (l timeList) Len() int           { return len(l) }
+func (l timeList) Less(i, j int) bool { return l[i].After(l[j]) }
+func (l timeList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Get the time of all saved versions of a chunk, the newest first.
+func chunkHistory(cc chunkdb.CC) []time.Time {
+	dir, err := ioutil.ReadDir(chunkHistoryFolder(cc))
+	if err != nil {
+		return nil
+	}
+	var list timeList
+	for _, fi := range dir {
+		ns, err := strconv.ParseInt(fi.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		list = append(list, time.Unix(0, ns))
+	}
+	sort.Sort(list)
+	return list
+}
+
+// Find the newest version of a chunk that was saved no later than 't'.
+// Return false if there is no such version.
+func chunkVersionAt(cc chunkdb.CC, t time.Time) (time.Time, bool) {
+	for _, v := range chunkHistory(cc) {
+		if !v.After(t) {
+			return v, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Load a saved version of a chunk. Return nil if it failed.
+func loadChunkVersion(cc chunkdb.CC, t time.Time) *chunk {
+	b, err := ioutil.ReadFile(chunkVersionFileName(cc, t))
+	if err != nil {
+		log.Println("loadChunkVersion:", err)
+		return nil
+	}
+	return dBDecodeChunk(cc, b)
+}
+
+// Replace the content of the chunk with the content of the version saved at time 't'. The owner is not changed.
+// Near players get the updated chunk.
+func (cp *chunk) Rollback_WLcRLq(t time.Time) bool {
+	version := loadChunkVersion(cp.Coord, t)
+	if version == nil || version.rc.Load() == nil {
+		return false
+	}
+	cp.Lock()
+	cp.rc.Store(version.rc.Load())
+	cp.ch_comp = version.ch_comp
+	cp.ch_comp2 = nil
+	cp.checkSum = version.checkSum
+	cp.triggerMsgs = version.triggerMsgs
+	cp.liquidLevels = version.liquidLevels
+	cp.lights, cp.lightsKnown = nil, false
+	cp.jellyBlocks = nil
+	cp.ComputeLinks()
+	cp.flag |= CHF_MODIFIED
+	cp.WriteDelayed()
+	cp.Unlock()
+	ResendChunkToNearPlayers_RLq(cp.Coord, false)
+	return true
+}
+
+// Find the territory of a player. It is taken from the database if the player isn't logged in.
+func territoryOf_RLa(uid uint32) []chunkdb.CC {
+	allPlayersSem.RLock()
+	other, ok := allPlayerIdMap[uid]
+	allPlayersSem.RUnlock()
+	if ok {
+		other.RLock()
+		defer other.RUnlock()
+		return append([]chunkdb.CC(nil), other.Territory...)
+	}
+	var avatar struct {
+		Territory []chunkdb.CC
+	}
+	db := ephenationdb.New()
+	if db == nil {
+		return nil
+	}
+	if err := db.C("avatars").FindId(uid).One(&avatar); err != nil {
+		log.Println("territoryOf", uid, err)
+		return nil
+	}
+	return avatar.Territory
+}
+
+// Handle "/territory history" and "/territory rollback". The chunk where the player is will be used.
+// Only the owner of the chunk, or an admin, may do this.
+func (up *user) TerritoryHistory_WLwWLcRLaRLqBl(msg []string) {
+	const usage = "#FAIL !Usage: /territory history, /territory rollback [all] [version|age]"
+	cc := up.Coord.GetChunkCoord()
+	cp := ChunkFind_WLwWLc(cc)
+	owner := cp.owner
+	if owner != up.Id && up.AdminLevel < 5 {
+		up.Printf_Bl("#FAIL !Not owner of chunk")
+		return
+	}
+	now := time.Now()
+	switch {
+	case msg[0] == "history" && len(msg) == 1:
+		versions := chunkHistory(cc)
+		if len(versions) == 0 {
+			up.Printf_Bl("!No saved versions of chunk %v", cc)
+		}
+		for i, t := range versions {
+			up.Printf_Bl("!%d: %s (%v ago)", i+1, t.Format("2006-01-02 15:04:05"), now.Sub(t)/time.Second*time.Second)
+		}
+	case msg[0] == "rollback" && len(msg) == 2:
+		var t time.Time
+		if n, err := strconv.Atoi(msg[1]); err == nil {
+			versions := chunkHistory(cc)
+			if n < 1 || n > len(versions) {
+				up.Printf_Bl("#FAIL !No version %d", n)
+				return
+			}
+			t = versions[n-1]
+		} else if age, err := time.ParseDuration(msg[1]); err == nil {
+			var ok bool
+			t, ok = chunkVersionAt(cc, now.Add(-age))
+			if !ok {
+				up.Printf_Bl("#FAIL !No version of chunk %v that old", cc)
+				return
+			}
+		} else {
+			up.Printf_Bl(usage)
+			return
+		}
+		if !cp.Rollback_WLcRLq(t) {
+			up.Printf_Bl("#FAIL !Rollback failed")
+			return
+		}
+		up.Printf_Bl("!Chunk %v rolled back to %s", cc, t.Format("2006-01-02 15:04:05"))
+	case msg[0] == "rollback" && len(msg) == 3 && msg[1] == "all":
+		age, err := time.ParseDuration(msg[2])
+		if err != nil {
+			up.Printf_Bl(usage)
+			return
+		}
+		if owner == OWNER_NONE || owner == OWNER_RESERVED {
+			up.Printf_Bl("#FAIL !This chunk is not part of a territory")
+			return
+		}
+		var done, skipped int
+		for _, c := range territoryOf_RLa(owner) {
+			t, ok := chunkVersionAt(c, now.Add(-age))
+			if !ok {
+				skipped++
+				continue
+			}
+			ch := ChunkFind_WLwWLc(c)
+			if ch.owner != owner || !ch.Rollback_WLcRLq(t) {
+				skipped++
+				continue
+			}
+			done++
+		}
+		up.Printf_Bl("!Rolled back %d chunks, skipped %d chunks", done, skipped)
+	default:
+		up.Printf_Bl(usage)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Modified chunks are not saved to disk immediately. Instead, they are marked as dirty,
+// and a background process saves them in batches. A chunk that is modified several times
+// between two batches is only saved once. The checksum and the compressed data are
+// always updated immediately, it is only the file system access that is delayed.
+//
+
+import (
+	"chunkdb"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"time"
+	"timerstats"
+)
+
+var (
+	dirtyChunks     = make(map[chunkdb.CC]*chunk) // Chunks waiting to be saved
+	savingChunks    map[chunkdb.CC]*chunk         // Chunks currently being saved by a flush
+	dirtyChunksLock sync.RWMutex                  // Protects dirtyChunks and savingChunks
+	chunkFlushOne   sync.Mutex                    // Only one flush at a time
+	chunkFlushLock  sync.RWMutex                  // Chunks are saved with a read lock, a snapshot takes a write lock
+	chunkSavePeriod = time.Duration(CnfgChunkSavePeriod)
+
+	ChunkSaveStats struct {
+		NumRequests int // Number of requests to save a chunk
+		NumWrites   int // Number of chunks actually written
+		NumBatches  int // Number of flushes that had something to save
+	}
+)
+
+// Request the chunk to be saved. The chunk is expected to be locked by the caller, but it is
+// not saved until later, and only the latest state is saved.
+func (cp *chunk) WriteDelayed() {
+	dirtyChunksLock.Lock()
+	dirtyChunks[cp.Coord] = cp
+	ChunkSaveStats.NumRequests++
+	dirtyChunksLock.Unlock()
+}
+
+// Find a chunk that is waiting to be saved. If it is found, it must be used instead of reading
+// the chunk from file, as the file may not be up to date. Return nil if not found.
+func dirtyChunkFind(cc chunkdb.CC) *chunk {
+	dirtyChunksLock.RLock()
+	defer dirtyChunksLock.RUnlock()
+	if cp, ok := dirtyChunks[cc]; ok {
+		return cp
+	}
+	return savingChunks[cc]
+}
+
+// The number of chunks waiting to be saved.
+func NumDirtyChunks() int {
+	dirtyChunksLock.RLock()
+	defer dirtyChunksLock.RUnlock()
+	return len(dirtyChunks)
+}
+
+// Save all dirty chunks. Return the number of chunks that were saved.
+func FlushDirtyChunks() int {
+	chunkFlushOne.Lock()
+	defer chunkFlushOne.Unlock()
+	chunkFlushLock.RLock()
+	defer chunkFlushLock.RUnlock()
+	return flushDirtyChunks()
+}
+
+// Save all dirty chunks. The caller must hold chunkFlushLock. Chunks that could not be
+// written are put back in the queue, to be tried again by the next flush.
+func flushDirtyChunks() int {
+	dirtyChunksLock.Lock()
+	list := dirtyChunks
+	if len(list) == 0 {
+		dirtyChunksLock.Unlock()
+		return 0
+	}
+	dirtyChunks = make(map[chunkdb.CC]*chunk)
+	// Keep them findable until they have been saved
+	savingChunks = list
+	dirtyChunksLock.Unlock()
+
+	var failed []*chunk
+	for _, cp := range list {
+		cp.RLock()
+		// A chunk with a file that couldn't be read is never saved, there is no use trying again.
+		if !cp.Write() && !cp.unreadable {
+			failed = append(failed, cp)
+		}
+		cp.RUnlock()
+	}
+
+	dirtyChunksLock.Lock()
+	savingChunks = nil
+	for _, cp := range failed {
+		if _, ok := dirtyChunks[cp.Coord]; !ok {
+			dirtyChunks[cp.Coord] = cp
+		}
+	}
+	ChunkSaveStats.NumWrites += len(list) - len(failed)
+	ChunkSaveStats.NumBatches++
+	dirtyChunksLock.Unlock()
+	return len(list) - len(failed)
+}
+
+// Periodically save all modified chunks.
+func ProcSaveDirtyChunks() {
+	var elapsed time.Duration
+	timerstats.Add("ProcSaveDirtyChunks", chunkSavePeriod, &elapsed)
+	for {
+		time.Sleep(chunkSavePeriod)
+		start := time.Now()
+		FlushDirtyChunks()
+		elapsed = time.Now().Sub(start)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Collision between moving bodies, players and monsters, and solid blocks. A body is an axis aligned
+// box, with the position at the center of the bottom. A movement is done one axis at a time, and
+// every block the box passes on the way is tested. That way, a body can't pass through thin walls
+// however long the movement is, and it slides along a wall when moving at an angle towards it.
+//
+// A body that is stopped by a wall can step up one block, if there is room for it.
+//
+
+import (
+	"math"
+)
+
+// The size of a moving body, in blocks
+type bodySize struct {
+	width, height float64
+}
+
+var (
+	playerBody  = bodySize{CnfgPlayerWidth, PlayerHeight}
+	monsterBody = bodySize{CnfgMonsterWidth, MonsterHeight}
+)
+
+// Box borders that are this close to a block border are not inside the block. It prevents
+// rounding errors from making a body stuck when touching a wall.
+const collisionEps = 1e-6
+
+// The offsets from the position to the corners of the box
+func (b bodySize) box() (lo, hi [3]float64) {
+	return [3]float64{-b.width / 2, -b.width / 2, 0}, [3]float64{b.width / 2, b.width / 2, b.height}
+}
+
+// The first and last block overlapped by an interval on one axis
+func firstBlock(lo float64) int64 { return int64(math.Floor(lo + collisionEps)) }
+func lastBlock(hi float64) int64  { return int64(math.Floor(hi - collisionEps)) }
+
+// Test if there is any solid block in the box of blocks from 'lo' to 'hi', inclusive.
+func solidBlocks_WLwWLc(lo, hi [3]int64) bool {
+	for x := lo[0]; x <= hi[0]; x++ {
+		for y := lo[1]; y <= hi[1]; y++ {
+			for z := lo[2]; z <= hi[2]; z++ {
+				if DBGetBlockCached_WLwWLc(user_coord{float64(x), float64(y), float64(z)}).Solid() {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Test if the body has room at 'pos'.
+func (b bodySize) Fits_WLwWLc(pos user_coord) bool {
+	lo, hi := b.box()
+	p := [3]float64{pos.X, pos.Y, pos.Z}
+	var blo, bhi [3]int64
+	for i := range p {
+		blo[i], bhi[i] = firstBlock(p[i]+lo[i]), lastBlock(p[i]+hi[i])
+	}
+	return !solidBlocks_WLwWLc(blo, bhi)
+}
+
+// Move the body at 'p' a distance 'd' along 'axis', or until it is stopped by a solid block. Return
+// true if it was stopped.
+func (b bodySize) sweep_WLwWLc(p *[3]float64, axis int, d float64) bool {
+	if d == 0 {
+		return false
+	}
+	lo, hi := b.box()
+	var blo, bhi [3]int64 // The blocks that the box passes through
+	for i := range p {
+		blo[i], bhi[i] = firstBlock(p[i]+lo[i]), lastBlock(p[i]+hi[i])
+	}
+	if d > 0 {
+		// Test the blocks in front of the box, one layer at a time
+		for bl := bhi[axis] + 1; bl <= lastBlock(p[axis]+hi[axis]+d); bl++ {
+			blo[axis], bhi[axis] = bl, bl
+			if solidBlocks_WLwWLc(blo, bhi) {
+				p[axis] = float64(bl) - hi[axis]
+				return true
+			}
+		}
+	} else {
+		for bl := blo[axis] - 1; bl >= firstBlock(p[axis]+lo[axis]+d); bl-- {
+			blo[axis], bhi[axis] = bl, bl
+			if solidBlocks_WLwWLc(blo, bhi) {
+				p[axis] = float64(bl+1) - lo[axis]
+				return true
+			}
+		}
+	}
+	p[axis] += d
+	return false
+}
+
+// Move the body at 'pos' by dx, dy and dz. It is stopped by solid blocks, and slides along them. If
+// 'stepUp' is true, the body steps up one block when that makes it come further. Return the new
+// position, and true if the horizontal movement was stopped.
+func (b bodySize) Move_WLwWLc(pos user_coord, dx, dy, dz float64, stepUp bool) (user_coord, bool) {
+	p := [3]float64{pos.X, pos.Y, pos.Z}
+	b.sweep_WLwWLc(&p, 2, dz)
+	start := p
+	stoppedX := b.sweep_WLwWLc(&p, 0, dx)
+	stoppedY := b.sweep_WLwWLc(&p, 1, dy)
+	stopped := stoppedX || stoppedY
+	if stopped && stepUp {
+		q := start
+		if !b.sweep_WLwWLc(&q, 2, 1) {
+			stoppedX = b.sweep_WLwWLc(&q, 0, dx)
+			stoppedY = b.sweep_WLwWLc(&q, 1, dy)
+			moved := func(r [3]float64) float64 {
+				return (r[0]-start[0])*(r[0]-start[0]) + (r[1]-start[1])*(r[1]-start[1])
+			}
+			if moved(q) > moved(p) {
+				p, stopped = q, stoppedX || stoppedY
+			}
+		}
+	}
+	return user_coord{p[0], p[1], p[2]}, stopped
+}
+
+// Move the body at 'pos' up or down by 'dz'. Return true if it was stopped by a solid block.
+func (b bodySize) MoveVert_WLwWLc(pos *user_coord, dz float64) bool {
+	p := [3]float64{pos.X, pos.Y, pos.Z}
+	stopped := b.sweep_WLwWLc(&p, 2, dz)
+	pos.Z = p[2]
+	return stopped
+}
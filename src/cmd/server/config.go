@@ -49,6 +49,9 @@ const (
 	LoginChallengeLength        = 20        // The number of random bytes used in login, sent to the client.
 	FlyingSpeedFactor           = 3         // How much quicker you fly than walking
 	PlayerHeight                = 1.8 * 2   // Height of player 180 cm = 1.8m = 3.6 blocks
+	CnfgPlayerWidth             = 0.6       // Default width of a player, in blocks, used for collisions
+	CnfgMonsterWidth            = 0.6       // Width of a monster, in blocks, used for collisions
+	MonsterHeight               = 3         // Height of a monster, in blocks, used for collisions
 	PlayerJumpSpeed             = 2         // Number of blocks per seoond intial upward speed.
 	WORLD_SOIL_LEVEL            = 9         // No soil above this level
 	FLOATING_ISLANDS_LIM        = 96        // No floating islands are created below this level
@@ -68,4 +71,35 @@ const (
 	CnfgScoreDamageFact         = 1.0 / 5   // Number of monsters that need to be killed for one point
 	CnfgChunkFolder             = "DB"      // The folder where all chunks are stored
 	CnfgSuperChunkFolder        = "SDB"     // The folder where all super chunks are stored
+	CnfgSnapshotFolder          = "backup"  // The folder where world snapshots are stored
+	CnfgChunkSavePeriod         = 5e9       // Default max time a modified chunk waits before being saved
+	CnfgChunkHistoryFolder      = "HDB"     // The folder where old versions of modified chunks are stored
+	CnfgChunkHistorySize        = 10        // Default number of old versions saved for every modified chunk
+	CnfgChunkHistoryInterval    = 6e11      // Default min time between two saved versions of a chunk
+	CnfgSchematicFolder         = "SCHEM"   // The folder where exported regions are stored
+	CnfgJournalFolder           = "JDB"     // The folder where player journals are stored
+	CnfgCacheMemory             = 500e6     // Default memory budget for chunks in the cache, in bytes
+	CnfgCachePurgePeriod        = 1e9       // How often the chunk cache is checked for chunks to throw away
+	CnfgCachePurgeShards        = 4         // Number of cache shards checked every period
+	CnfgCacheMaxIdle            = 36e11     // Chunks not used for this long are thrown away from the cache
+	CnfgRawChunkIdle            = 6e10      // Chunks not used for this long only keep the compressed copy in the cache
+	CnfgChunkLoaders            = 4         // Default max number of chunks loaded or created at the same time
+	CnfgPrefetchPeriod          = 1e9       // How often chunks are loaded in advance for moving players
+	CnfgPrefetchAhead           = 5e9       // How far ahead in time the position of a player is predicted
+	CnfgPrefetchBudget          = 20        // Default max number of chunks loaded in advance every period
+	CnfgBaseTerrainCache        = 128       // Number of chunks of base terrain saved for the decoration of neighbor chunks
+	CnfgLiquidPeriod            = 2.5e8     // How often flowing liquids move one step
+	CnfgLiquidBudget            = 1000      // Max number of liquid blocks updated every period
+	CnfgLiquidLevels            = 7         // The level of liquid sources. Flowing liquid loses one level for every block sideways.
+	CnfgRandomTickPeriod        = 1e9       // How often random blocks in the loaded chunks are updated
+	CnfgRandomTicks             = 3         // Default number of random blocks updated in every chunk, every period
+	CnfgPlantGrowth             = 0.02      // Default probability that an updated soil block grows a plant
+	CnfgTreeGrowth              = 0.01      // Default probability that an updated bush or tree grows
+	CnfgSnowfall                = 0.05      // Default probability that an updated soil block above the snow line gets snow
+	CnfgPlantDecay              = 0.2       // Default probability that an updated plant without soil withers
+	CnfgSnowLine                = 24        // Soil above this height can be covered by snow
+	CnfgMaxPlants               = 4         // Default max number of plants near soil that grows a new one
+	CnfgSkyLight                = 2         // Default light level of blocks exposed to the sky
+	CnfgSkyScan                 = 64        // The number of blocks above a block that are tested for sky exposure
+	CnfgMonsterMaxLight         = 4         // Default light level where monsters no longer spawn
 )
@@ -21,92 +21,153 @@ import (
 	// "fmt"
 	"chunkdb"
 	"github.com/larspensjo/Go-simplex-noise/simplexnoise"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
 	"math"
+	"math/rand"
 	"time"
 )
 
-func dBdensity(xf, yf, zf float64) float64 {
-	return simplexnoise.Noise3(xf*0.01, yf*0.01, zf*0.01)/2 + 0.5 // Now in range 0-1
-}
-
 var DBCreateStats struct {
-	Num     int
-	TotTime time.Duration
+	sync.Mutex // Chunks can be created concurrently
+	Num        int
+	TotTime    time.Duration
 }
 
-// For a chunk at a coordinate, create it.
+// For a chunk at a coordinate, create it using the current world generator.
 // There is no need for a lock, as no one can access the chunk
-// TODO: Some algorithms depend on looking at the block above, which can only be done when inside the
-// chunk. If the test would require looking at another chunk, the tets skipped. This leads to some special
-// effects failure.
 func dBCreateChunk(c chunkdb.CC) *chunk {
 	start := time.Now()
 	ch := new(chunk)
-	ch.rc = new(raw_chunk)
 	ch.Coord = c
+	if *inhibitCreateChunks {
+		ch.rc.Store(newAirChunk())
+	} else {
+		rc := generateChunk(worldGen, c)
+		ch.rc.Store(rc)
+		ch.triggerMsgs = addStructures(worldGen, worldParams, c, rc)
+	}
+	ch.compressAndChecksum()
+	if ch.triggerMsgs != nil {
+		ch.ComputeLinks()
+	}
+	delta := time.Now().Sub(start)
+	DBCreateStats.Lock()
+	DBCreateStats.Num++
+	DBCreateStats.TotTime += delta
+	DBCreateStats.Unlock()
+	return ch
+}
+
+// The original world generator, based on simplex noise. The seed moves the part of the noise
+// functions that is used, which means seed 0 gives the original world.
+type simplexGenerator struct {
+	WorldParams
+	ox, oy, oz float64 // Offset added to all noise coordinates, derived from the seed
+}
+
+func newSimplexGenerator(params WorldParams) WorldGenerator {
+	g := &simplexGenerator{WorldParams: params}
+	if params.Seed != 0 {
+		const maxOffset = 1e4
+		r := rand.New(rand.NewSource(params.Seed))
+		g.ox, g.oy, g.oz = r.Float64()*maxOffset, r.Float64()*maxOffset, r.Float64()*maxOffset
+	}
+	return g
+}
+
+func (g *simplexGenerator) noise2(x, y float64) float64 {
+	return simplexnoise.Noise2(x+g.ox, y+g.oy)
+}
+
+func (g *simplexGenerator) density(xf, yf, zf float64) float64 {
+	return simplexnoise.Noise3(xf*0.01+g.ox, yf*0.01+g.oy, zf*0.01+g.oz)/2 + 0.5 // Now in range 0-1
+}
+
+// Get the height of the stone, and the depth of the soil above it, of a column.
+func (g *simplexGenerator) column(xf, yf float64) (stoneheight, soildepth float64) {
+	highFreq := 20 * g.noise2(xf*0.016, yf*0.016)  // This will generate high frequency terrain
+	f := g.noise2(xf*0.0025, yf*0.0025)            // Factor to modulate the high frequency amplitude
+	lowFreq := 15 * g.noise2(xf*0.0013, yf*0.0013) // Low frequency terrain
+	stoneheight = math.Floor(2.5 + highFreq*f*f + lowFreq)
+	soildepth = math.Floor(2*g.noise2(xf*0.012, yf*0.012) + 2.8)
+	if stoneheight > g.SoilLevel {
+		soildepth = 0
+	} else if soildepth+stoneheight > g.SoilLevel {
+		soildepth = g.SoilLevel - stoneheight
+	}
+	return
+}
+
+// Test if a block is inside a cave tunnel. Caves are the intersection of two noise functions.
+func (g *simplexGenerator) isCave(xf, yf, zf float64) bool {
+	density := g.density(xf/2, yf/2, zf)
+	if density <= 0.5-g.CaveWidth/2 || density >= 0.5+g.CaveWidth/2 {
+		return false
+	}
+	density2 := g.density(1000-xf/2, 1000-yf/2, 1000-zf) // Use a compressed layout in height
+	return density2 > 0.5-g.CaveWidth/2 && density2 < 0.5+g.CaveWidth/2
+}
+
+// The level of the top of the ground, not counting holes and caves.
+func (g *simplexGenerator) GroundHeight(xf, yf float64) float64 {
+	stoneheight, soildepth := g.column(xf, yf)
+	return stoneheight + soildepth
+}
+
+func (g *simplexGenerator) IsCave(xf, yf, zf float64) bool {
+	return zf <= g.GroundHeight(xf, yf) && g.isCave(xf, yf, zf)
+}
+
+// Generate the base terrain. Sand and scenery are added by Decorate.
+func (g *simplexGenerator) Generate(c chunkdb.CC, rc *raw_chunk) {
 	z1 := int(c.Z * CHUNK_SIZE)
 
 	for x := int32(0); x < CHUNK_SIZE; x++ {
 		xf := float64(x + c.X*CHUNK_SIZE)
 		for y := int32(0); y < CHUNK_SIZE; y++ {
 			yf := float64(y + c.Y*CHUNK_SIZE)
-			highFreq := 20 * simplexnoise.Noise2(xf*0.016, yf*0.016)  // This will generate high frequency terrain
-			f := simplexnoise.Noise2(xf*0.0025, yf*0.0025)            // Factor to modulate the high frequency amplitude
-			lowFreq := 15 * simplexnoise.Noise2(xf*0.0013, yf*0.0013) // Low frequency terrain
-			stoneheight := math.Floor(2.5 + highFreq*f*f + lowFreq)
+			stoneheight, soildepth := g.column(xf, yf)
+			height := stoneheight + soildepth
 
 			// Given 'height', fill in the content of the current chunk. Iterate from high 'z' to low,
 			// to enable tests that depends on the block above.
 			for z := CHUNK_SIZE - 1; z >= 0; z-- {
-				if *inhibitCreateChunks {
-					ch.rc[x][y][z] = BT_Air
-					continue
-				}
 				zf := float64(z + z1)
-				if zf > FLOATING_ISLANDS_LIM {
+				if zf > g.FloatingIslandsLim {
 					// Use a gradial transient, or all islands would have a hard cut off.
-					f := (1-FLOATING_ISLANDS_PROB)/CHUNK_SIZE*(zf-FLOATING_ISLANDS_LIM) + FLOATING_ISLANDS_PROB
+					f := (1-g.FloatingIslandsProb)/CHUNK_SIZE*(zf-g.FloatingIslandsLim) + g.FloatingIslandsProb
 					if f > 1 {
 						f = 1
 					}
-					density := f * dBdensity(xf/2, yf/2, zf) // Use a compressed layout in height
-					if density > FLOATING_ISLANDS_PROB {
-						if z != CHUNK_SIZE-1 && blockIsInvisible[ch.rc[x][y][z+1]] {
-							ch.rc[x][y][z] = BT_Soil // Put grass on top
+					density := f * g.density(xf/2, yf/2, zf) // Use a compressed layout in height
+					if density > g.FloatingIslandsProb {
+						if z != CHUNK_SIZE-1 && rc[x][y][z+1].Invisible() {
+							rc[x][y][z] = BT_Soil // Put grass on top
 						} else {
-							ch.rc[x][y][z] = BT_Stone
+							rc[x][y][z] = BT_Stone
 						}
 					} else {
-						ch.rc[x][y][z] = BT_Air
+						rc[x][y][z] = BT_Air
 					}
 					continue
 				}
-				density := dBdensity(xf/2, yf/2, zf)
-				soildepth := math.Floor(2*simplexnoise.Noise2(xf*0.012, yf*0.012) + 2.8)
-				if stoneheight > WORLD_SOIL_LEVEL {
-					soildepth = 0
-				} else if soildepth+stoneheight > WORLD_SOIL_LEVEL {
-					soildepth = WORLD_SOIL_LEVEL - stoneheight
-				}
-				height := stoneheight + soildepth
-
-				ch.rc[x][y][z] = BT_Air
+				rc[x][y][z] = BT_Air
 				if zf <= stoneheight {
 					// Initialize with stone, may be updated below
 					if zf > 24 {
-						ch.rc[x][y][z] = BT_Snow
+						rc[x][y][z] = BT_Snow
 					} else {
-						ch.rc[x][y][z] = BT_Stone
+						rc[x][y][z] = BT_Stone
 					}
 				} else if zf <= stoneheight+soildepth {
 					// Initialize with soil, may be updated below
-					ch.rc[x][y][z] = BT_Soil
+					rc[x][y][z] = BT_Soil
 				}
 
 				// Excavate some holes in the terrain. Don't let the hole go too deep
 				const HOLEDEPTH = 50 // Max depth of hole
 				if zf > -HOLEDEPTH && zf < HOLEDEPTH {
-					density := dBdensity(xf, yf, zf) // This costs a lot of CPU
+					density := g.density(xf, yf, zf) // This costs a lot of CPU
 					fadeoff := 1.0
 					if zf >= -HOLEDEPTH && zf <= 0 {
 						fadeoff = (HOLEDEPTH + zf) / HOLEDEPTH
@@ -114,71 +175,87 @@ func dBCreateChunk(c chunkdb.CC) *chunk {
 						fadeoff = 0
 					}
 					if density*fadeoff > 0.7 {
-						ch.rc[x][y][z] = BT_Air
+						rc[x][y][z] = BT_Air
 					}
 				}
 
 				// Some special cases if below water line
 				if zf <= 0 {
-					if ch.rc[x][y][z] == BT_Air {
-						ch.rc[x][y][z] = BT_Water
-					} else if ch.rc[x][y][z] == BT_Soil {
-						ch.rc[x][y][z] = BT_Stone
-					}
-					if ch.rc[x][y][z] == BT_Stone && z+z1 == 0 && blockIsInvisible[ch.rc[x][y][1]] {
-						// Replace stone with sand if it is at water level and air above.
-						ch.rc[x][y][0] = BT_Sand
+					if rc[x][y][z] == BT_Air {
+						rc[x][y][z] = BT_Water
+					} else if rc[x][y][z] == BT_Soil {
+						rc[x][y][z] = BT_Stone
 					}
 				}
 
-				a := density > 0.5-CnfgCaveWidth/2 && density < 0.5+CnfgCaveWidth/2
-				if zf <= height && a {
-					density2 := dBdensity(1000-xf/2, 1000-yf/2, 1000-zf) // Use a compressed layout in height
-					b := density2 > 0.5-CnfgCaveWidth/2 && density2 < 0.5+CnfgCaveWidth/2
-					if b && ch.rc[x][y][z] != BT_Water {
-						ch.rc[x][y][z] = BT_Air
-					}
+				if zf <= height && rc[x][y][z] != BT_Water && g.isCave(xf, yf, zf) {
+					rc[x][y][z] = BT_Air
 				}
+			}
+		}
+	}
+}
 
-				// Add some scenery
-				if ch.rc[x][y][z] == BT_Soil && z+1 < CHUNK_SIZE && blockIsInvisible[ch.rc[x][y][z+1]] {
-					// This is a candidate for a tree override
-					const (
-						t3      = 0.0005 // Very few big trees
-						t2      = 0.005
-						t1      = 0.010
-						tflower = 0.012 // Less flowers than tuft of grass
-						ttuft   = 0.020
-					)
-					rnd := math.Abs(simplexnoise.Noise2(xf*422.34, yf*234.123)) // Without scaling, there is a line where xf+yf==0 gives rnd=0
-					if rnd > t1 {
-						continue // Not needed for the algorithm but will save a call to Noise2.
-					}
-					// Use a low frequency function to make less trees for some areas.
-					lowFreq := 1 - math.Abs(simplexnoise.Noise2(xf*0.002, yf*0.002))
-					// The lowFreq function takes away too many trees, ease it up a little
-					lowFreq = 1 - lowFreq*lowFreq
-					// fmt.Printf("%.5f ", lowFreq)
-					switch {
-					case rnd < t3*lowFreq:
-						ch.rc[x][y][z+1] = BT_Tree3
-					case rnd < t2*lowFreq:
-						ch.rc[x][y][z+1] = BT_Tree2
-					case rnd < t1*lowFreq:
-						ch.rc[x][y][z+1] = BT_Tree1
-					case rnd < tflower*lowFreq:
-						ch.rc[x][y][z+1] = BT_Flowers
-					case rnd < ttuft*lowFreq:
-						ch.rc[x][y][z+1] = BT_Tuft
-					}
+// Decorate the base terrain with sand at the water level and with scenery. The scenery depends on
+// the block below, which can be in the chunk below.
+func (g *simplexGenerator) Decorate(c chunkdb.CC, rc *raw_chunk, base *baseTerrain) {
+	z1 := int(c.Z * CHUNK_SIZE)
+	for x := int32(0); x < CHUNK_SIZE; x++ {
+		xf := float64(x + c.X*CHUNK_SIZE)
+		for y := int32(0); y < CHUNK_SIZE; y++ {
+			yf := float64(y + c.Y*CHUNK_SIZE)
+			for z := 0; z < CHUNK_SIZE; z++ {
+				if z+z1 == 0 && rc[x][y][z] == BT_Stone && base.Block(c, int(x), int(y), z+1).Invisible() {
+					// Replace stone with sand if it is at water level and air above.
+					rc[x][y][z] = BT_Sand
+				}
+
+				// Add some scenery on top of soil
+				if !rc[x][y][z].Invisible() || float64(z+z1-1) > g.FloatingIslandsLim {
+					continue
+				}
+				var below block
+				if z > 0 {
+					below = rc[x][y][z-1]
+				} else {
+					below = base.Block(c, int(x), int(y), -1)
+				}
+				if below != BT_Soil {
+					continue
+				}
+				// This is a candidate for a tree override
+				const (
+					t3      = 0.0005 // Very few big trees
+					t2      = 0.005
+					t1      = 0.010
+					tflower = 0.012 // Less flowers than tuft of grass
+					ttuft   = 0.020
+				)
+				rnd := math.Abs(g.noise2(xf*422.34, yf*234.123)) // Without scaling, there is a line where xf+yf==0 gives rnd=0
+				if rnd > t1 {
+					continue // Not needed for the algorithm but will save a call to Noise2.
+				}
+				// Use a low frequency function to make less trees for some areas.
+				lowFreq := 1 - math.Abs(g.noise2(xf*0.002, yf*0.002))
+				// The lowFreq function takes away too many trees, ease it up a little
+				lowFreq = 1 - lowFreq*lowFreq
+				// fmt.Printf("%.5f ", lowFreq)
+				switch {
+				case rnd < t3*lowFreq:
+					rc[x][y][z] = BT_Tree3
+				case rnd < t2*lowFreq:
+					rc[x][y][z] = BT_Tree2
+				case rnd < t1*lowFreq:
+					rc[x][y][z] = BT_Tree1
+				case rnd < tflower*lowFreq:
+					rc[x][y][z] = BT_Flowers
+				case rnd < ttuft*lowFreq:
+					rc[x][y][z] = BT_Tuft
 				}
 			}
 		}
 	}
-	ch.compressAndChecksum()
-	ch.touched = true
-	delta := time.Now().Sub(start)
-	DBCreateStats.Num++
-	DBCreateStats.TotTime += delta
-	return ch
+	if g.Ores {
+		addOres(g.Seed, c, rc)
+	}
 }
@@ -26,11 +26,17 @@ import (
 	"chunkdb"
 	"client_prot"
 	"crypto/rc4"
+	"encoding/gob"
 	"fmt"
 	"github.com/larspensjo/Go-simplex-noise/simplexnoise"
+	"io/ioutil"
 	"keys"
 	"math"
+	"math/rand"
+	"os"
 	"quadtree"
+	"schematic"
+	"strings"
 	"time"
 	"twof"
 )
@@ -45,6 +51,7 @@ func DoTest() {
 	fmt.Printf("Ephenation starting automatic testing\n")
 	*allowTestUser = true // Override this flag
 	DoTestChunkSaveRestore()
+	DoTestChunkFileVersions()
 	DoTestTriggerBlocks_WLwWLc() // Do this early on, as a fake chunk will be used
 	DoTestTextActivators()
 	DoTestActivatorConditions()
@@ -60,6 +67,26 @@ func DoTest() {
 	DoTestFriends_WLaWLwWLuWLqBlWLc()
 	DoTestKeyRing()
 	DoTestJellyBlocks()
+	DoTestDirtyChunks()
+	DoTestChunkHistory()
+	DoTestRegion()
+	DoTestJournal()
+	DoTestConcurrentChunkLoad()
+	DoTestPrefetchCandidates()
+	DoTestRawChunkRelease()
+	DoTestWorldGenerator()
+	DoTestBiomes()
+	DoTestDecoration()
+	DoTestStructures()
+	DoTestOres()
+	DoTestTerrainGoldens()
+	DoTestPregen()
+	DoTestBlockRegistry()
+	DoTestLiquids()
+	DoTestRandomTicks()
+	DoTestLight()
+	DoTestCollision()
+	DoTestWorldCache() // Do this last, as it empties the cache
 	fmt.Printf("Tests done. %d tests (%d successful + %d failures)\n", testCount, testSuccess, testFailed)
 }
 
@@ -107,19 +134,19 @@ func DoTestChunkCompression() {
 	for x := uint(0); x < CHUNK_SIZE; x++ {
 		for y := uint(0); y < CHUNK_SIZE; y++ {
 			for z := uint8(0); z < CHUNK_SIZE; z++ {
-				rc[x][y][z] = ch.rc[x][y][z]
+				rc[x][y][z] = ch.raw()[x][y][z]
 			}
 		}
 	}
 	ch.compressAndChecksum()
-	ch.rc = nil
-	ch.rc = decompressChunk(ch.ch_comp)
+	ch.rc.Store(nil)
+	ch.rc.Store(decompressChunk(ch.ch_comp))
 	// Verify that the content is the same
 	success := true
 	for x := uint(0); x < CHUNK_SIZE; x++ {
 		for y := uint(0); y < CHUNK_SIZE; y++ {
 			for z := uint8(0); z < CHUNK_SIZE; z++ {
-				if rc[x][y][z] != ch.rc[x][y][z] {
+				if rc[x][y][z] != ch.raw()[x][y][z] {
 					success = false
 				}
 			}
@@ -234,8 +261,8 @@ func DoTestTriggerBlocks_WLwWLc() {
 	DoTestCheck("DoTestTriggerBlocks No initial links", len(ch.blTriggers) == 0 && len(ch.triggerMsgs) == 0)
 	// Define a trigger, an activator, and a link in between. Easy one, not at the
 	// border to another chunk
-	ch.rc[5][5][5] = BT_Trigger
-	ch.rc[5][5][6] = BT_Text
+	ch.raw()[5][5][5] = BT_Trigger
+	ch.raw()[5][5][6] = BT_Text
 	ch.ComputeLinks()
 	DoTestCheck("DoTestTriggerBlocks zero links", len(ch.blTriggers) == 1 && len(ch.triggerMsgs) == 1)
 	msgp := ch.FindActivator(5, 5, 6)
@@ -243,22 +270,22 @@ func DoTestTriggerBlocks_WLwWLc() {
 	DoTestCheck("DoTestTriggerBlocks zero links add msg", len(ch.triggerMsgs[0].Message) == 1 && ch.triggerMsgs[0].Message[0] == msg1)
 	ch.ComputeLinks() // Compute the same links again, and make sure message is copied
 	DoTestCheck("DoTestTriggerBlocks zero links same msg", len(ch.triggerMsgs[0].Message) == 1 && ch.triggerMsgs[0].Message[0] == msg1)
-	ch.rc[4][5][5], ch.rc[5][4][5], ch.rc[5][5][4], ch.rc[6][5][5], ch.rc[5][6][5], ch.rc[5][5][6] = BT_Text, BT_Text, BT_Text, BT_Text, BT_Text, BT_Text
+	ch.raw()[4][5][5], ch.raw()[5][4][5], ch.raw()[5][5][4], ch.raw()[6][5][5], ch.raw()[5][6][5], ch.raw()[5][5][6] = BT_Text, BT_Text, BT_Text, BT_Text, BT_Text, BT_Text
 	ch.ComputeLinks()
 	// fmt.Println(ch.triggerMsgs)
 	DoTestCheck("DoTestTriggerBlocks zero links 6 spawners", len(ch.blTriggers) == 6 && len(ch.triggerMsgs) == 6)
-	ch.rc[4][5][5], ch.rc[5][4][5], ch.rc[5][5][4], ch.rc[6][5][5], ch.rc[5][6][5], ch.rc[5][5][6] = BT_Air, BT_Air, BT_Air, BT_Air, BT_Air, BT_Air
-	ch.rc[5][5][6] = BT_Link
-	ch.rc[5][5][7] = BT_Text
+	ch.raw()[4][5][5], ch.raw()[5][4][5], ch.raw()[5][5][4], ch.raw()[6][5][5], ch.raw()[5][6][5], ch.raw()[5][5][6] = BT_Air, BT_Air, BT_Air, BT_Air, BT_Air, BT_Air
+	ch.raw()[5][5][6] = BT_Link
+	ch.raw()[5][5][7] = BT_Text
 	ch.ComputeLinks()
 	DoTestCheck("DoTestTriggerBlocks One link", len(ch.blTriggers) == 1 && len(ch.triggerMsgs) == 1)
-	ch.rc[5][6][5] = BT_Link
-	ch.rc[5][7][5] = BT_Link
-	ch.rc[5][8][5] = BT_Link
-	ch.rc[5][9][5] = BT_Text
+	ch.raw()[5][6][5] = BT_Link
+	ch.raw()[5][7][5] = BT_Link
+	ch.raw()[5][8][5] = BT_Link
+	ch.raw()[5][9][5] = BT_Text
 	ch.ComputeLinks()
 	DoTestCheck("DoTestTriggerBlocks Two links", len(ch.blTriggers) == 2 && len(ch.triggerMsgs) == 2)
-	ch.rc[5][6][6] = BT_DeTrigger // Connect to both spawners
+	ch.raw()[5][6][6] = BT_DeTrigger // Connect to both spawners
 	ch.ComputeLinks()
 	DoTestCheck("DoTestTriggerBlocks DeTrigger also", len(ch.blTriggers) == 4 && len(ch.triggerMsgs) == 2) // Two triggers times two activators
 	for _, trig := range ch.blTriggers {
@@ -462,13 +489,13 @@ func DoTestPlayerManagement_WLuWLqWLmBlWLaWLwWLc() {
 	DoTestCheck("DoTestPlayerManagement test0 starting point z", pl.Coord.Z >= 0)
 	DoTestCheck("DoTestPlayerManagement test0 initially stationary", pl.ZSpeed == 0)
 	coord := pl.Coord
-	newZSpeed := UpdateZPos_WLwWLc(1e8, 0, &coord)
+	newZSpeed := UpdateZPos_WLwWLc(1e8, 0, &coord, playerBody)
 	DoTestCheck("DoTestPlayerManagement test0 stationary", coord.Z == pl.Coord.Z && newZSpeed == 0)
 	// Verify jumping
 	up.CmdPlayerMove_WLuWLqWLmWLwWLc(client_prot.CMD_JUMP)
 	// println("DoTestPlayerManagement zspeed", pl.ZSpeed)
 	for i := 0; i < 10; i++ {
-		pl.ZSpeed = UpdateZPos_WLwWLc(1e8, pl.ZSpeed, &pl.Coord)
+		pl.ZSpeed = UpdateZPos_WLwWLc(1e8, pl.ZSpeed, &pl.Coord, playerBody)
 		up.checkOnePlayerPosChanged_RLuWLqBl(false) // Report should be generated that the player moved
 		if i == 0 {
 			DoTestCheck("DoTestPlayerManagement prev coord updated",
@@ -620,7 +647,7 @@ func DoTestChunkCompare(ch1, ch2 *chunk) bool {
 	for x := 0; x < CHUNK_SIZE; x++ {
 		for y := 0; y < CHUNK_SIZE; y++ {
 			for z := 0; z < CHUNK_SIZE; z++ {
-				if ch1.rc[x][y][z] != ch2.rc[x][y][z] {
+				if ch1.raw()[x][y][z] != ch2.raw()[x][y][z] {
 					return false
 				}
 			}
@@ -641,6 +668,67 @@ func DoTestChunkSaveRestore() {
 	DoTestCheck("DoTestChunkSaverestore Compare ", DoTestChunkCompare(ch1, ch2))
 }
 
+// Read chunk files of different versions
+func DoTestChunkFileVersions() {
+	coord := chunkdb.CC{X: 0, Y: 0, Z: 0}
+	ch1 := dBCreateChunk(coord)
+
+	// Version 1, with 16-bit partition lengths.
+	var b1 [24 + 4]byte
+	EncodeUint32(ch1.flag, b1[0:4])
+	EncodeUint32(ch1.checkSum, b1[4:8])
+	EncodeUint32(ch1.owner, b1[8:12])
+	EncodeUint16(uint16(PART_COMP_CHUNK), b1[24:26])
+	EncodeUint16(uint16(len(ch1.ch_comp)), b1[26:28])
+	ch2 := dBDecodeChunk(coord, append(b1[:], ch1.ch_comp...))
+	DoTestCheck("DoTestChunkFileVersions read version 1", ch2 != nil && DoTestChunkCompare(ch1, ch2))
+
+	// Activator messages bigger than what a 16-bit length can handle
+	long := strings.Repeat("x", 70000)
+	ch1.raw()[1][2][3] = BT_Text
+	ch1.compressAndChecksum()
+	ch1.triggerMsgs = []textMsgActivator{{1, 2, 3, []string{long}, zeroTime}}
+	var buf bytes.Buffer
+	ok := ch1.WriteFS(&buf)
+	DoTestCheck("DoTestChunkFileVersions write version 2", ok)
+	// Add a partition of a type that is unknown
+	var unknown [6 + 3]byte
+	EncodeUint16(1000, unknown[0:2])
+	EncodeUint32(3, unknown[2:6])
+	buf.Write(unknown[:])
+	ch2 = dBDecodeChunk(coord, buf.Bytes())
+	DoTestCheck("DoTestChunkFileVersions read version 2", ch2 != nil && DoTestChunkCompare(ch1, ch2))
+	DoTestCheck("DoTestChunkFileVersions long activator message", ch2 != nil && len(ch2.triggerMsgs) == 1 && len(ch2.triggerMsgs[0].Message) == 1 && ch2.triggerMsgs[0].Message[0] == long)
+
+	// Activators saved with gob, by older versions of the server
+	var legacy bytes.Buffer
+	ch1.triggerMsgs[0].Message = []string{"legacy"}
+	gob.NewEncoder(&legacy).Encode(&ch1.triggerMsgs)
+	var buf2 bytes.Buffer
+	buf2.Write(buf.Bytes()[:24])
+	ch1.WritePartition(&buf2, ch1.ch_comp, PART_COMP_CHUNK)
+	ch1.WritePartition(&buf2, legacy.Bytes(), PART_TEXT_ACTIVATORS)
+	ch2 = dBDecodeChunk(coord, buf2.Bytes())
+	DoTestCheck("DoTestChunkFileVersions legacy activator message", ch2 != nil && len(ch2.triggerMsgs) == 1 && len(ch2.triggerMsgs[0].Message) == 1 && ch2.triggerMsgs[0].Message[0] == "legacy")
+
+	// A future version shall not be accepted
+	b := buf.Bytes()
+	EncodeUint32(CHUNK_FILE_VERSION+1, b[12:16])
+	DoTestCheck("DoTestChunkFileVersions unknown version", dBDecodeChunk(coord, b) == nil)
+
+	// A file that can't be decoded is kept, and the chunk is not saved over it
+	far := chunkdb.CC{X: 1 << 20, Y: 1<<20 + 18, Z: 1 << 20} // Far away, not used by anyone else
+	fn := DBChunkFileName(far)
+	defer os.Remove(fn)
+	ioutil.WriteFile(fn, b, 0666)
+	ch3 := dBFindChunkFromFS(far)
+	DoTestCheck("DoTestChunkFileVersions unreadable", ch3.unreadable && ch3.owner == OWNER_RESERVED)
+	ch3.flag |= CHF_MODIFIED
+	ok = ch3.Write()
+	b2, err := ioutil.ReadFile(fn)
+	DoTestCheck("DoTestChunkFileVersions unreadable kept", !ok && err == nil && bytes.Equal(b, b2))
+}
+
 func DoTestKeyRing() {
 	var keyRing keys.KeyRing
 	const (
@@ -667,19 +755,741 @@ func DoTestJellyBlocks() {
 	chunk := chunkdb.CC{X: testCoord, Y: 0, Z: 0}
 	ch := dBCreateChunk(chunk)
 	// Initialize with something that is not air
-	ch.rc[0][0][0] = BT_Stone
-	ch.rc[0][0][1] = BT_Stone
+	ch.raw()[0][0][0] = BT_Stone
+	ch.raw()[0][0][1] = BT_Stone
 	ch.TurnToJelly(0, 0, 0, zeroTime)             // Will timeout immediately
 	ch.TurnToJelly(0, 0, 1, time.Now().Add(1e10)) // Timeout in 10s, which is longer than waiting for in the test
-	DoTestCheck("DoTestJellyBlocks jelly 1", ch.rc[0][0][0] == BT_Air)
-	DoTestCheck("DoTestJellyBlocks jelly 2", ch.rc[0][0][1] == BT_Air)
+	DoTestCheck("DoTestJellyBlocks jelly 1", ch.raw()[0][0][0] == BT_Air)
+	DoTestCheck("DoTestJellyBlocks jelly 2", ch.raw()[0][0][1] == BT_Air)
 	DoTestCheck("DoTestJellyBlocks initial list length correct", len(ch.jellyBlocks) == 2)
 	ch.RestoreJellyBlocks(false) // Restore only the one with a timeout
 	DoTestCheck("DoTestJellyBlocks list decreased", len(ch.jellyBlocks) == 1)
-	DoTestCheck("DoTestJellyBlocks jelly 1 reverted", ch.rc[0][0][0] == BT_Stone)
-	DoTestCheck("DoTestJellyBlocks jelly 2 remains", ch.rc[0][0][1] == BT_Air)
+	DoTestCheck("DoTestJellyBlocks jelly 1 reverted", ch.raw()[0][0][0] == BT_Stone)
+	DoTestCheck("DoTestJellyBlocks jelly 2 remains", ch.raw()[0][0][1] == BT_Air)
 	ch.RestoreJellyBlocks(true) // Restore all, unconditionally
 	DoTestCheck("DoTestJellyBlocks list decreased again", ch.jellyBlocks == nil)
-	DoTestCheck("DoTestJellyBlocks jelly 1 still reverted", ch.rc[0][0][0] == BT_Stone)
-	DoTestCheck("DoTestJellyBlocks jelly 2 also reverted", ch.rc[0][0][1] == BT_Stone)
+	DoTestCheck("DoTestJellyBlocks jelly 1 still reverted", ch.raw()[0][0][0] == BT_Stone)
+	DoTestCheck("DoTestJellyBlocks jelly 2 also reverted", ch.raw()[0][0][1] == BT_Stone)
+}
+
+// Test the delayed saving of chunks. Nothing is actually saved.
+func DoTestDirtyChunks() {
+	cc := chunkdb.CC{X: 1 << 20, Y: 1 << 20, Z: 1 << 20} // Far away, not used by anyone else
+	var ch chunk
+	ch.Coord = cc
+	before := NumDirtyChunks()
+	DoTestCheck("DoTestDirtyChunks not dirty", dirtyChunkFind(cc) == nil)
+	ch.WriteDelayed()
+	ch.WriteDelayed()
+	DoTestCheck("DoTestDirtyChunks coalesced", NumDirtyChunks() == before+1)
+	DoTestCheck("DoTestDirtyChunks found", dirtyChunkFind(cc) == &ch)
+	// Remove it again, to prevent it from being saved.
+	dirtyChunksLock.Lock()
+	delete(dirtyChunks, cc)
+	dirtyChunksLock.Unlock()
+	DoTestCheck("DoTestDirtyChunks removed", dirtyChunkFind(cc) == nil)
+
+	// A modified chunk that is purged from the cache before it is saved shall be found again,
+	// not loaded from the old file. A flush saves it.
+	far := chunkdb.CC{X: 1 << 20, Y: 1<<20 + 20, Z: 1 << 20}
+	fn := DBChunkFileName(far)
+	defer os.Remove(fn)
+	cp := dBCreateChunk(far)
+	cp.raw()[1][2][3] = BT_Stone
+	cp.compressAndChecksum()
+	cp.WriteDelayed()
+	DoTestCheck("DoTestDirtyChunks evicted found", ChunkFindLoaded_RLw(far) == nil && ChunkFind_WLwWLc(far) == cp)
+	_, err := os.Stat(fn)
+	DoTestCheck("DoTestDirtyChunks not saved yet", os.IsNotExist(err))
+	FlushDirtyChunks()
+	data, err := ioutil.ReadFile(fn)
+	DoTestCheck("DoTestDirtyChunks flushed", err == nil && dirtyChunkFind(far) == nil)
+	ch2 := dBDecodeChunk(far, data)
+	DoTestCheck("DoTestDirtyChunks saved", ch2 != nil && ch2.raw()[1][2][3] == BT_Stone)
+	shard := cacheShardOf(far)
+	shard.Lock()
+	delete(shard.chunks, far)
+	shard.Unlock()
+}
+
+// Save versions of a chunk in the history, and read them back.
+func DoTestChunkHistory() {
+	coord := chunkdb.CC{X: 1 << 20, Y: 1 << 20, Z: 1 << 20} // Far away, not used by anyone else
+	defer os.RemoveAll(chunkHistoryFolder(coord))
+	ch := dBCreateChunk(coord)
+	var buf bytes.Buffer
+	ch.WriteFS(&buf)
+	interval := chunkHistoryInterval
+	defer func() { chunkHistoryInterval = interval }()
+	chunkHistoryInterval = 0
+	saveChunkHistory(coord, buf.Bytes())
+	for i := 0; i < chunkHistorySize+2; i++ {
+		saveChunkHistory(coord, buf.Bytes())
+	}
+	versions := chunkHistory(coord)
+	DoTestCheck("DoTestChunkHistory number of versions", len(versions) == chunkHistorySize)
+	DoTestCheck("DoTestChunkHistory newest first", len(versions) > 1 && versions[0].After(versions[1]))
+	_, ok := chunkVersionAt(coord, versions[len(versions)-1].Add(-1))
+	DoTestCheck("DoTestChunkHistory nothing that old", !ok)
+	t, ok := chunkVersionAt(coord, time.Now())
+	DoTestCheck("DoTestChunkHistory find newest", ok && t.Equal(versions[0]))
+	ch2 := loadChunkVersion(coord, t)
+	DoTestCheck("DoTestChunkHistory load version", ch2 != nil && DoTestChunkCompare(ch, ch2))
+
+	// Versions saved close in time replace the newest one, and don't push out the old ones
+	chunkHistoryInterval = time.Hour
+	for i := 0; i < chunkHistorySize+2; i++ {
+		saveChunkHistory(coord, buf.Bytes())
+	}
+	versions2 := chunkHistory(coord)
+	DoTestCheck("DoTestChunkHistory throttled", len(versions2) == chunkHistorySize && versions2[len(versions2)-1].Equal(versions[len(versions)-1]))
+	DoTestCheck("DoTestChunkHistory newest kept", versions2[0].After(versions[0]))
+}
+
+// Find a test chunk far away, not used by anyone else, at offset 'dx', 'dy' from (1<<20, 1<<20, 1<<20).
+// It is made empty, with a floor of 'floor', and 'add' can add more blocks. The returned function
+// forgets the changes of the chunk, which are never saved, and removes the chunk file.
+func doTestFarChunk(dx, dy int32, floor block, add func(rc *raw_chunk)) (chunkdb.CC, *chunk, func()) {
+	cc := chunkdb.CC{X: 1<<20 + dx, Y: 1<<20 + dy, Z: 1 << 20}
+	cp := ChunkFind_WLwWLc(cc)
+	cp.Lock()
+	rc := cp.raw()
+	for x := 0; x < CHUNK_SIZE; x++ {
+		for y := 0; y < CHUNK_SIZE; y++ {
+			for z := 0; z < CHUNK_SIZE; z++ {
+				rc[x][y][z] = BT_Air
+			}
+			rc[x][y][0] = floor
+		}
+	}
+	if add != nil {
+		add(rc)
+	}
+	cp.compressAndChecksum()
+	cp.Unlock()
+	return cc, cp, func() {
+		dirtyChunksLock.Lock()
+		delete(dirtyChunks, cc)
+		dirtyChunksLock.Unlock()
+		os.Remove(DBChunkFileName(cc))
+	}
+}
+
+func DoTestRegion() {
+	lo, hi, err := parseBox("3,-1,2:-3,1,4")
+	DoTestCheck("DoTestRegion parse box", err == nil && lo == blockCoord{-3, -1, 2} && hi == blockCoord{3, 1, 4})
+	DoTestCheck("DoTestRegion chunk of negative block", blockCoord{-1, -CHUNK_SIZE, CHUNK_SIZE}.GetChunkCoord() == chunkdb.CC{X: -1, Y: -1, Z: 1})
+
+	src, ch, done := doTestFarChunk(0, 0, BT_Air, func(rc *raw_chunk) {
+		rc[CHUNK_SIZE-1][1][2] = BT_Text
+		rc[CHUNK_SIZE-2][3][4] = BT_Stone
+	})
+	defer done()
+	dst, _, done := doTestFarChunk(10, 0, BT_Air, nil)
+	defer done()
+	ch.Lock()
+	ch.triggerMsgs = []textMsgActivator{{CHUNK_SIZE - 1, 1, 2, []string{"region"}, time.Time{}}}
+	ch.Unlock()
+	// The box covers two blocks of the source chunk, and two blocks of the chunk next to it
+	origin := blockCoord{int64(src.X) * CHUNK_SIZE, int64(src.Y) * CHUNK_SIZE, int64(src.Z) * CHUNK_SIZE}
+	s, err := ExportRegion_RLwWLc(blockCoord{origin.X + CHUNK_SIZE - 2, origin.Y, origin.Z}, blockCoord{origin.X + CHUNK_SIZE + 1, origin.Y + 7, origin.Z + 7})
+	DoTestCheck("DoTestRegion export", err == nil && s.SizeX == 4 && s.SizeY == 8 && s.SizeZ == 8)
+	if err != nil {
+		return
+	}
+	next := chunkdb.CC{X: src.X + 1, Y: src.Y, Z: src.Z}
+	_, err = os.Stat(DBChunkFileName(next))
+	DoTestCheck("DoTestRegion export creates no chunk", os.IsNotExist(err) && ChunkFindLoaded_RLw(next) == nil)
+	DoTestCheck("DoTestRegion export activator", len(s.Activators) == 1 && s.Activators[0].Pos == schematic.Pos{X: 1, Y: 1, Z: 2})
+	first := s.Get(0, 0, 0)
+	s.Set(0, 0, 0, uint8(BT_Topsoil))
+	_, err = ImportRegion_WLwWLcRLq(s, dst)
+	DoTestCheck("DoTestRegion import virtual block", err != nil)
+	s.Set(0, 0, 0, first)
+	n, err := ImportRegion_WLwWLcRLq(s, dst)
+	DoTestCheck("DoTestRegion import chunks", err == nil && n == 1)
+	ch2 := ChunkFind_WLwWLc(dst)
+	ch2.RLock()
+	DoTestCheck("DoTestRegion import blocks", ch2.raw()[0][3][4] == BT_Stone && ch2.raw()[1][1][2] == BT_Text)
+	msgp := ch2.FindActivator(1, 1, 2)
+	DoTestCheck("DoTestRegion import activator", msgp != nil && len(*msgp) == 1 && (*msgp)[0] == "region")
+	ch2.RUnlock()
+}
+
+func DoTestJournal() {
+	var up user
+	up.Id = 1 << 30 // Not used by anyone else
+	up.Email = "journal@test"
+	defer os.Remove(journalFileName(up.Id))
+	defer os.Remove(journalCommitFileName(up.Id))
+	up.Level = 3
+	up.Journal("first")
+	up.Level = 4
+	up.Inventory.AddOneObject(ItemHealthPotionID, 2)
+	up.Journal("second")
+	var loaded user
+	loaded.Id = up.Id
+	DoTestCheck("DoTestJournal replay", loaded.ReplayJournal() == 2 && loaded.Level == 4 && loaded.Inventory.Find(ItemHealthPotionID, 2) != -1 && loaded.JournalSeq == 2)
+	loaded.JournalSeq = 0
+	DoTestCheck("DoTestJournal replay again", loaded.ReplayJournal() == 2 && loaded.Level == 4)
+
+	// A save that fails keeps the journal, also for events during the save
+	journalStartCommit(up.Id)
+	up.Level = 5
+	up.Journal("during save")
+	journalStartCommit(up.Id)
+	loaded.Level, loaded.JournalSeq = 0, 0
+	DoTestCheck("DoTestJournal failed save", loaded.ReplayJournal() == 3 && loaded.Level == 5)
+
+	// A crash after the save, before the journal is removed. The saved state is newer than
+	// the journal, and must not be rolled back.
+	loaded.Level, loaded.JournalSeq = 6, 3
+	DoTestCheck("DoTestJournal already saved", loaded.ReplayJournal() == 0 && loaded.Level == 6)
+	journalEndCommit(up.Id)
+	loaded.JournalSeq = 0
+	DoTestCheck("DoTestJournal committed", loaded.ReplayJournal() == 0)
+
+	// A crash in the middle of writing an entry
+	up.Journal("complete")
+	journalLock.Lock()
+	writePendingJournals()
+	journalLock.Unlock()
+	f, err := os.OpenFile(journalFileName(up.Id), os.O_WRONLY|os.O_APPEND, 0666)
+	if err == nil {
+		f.Write([]byte{100, 0, 0, 0, 3})
+		f.Close()
+	}
+	DoTestCheck("DoTestJournal truncated entry", err == nil && loaded.ReplayJournal() == 1)
+
+	// Saving a player only writes the entries of that player
+	var other user
+	other.Id, other.Email = up.Id+2, "other@test"
+	other.Journal("other")
+	journalStartCommit(up.Id)
+	journalPendingLock.Lock()
+	_, pending := journalPending[other.Id]
+	delete(journalPending, other.Id)
+	journalPendingLock.Unlock()
+	DoTestCheck("DoTestJournal only the saved player", pending)
+	journalEndCommit(up.Id)
+
+	var testPlayer user
+	testPlayer.Id = up.Id + 1
+	testPlayer.Journal("test player")
+	journalPendingLock.Lock()
+	_, pending = journalPending[testPlayer.Id]
+	journalPendingLock.Unlock()
+	DoTestCheck("DoTestJournal nothing pending for test players", !pending)
+	_, err = os.Stat(journalFileName(testPlayer.Id))
+	DoTestCheck("DoTestJournal no journal for test players", os.IsNotExist(err))
+}
+
+// The uncompressed chunk is released when not used, and rebuilt with the same content when needed again.
+func DoTestRawChunkRelease() {
+	cp := dBCreateChunk(chunkdb.CC{X: 1 << 20, Y: 1<<20 + 3, Z: 0})
+	cp.raw()[1][2][3] = BT_Stone
+	cp.compressAndChecksum()
+	orig := *cp.rc.Load()
+	AddChunkToCache(cp)
+	cp.TurnToJelly(1, 2, 3, time.Now().Add(time.Hour))
+	cp.lastUsed = time.Now().Add(-2 * time.Minute).UnixNano()
+	purgeWorldCache(1<<62, time.Minute, time.Hour)
+	DoTestCheck("DoTestRawChunkRelease keep with jelly blocks", cp.rc.Load() != nil)
+	cp.RestoreJellyBlocks(true)
+	cp.lastUsed = time.Now().Add(-2 * time.Minute).UnixNano()
+	released := CacheStats.RawReleased
+	purgeWorldCache(1<<62, time.Minute, time.Hour)
+	DoTestCheck("DoTestRawChunkRelease released", cp.rc.Load() == nil && CacheStats.RawReleased == released+1 && CacheStats.RawSaved >= CHUNK_VOL)
+	rebuilt := CacheStats.RawRebuilt
+	uc := user_coord{float64(cp.Coord.X*CHUNK_SIZE) + 1.5, float64(cp.Coord.Y*CHUNK_SIZE) + 2.5, float64(cp.Coord.Z*CHUNK_SIZE) + 3.5}
+	DoTestCheck("DoTestRawChunkRelease get block", DBGetBlock_WLwWLc(uc) == BT_Stone && CacheStats.RawRebuilt == rebuilt+1)
+	DoTestCheck("DoTestRawChunkRelease rebuilt", cp.rc.Load() != nil && *cp.rc.Load() == orig)
+}
+
+func DoTestWorldGenerator() {
+	name, params := worldGenName, worldParams
+	defer SetWorldGenerator(name, params)
+	cc := chunkdb.CC{X: 1 << 20, Y: 1<<20 + 4, Z: 0}
+	DoTestCheck("DoTestWorldGenerator unknown", !SetWorldGenerator("nosuchgenerator", params) && worldGenName == name)
+
+	SetWorldGenerator("flat", params)
+	ch := dBCreateChunk(cc)
+	DoTestCheck("DoTestWorldGenerator flat", ch.raw()[3][4][0] == BT_Soil && ch.raw()[3][4][1] == BT_Air && ch.raw()[3][4][CHUNK_SIZE-1] == BT_Air)
+	ch = dBCreateChunk(chunkdb.CC{X: cc.X, Y: cc.Y, Z: -1})
+	DoTestCheck("DoTestWorldGenerator flat stone", ch.raw()[3][4][0] == BT_Stone && ch.raw()[3][4][CHUNK_SIZE-1] == BT_Soil)
+
+	SetWorldGenerator("empty", params)
+	ch = dBCreateChunk(chunkdb.CC{X: cc.X, Y: cc.Y, Z: -1})
+	DoTestCheck("DoTestWorldGenerator empty", ch.raw()[3][4][0] == BT_Air)
+
+	SetWorldGenerator("simplex", params)
+	orig := dBCreateChunk(cc).checkSum
+	DoTestCheck("DoTestWorldGenerator same world", dBCreateChunk(cc).checkSum == orig)
+	seeded := params
+	seeded.Seed = 4711
+	SetWorldGenerator("simplex", seeded)
+	DoTestCheck("DoTestWorldGenerator seed", dBCreateChunk(cc).checkSum != orig)
+}
+
+func DoTestBiomes() {
+	g := newBiomeGenerator(worldParams).(biomeGenerator)
+	found := make(map[string]bool)
+	var desert chunkdb.CC
+	var desertFound bool
+	for x := -20000.0; x <= 20000; x += 500 {
+		for y := -20000.0; y <= 20000; y += 500 {
+			b, height := g.column(x, y)
+			found[b.name] = true
+			if b.name == "desert" && height > 0 && height < CHUNK_SIZE-1 && !desertFound {
+				uc := user_coord{x, y, height}
+				desert = uc.GetChunkCoord()
+				desertFound = true
+			}
+		}
+	}
+	DoTestCheck("DoTestBiomes several biomes", len(found) >= 3)
+	if !desertFound {
+		DoTestCheck("DoTestBiomes found desert", false)
+		return
+	}
+	var rc1, rc2 raw_chunk
+	g.Generate(desert, &rc1)
+	g.Generate(desert, &rc2)
+	DoTestCheck("DoTestBiomes same result", rc1 == rc2)
+	var sand int
+	for x := 0; x < CHUNK_SIZE; x++ {
+		for y := 0; y < CHUNK_SIZE; y++ {
+			for z := 0; z < CHUNK_SIZE; z++ {
+				if rc1[x][y][z] == BT_Sand {
+					sand++
+				}
+			}
+		}
+	}
+	DoTestCheck("DoTestBiomes desert sand", sand > 0)
+}
+
+// A generator with stone below level 0, that puts tufts on top of the stone in the decoration.
+type testDecorator struct{}
+
+func (testDecorator) Generate(cc chunkdb.CC, rc *raw_chunk) {
+	if cc.Z < 0 {
+		for x := 0; x < CHUNK_SIZE; x++ {
+			for y := 0; y < CHUNK_SIZE; y++ {
+				for z := 0; z < CHUNK_SIZE; z++ {
+					rc[x][y][z] = BT_Stone
+				}
+			}
+		}
+	}
+}
+
+func (testDecorator) Decorate(cc chunkdb.CC, rc *raw_chunk, base *baseTerrain) {
+	for x := 0; x < CHUNK_SIZE; x++ {
+		for y := 0; y < CHUNK_SIZE; y++ {
+			for z := 0; z < CHUNK_SIZE; z++ {
+				if rc[x][y][z] == BT_Air && base.Block(cc, x, y, z-1) == BT_Stone {
+					rc[x][y][z] = BT_Tuft
+				}
+			}
+		}
+	}
+}
+
+func DoTestDecoration() {
+	rc := generateChunk(testDecorator{}, chunkdb.CC{X: 1 << 20, Y: 1<<20 + 5, Z: 0})
+	DoTestCheck("DoTestDecoration over chunk border", rc[0][0][0] == BT_Tuft && rc[CHUNK_SIZE-1][5][0] == BT_Tuft && rc[0][0][1] == BT_Air)
+	rc = generateChunk(testDecorator{}, chunkdb.CC{X: 1 << 20, Y: 1<<20 + 5, Z: -1})
+	DoTestCheck("DoTestDecoration inside chunk", rc[0][0][CHUNK_SIZE-1] == BT_Stone)
+
+	base := &baseTerrain{gen: testDecorator{}, chunks: make(map[chunkdb.CC]*raw_chunk)}
+	cc := chunkdb.CC{X: 0, Y: 0, Z: 0}
+	DoTestCheck("DoTestDecoration base terrain", base.Block(cc, 3, 3, 3) == BT_Air && base.Block(cc, -1, -40, -1) == BT_Stone && len(base.chunks) == 2)
+}
+
+func DoTestStructures() {
+	site := newSimplexGenerator(worldParams).(StructureSite)
+	DoTestCheck("DoTestStructures none near start", planStructure(site, worldParams, 0, 0) == nil && planStructure(site, worldParams, 7, -1) == nil)
+	found := make(map[string]*structure)
+	for cx := int64(0); cx < 100; cx++ {
+		if s := planStructure(site, worldParams, cx, 10); s != nil && found[s.name] == nil {
+			found[s.name] = s
+		}
+	}
+	DoTestCheck("DoTestStructures found", len(found) >= 2)
+	ruin := found["ruin"]
+	if ruin == nil {
+		DoTestCheck("DoTestStructures found ruin", false)
+		return
+	}
+	again := planStructure(site, worldParams, ruin.lo.X/structureCellSize, 10)
+	DoTestCheck("DoTestStructures same plan", again != nil && len(again.blocks) == len(ruin.blocks) && again.blocks[len(again.blocks)-1] == ruin.blocks[len(ruin.blocks)-1])
+
+	// The chunk with the activator shall have a trigger connected to the text, with the message.
+	text := ruin.texts[0]
+	name, params := worldGenName, worldParams
+	withStructures := params
+	withStructures.Structures = true
+	SetWorldGenerator("simplex", withStructures)
+	defer SetWorldGenerator(name, params)
+	cc := blockCoord{text.x, text.y, text.z}.GetChunkCoord()
+	ch := dBCreateChunk(cc)
+	msg := ch.FindActivator(uint8(text.x-int64(cc.X)*CHUNK_SIZE), uint8(text.y-int64(cc.Y)*CHUNK_SIZE), uint8(text.z-int64(cc.Z)*CHUNK_SIZE))
+	DoTestCheck("DoTestStructures activator", msg != nil && len(*msg) == 1 && strings.Contains((*msg)[0], "/invadd:"))
+	DoTestCheck("DoTestStructures trigger", len(ch.blTriggers) == 1 && ch.blTriggers[0].msg != nil)
+	for _, b := range ruin.blocks {
+		if b.bl == BT_Treasure {
+			tc := blockCoord{b.x, b.y, b.z}.GetChunkCoord()
+			rc := dBCreateChunk(tc).raw()
+			DoTestCheck("DoTestStructures treasure", rc[b.x-int64(tc.X)*CHUNK_SIZE][b.y-int64(tc.Y)*CHUNK_SIZE][b.z-int64(tc.Z)*CHUNK_SIZE] == BT_Treasure)
+		}
+	}
+}
+
+func DoTestOres() {
+	coal, gold := &oreTypes[0], &oreTypes[2]
+	DoTestCheck("DoTestOres rate", coal.rate(0) == coal.prob && gold.rate(0) == 0 && gold.rate(-1000) == gold.prob && coal.rate(-1000) == 0)
+
+	// Count the ores in chunks of only stone, with air in the top layer.
+	count := func(cc chunkdb.CC) (found map[block]int, air bool) {
+		rc := newAirChunk()
+		for x := 0; x < CHUNK_SIZE; x++ {
+			for y := 0; y < CHUNK_SIZE; y++ {
+				for z := 0; z < CHUNK_SIZE-1; z++ {
+					rc[x][y][z] = BT_Stone
+				}
+			}
+		}
+		addOres(0, cc, rc)
+		found = make(map[block]int)
+		air = true
+		for x := 0; x < CHUNK_SIZE; x++ {
+			for y := 0; y < CHUNK_SIZE; y++ {
+				for z := 0; z < CHUNK_SIZE; z++ {
+					found[rc[x][y][z]]++
+				}
+				air = air && rc[x][y][CHUNK_SIZE-1] == BT_Air
+			}
+		}
+		return
+	}
+	surface, air := count(chunkdb.CC{X: 3, Y: 30, Z: 0})
+	DoTestCheck("DoTestOres near surface", surface[BT_Coal] > 0 && surface[BT_GoldOre] == 0 && air)
+	deep, _ := count(chunkdb.CC{X: 3, Y: 30, Z: -6})
+	DoTestCheck("DoTestOres deep down", deep[BT_GoldOre] > 0 && deep[BT_Coal] == 0)
+	again, _ := count(chunkdb.CC{X: 3, Y: 30, Z: -6})
+	DoTestCheck("DoTestOres same veins", again[BT_GoldOre] == deep[BT_GoldOre] && again[BT_IronOre] == deep[BT_IronOre])
+	high, _ := count(chunkdb.CC{X: 3, Y: 30, Z: 2})
+	DoTestCheck("DoTestOres none high up", high[BT_Stone] == CHUNK_SIZE*CHUNK_SIZE*(CHUNK_SIZE-1))
+
+	// All resources must be possible to use, or the inventory will fail.
+	for bl, t := range blockTypes {
+		if t.drops != "" && objectUseTable[t.drops] == nil {
+			DoTestCheck(fmt.Sprint("DoTestOres use resource from ", bl), false)
+		}
+	}
+
+	// Digging ore shall give a resource.
+	cc, cp, done := doTestFarChunk(0, 4, BT_Stone, nil)
+	defer done()
+	var up user
+	up.AdminLevel = 1 // Allowed to change any chunk
+	cp.UpdateBlock_WLcWLw(1, 2, 3, BT_GoldOre)
+	up.HitBlock_WLwWLcRLq(cc, 1, 2, 3)
+	i := up.Inventory.Find(ItemGoldOreID, 0)
+	DoTestCheck("DoTestOres mining", i >= 0 && up.Inventory[i].Count == 1 && cp.raw()[1][2][3] == BT_Air && up.BlockRem == 1)
+	up.HitBlock_WLwWLcRLq(cc, 1, 2, 3)
+	DoTestCheck("DoTestOres mining air", up.Inventory[i].Count == 1)
+}
+
+// Generated chunks shall not change, unless the golden values are generated again.
+func DoTestTerrainGoldens() {
+	DoTestCheck("DoTestTerrainGoldens golden values", len(terrainGoldens) > 0)
+	diffs := compareTerrainGoldens()
+	for _, d := range diffs {
+		fmt.Println("DoTestTerrainGoldens", d)
+	}
+	DoTestCheck("DoTestTerrainGoldens", len(diffs) == 0)
+}
+
+func DoTestPregen() {
+	lo, hi := chunkdb.CC{X: 1<<20 + 10, Y: 4, Z: 0}, chunkdb.CC{X: 1<<20 + 10, Y: 5, Z: 0}
+	defer os.Remove(DBChunkFileName(lo))
+	defer os.Remove(DBChunkFileName(hi))
+	stats := PregenerateChunks(lo, hi, 2, 0)
+	DoTestCheck("DoTestPregen created", stats.Total == 2 && stats.Created == 2 && stats.Skipped == 0)
+	// The chunks in the spawn region are reserved.
+	DoTestCheck("DoTestPregen reserved", dBFindChunkFromFS(lo).owner == OWNER_RESERVED && dBFindChunkFromFS(hi).owner != OWNER_RESERVED)
+	stats = PregenerateChunks(lo, hi, 2, 0)
+	DoTestCheck("DoTestPregen resume", stats.Created == 0 && stats.Skipped == 2)
+}
+
+func DoTestBlockRegistry() {
+	for i := range blockTypes {
+		t, bl := &blockTypes[i], block(i)
+		if t.hidden && !t.invisible || t.liquid && t.solid || t.generatedOnly && t.drops == "" {
+			DoTestCheck(fmt.Sprint("DoTestBlockRegistry consistent ", bl, " ", t.name), false)
+		}
+	}
+	DoTestCheck("DoTestBlockRegistry solid", BT_Stone.Solid() && !BT_Air.Solid() && !BT_Water.Solid() && !BT_Tuft.Solid() && BT_Unused.Solid() && block(200).Solid())
+	DoTestCheck("DoTestBlockRegistry properties", BT_Ladder.Climbable() && BT_BrownWater.Liquid() && BT_Trigger.Invisible() && !BT_Stone.Liquid() && BT_Lamp2.Light() > BT_Lamp1.Light())
+
+	var owner, other user
+	owner.Id, other.Id = 1<<30+1, 1<<30+2
+	owner.connState, other.connState = PlayerConnStateDisc, PlayerConnStateDisc // Don't send anything
+	DoTestCheck("DoTestBlockRegistry add", other.mayAdd(BT_Stone) && !other.mayAdd(BT_Topsoil) && !other.mayAdd(block(200)) && !other.mayAdd(BT_GoldOre))
+
+	// Hidden blocks are only sent to the owner.
+	cc, cp, done := doTestFarChunk(0, 6, BT_Stone, nil)
+	defer done()
+	cp.owner = owner.Id
+	data, sum := cp.ClientData_WLc(&other)
+	DoTestCheck("DoTestBlockRegistry nothing hidden", sum == cp.checkSum && len(data) == len(cp.ch_comp))
+	cp.UpdateBlock_WLcWLw(1, 2, 3, BT_Trigger)
+	cp.UpdateBlock_WLcWLw(1, 2, 4, BT_Stone)
+	data, sum = cp.ClientData_WLc(&other)
+	rc := decompressChunk(data)
+	DoTestCheck("DoTestBlockRegistry hidden", sum != cp.checkSum && rc[1][2][3] == BT_Air && rc[1][2][4] == BT_Stone)
+	data, sum = cp.ClientData_WLc(&owner)
+	DoTestCheck("DoTestBlockRegistry owner", sum == cp.checkSum && decompressChunk(data)[1][2][3] == BT_Trigger)
+
+	// Only the owner can remove blocks.
+	other.HitBlock_WLwWLcRLq(cc, 1, 2, 4)
+	DoTestCheck("DoTestBlockRegistry not owner", cp.GetBlock_WLc(1, 2, 4) == BT_Stone && other.BlockRem == 0)
+	owner.HitBlock_WLwWLcRLq(cc, 1, 2, 4)
+	DoTestCheck("DoTestBlockRegistry owner remove", cp.GetBlock_WLc(1, 2, 4) == BT_Air && owner.BlockRem == 1)
+}
+
+func DoTestLiquids() {
+	cc, cp, done := doTestFarChunk(0, 8, BT_Stone, nil)
+	defer done()
+	cp.UpdateBlock_WLcWLw(10, 10, 1, BT_Water)      // Spreads on the ground
+	cp.UpdateBlock_WLcWLw(22, 22, 5, BT_BrownWater) // Falls down first
+	cp.UpdateBlock_WLcWLw(31, 2, 1, BT_Water)       // Next to a chunk that isn't loaded
+	for i := 0; i < 30 && updateLiquids_RLwWLcRLq(1e6) > 0; i++ {
+	}
+	DoTestCheck("DoTestLiquids spread", cp.GetBlock_WLc(16, 10, 1) == BT_Water && cp.GetBlock_WLc(13, 13, 1) == BT_Water && cp.GetBlock_WLc(10, 10, 2) == BT_Air)
+	DoTestCheck("DoTestLiquids limited", cp.GetBlock_WLc(17, 10, 1) == BT_Air && cp.GetBlock_WLc(14, 13, 1) == BT_Air)
+	DoTestCheck("DoTestLiquids fall", cp.GetBlock_WLc(22, 22, 2) == BT_BrownWater && cp.GetBlock_WLc(23, 22, 5) == BT_Air && cp.GetBlock_WLc(28, 22, 1) == BT_BrownWater)
+	DoTestCheck("DoTestLiquids unloaded", cp.GetBlock_WLc(30, 2, 1) == BT_Water && ChunkFindLoaded_RLw(chunkdb.CC{X: cc.X + 1, Y: cc.Y, Z: cc.Z}) == nil)
+	// Removing the ground lets the water fall down.
+	cp.UpdateBlock_WLcWLw(4, 10, 0, BT_Air)
+	updateLiquids_RLwWLcRLq(1e6)
+	DoTestCheck("DoTestLiquids hole", cp.GetBlock_WLc(4, 10, 0) == BT_Water)
+
+	// The levels are saved with the chunk
+	cp.RLock()
+	level, ok := cp.liquidLevels[[3]uint8{16, 10, 1}]
+	var buf bytes.Buffer
+	cp.WriteFS(&buf)
+	cp.RUnlock()
+	DoTestCheck("DoTestLiquids level", ok && level == 1)
+	ch2 := dBDecodeChunk(cc, buf.Bytes())
+	DoTestCheck("DoTestLiquids level saved", ch2 != nil && ch2.liquidLevels[[3]uint8{16, 10, 1}] == 1 && len(ch2.liquidLevels) == len(cp.liquidLevels))
+
+	// Liquid doesn't flow into a chunk with another owner
+	_, cp2, done := doTestFarChunk(-1, 8, BT_Stone, nil)
+	defer done()
+	cp2.Lock()
+	cp2.owner = 7
+	cp2.Unlock()
+	cp.UpdateBlock_WLcWLw(0, 25, 1, BT_Water)
+	updateLiquids_RLwWLcRLq(1e6)
+	DoTestCheck("DoTestLiquids owner", cp.GetBlock_WLc(0, 26, 1) == BT_Water && cp2.GetBlock_WLc(CHUNK_SIZE-1, 25, 1) == BT_Air)
+}
+
+func DoTestRandomTicks() {
+	cc, cp, done := doTestFarChunk(0, 12, BT_Soil, func(rc *raw_chunk) {
+		rc[3][3][1] = BT_Tree1
+		rc[5][5][1] = BT_Stone
+		rc[5][5][2] = BT_Tuft
+	})
+	defer done()
+	saved := tickRates
+	defer func() { tickRates = saved }()
+	tickRates.Plants, tickRates.Trees, tickRates.Snow, tickRates.Decay, tickRates.SnowLine = 1, 1, 0, 1, math.MaxInt64
+	r := rand.New(rand.NewSource(1))
+	tick := func(x, y, z uint8) {
+		target, old, bl, ok := tickBlock_RLwWLc(blockCoordOf(cc, x, y, z), cp.GetBlock_WLc(x, y, z), r)
+		if ok {
+			_, x, y, z := target.chunkOffset()
+			cp.ChangeBlocks_WLcRLq([]blockChange{{blockUpdate{x, y, z, bl}, old, 0}}, true)
+		}
+	}
+	tick(1, 1, 0)
+	plant := cp.GetBlock_WLc(1, 1, 1)
+	DoTestCheck("DoTestRandomTicks plant", plant == BT_Tuft || plant == BT_Flowers)
+	tick(3, 3, 1)
+	tick(3, 3, 1)
+	tick(3, 3, 1)
+	DoTestCheck("DoTestRandomTicks tree", cp.GetBlock_WLc(3, 3, 1) == BT_Tree3)
+	tick(5, 5, 2)
+	tick(1, 1, 1)
+	DoTestCheck("DoTestRandomTicks decay", cp.GetBlock_WLc(5, 5, 2) == BT_Air && cp.GetBlock_WLc(1, 1, 1) == plant)
+	tickRates.Snow, tickRates.SnowLine = 1, 0
+	tick(7, 7, 0)
+	DoTestCheck("DoTestRandomTicks snow", cp.GetBlock_WLc(7, 7, 0) == BT_Snow)
+
+	// Soil doesn't grow more plants when there are many near
+	tickRates.MaxPlants, tickRates.SnowLine = 2, math.MaxInt64
+	cp.ChangeBlocks_WLcRLq([]blockChange{{blockUpdate{20, 20, 1, BT_Tuft}, BT_Air, 0}, {blockUpdate{21, 20, 1, BT_Tuft}, BT_Air, 0}}, true)
+	tick(22, 20, 0)
+	DoTestCheck("DoTestRandomTicks max plants", cp.GetBlock_WLc(22, 20, 1) == BT_Air)
+
+	// The changes are not saved in chunks without an owner
+	tickRates.MaxPlants = math.MaxInt32
+	cp.Lock()
+	cp.flag &^= CHF_MODIFIED
+	cp.Unlock()
+	DoTestCheck("DoTestRandomTicks not saved", cp.RandomTicks_RLwWLcRLq(CHUNK_VOL, r) > 0 && cp.flag&CHF_MODIFIED == 0)
+
+	// The owner can stop the growth.
+	var up user
+	up.connState = PlayerConnStateDisc // Don't send anything
+	up.Territory = []chunkdb.CC{cc}
+	up.TerritoryGrowth_WLc([]string{"off"})
+	DoTestCheck("DoTestRandomTicks growth off", cp.RandomTicks_RLwWLcRLq(CHUNK_VOL, r) == 0)
+	up.TerritoryGrowth_WLc([]string{"on"})
+	DoTestCheck("DoTestRandomTicks growth on", cp.RandomTicks_RLwWLcRLq(CHUNK_VOL, r) > 0)
+}
+
+func DoTestLight() {
+	cc, cp, done := doTestFarChunk(0, 14, BT_Stone, func(rc *raw_chunk) {
+		for x := 0; x < 10; x++ {
+			for y := 0; y < 10; y++ {
+				rc[x][y][10] = BT_Stone // A roof
+			}
+		}
+	})
+	defer done()
+	pos := func(x, y, z uint8) blockCoord { return blockCoordOf(cc, x, y, z) }
+	DoTestCheck("DoTestLight sky", LightLevel_RLwWLc(pos(20, 20, 1)) == skyLight && skyExposed_RLwWLc(pos(20, 20, 1)))
+	DoTestCheck("DoTestLight dark", LightLevel_RLwWLc(pos(5, 5, 1)) == 0 && !skyExposed_RLwWLc(pos(5, 5, 1)))
+	cp.UpdateBlock_WLcWLw(5, 5, 5, BT_Lamp2)
+	DoTestCheck("DoTestLight lamp", LightLevel_RLwWLc(pos(5, 5, 1)) == BT_Lamp2.Light()-4 && LightLevel_RLwWLc(pos(5, 5, 5)) == BT_Lamp2.Light())
+	DoTestCheck("DoTestLight out of range", LightLevel_RLwWLc(pos(5, 5+BT_Lamp2.Light(), 5)) == skyLight)
+	DoTestCheck("DoTestLight spawn", monsterSpawnProbability(0) == 1 && monsterSpawnProbability(LightLevel_RLwWLc(pos(5, 5, 1))) == 0)
+	above := chunkdb.CC{X: cc.X, Y: cc.Y + 1, Z: cc.Z + 1}
+	loaded := ChunkFindLoaded_RLw(above) != nil
+	LightLevel_RLwWLc(pos(31, 31, 31))
+	DoTestCheck("DoTestLight no chunks loaded", loaded || ChunkFindLoaded_RLw(above) == nil)
+}
+
+func DoTestCollision() {
+	cc, _, done := doTestFarChunk(0, 16, BT_Stone, func(rc *raw_chunk) {
+		for y := 0; y < 10; y++ {
+			for z := 1; z < 6; z++ {
+				rc[10][y][z] = BT_Stone // A thin wall
+			}
+		}
+		rc[20][5][1] = BT_Stone // A step
+		for y := 10; y < 15; y++ {
+			rc[25][y][1], rc[25][y][2] = BT_Stone, BT_Stone // Too high to step up
+		}
+		rc[30][30][5] = BT_Stone // A roof
+	})
+	defer done()
+	o := blockCoordOf(cc, 0, 0, 0)
+	pos := func(x, y, z float64) user_coord {
+		return user_coord{float64(o.X) + x, float64(o.Y) + y, float64(o.Z) + z}
+	}
+	w := playerBody.width / 2
+
+	p, stopped := playerBody.Move_WLwWLc(pos(8.5, 5.5, 1), 5, 0, 0, true)
+	DoTestCheck("DoTestCollision thin wall", stopped && p == pos(10-w, 5.5, 1))
+	p, stopped = playerBody.Move_WLwWLc(pos(8.5, 5.5, 1), 3, 2, 0, true)
+	DoTestCheck("DoTestCollision slide", stopped && p == pos(10-w, 7.5, 1))
+	p, stopped = playerBody.Move_WLwWLc(pos(18.5, 5.5, 1), 2, 0, 0, true)
+	DoTestCheck("DoTestCollision step up", !stopped && p == pos(20.5, 5.5, 2))
+	p, stopped = playerBody.Move_WLwWLc(pos(18.5, 5.5, 1), 2, 0, 0, false)
+	DoTestCheck("DoTestCollision no step up", stopped && p == pos(20-w, 5.5, 1))
+	p, stopped = playerBody.Move_WLwWLc(pos(23.5, 12.5, 1), 3, 0, 0, true)
+	DoTestCheck("DoTestCollision high wall", stopped && p == pos(25-w, 12.5, 1))
+	p = pos(30.5, 30.5, 1)
+	speed := UpdateZPos_WLwWLc(0, PlayerJumpSpeed, &p, playerBody)
+	DoTestCheck("DoTestCollision roof", speed == 0 && p == pos(30.5, 30.5, 5-playerBody.height))
+	DoTestCheck("DoTestCollision fits", playerBody.Fits_WLwWLc(pos(9.5, 5.5, 1)) && !playerBody.Fits_WLwWLc(pos(9.8, 5.5, 1)) && !playerBody.Fits_WLwWLc(pos(5.5, 5.5, 0.5)))
+
+	// Monsters use the same collisions, and turn at walls.
+	var m monster
+	m.Coord = pos(8.5, 5.5, 1)
+	m.dirHor = math.Pi / 2 // Towards the wall
+	m.speed = 5
+	m.mvFwd = true
+	m.Move_WLwWLc(1e9)
+	want := pos(10-monsterBody.width/2, 5.5, 1)
+	DoTestCheck("DoTestCollision monster", m.Coord.X == want.X && math.Abs(m.Coord.Y-want.Y) < 1e-6 && m.Coord.Z == want.Z && m.state == MD_TURNING && !m.mvFwd)
+}
+
+func DoTestWorldCache() {
+	old := dBCreateChunk(chunkdb.CC{X: 1 << 20, Y: 1<<20 + 1, Z: 1 << 20})
+	AddChunkToCache(old)
+	old.lastUsed = time.Now().Add(-2 * time.Hour).UnixNano()
+	fresh := dBCreateChunk(chunkdb.CC{X: 1 << 20, Y: 1<<20 + 2, Z: 1 << 20})
+	AddChunkToCache(fresh)
+	hits := CacheStats.Hits
+	DoTestCheck("DoTestWorldCache find", ChunkFind_WLwWLc(fresh.Coord) == fresh && CacheStats.Hits == hits+1)
+	purgeWorldCache(1<<62, time.Hour, time.Hour)
+	DoTestCheck("DoTestWorldCache remove idle chunk", cacheShardOf(old.Coord).chunks[old.Coord] == nil)
+	DoTestCheck("DoTestWorldCache keep used chunk", cacheShardOf(fresh.Coord).chunks[fresh.Coord] == fresh)
+	// Only the given shards are purged
+	AddChunkToCache(old)
+	old.lastUsed = time.Now().Add(-2 * time.Hour).UnixNano()
+	var shard int
+	for shard = range worldCache {
+		if &worldCache[shard] == cacheShardOf(old.Coord) {
+			break
+		}
+	}
+	purgeCacheShards(shard+1, worldCacheShards-1, 1<<62, time.Hour, time.Hour)
+	DoTestCheck("DoTestWorldCache other shards", cacheShardOf(old.Coord).chunks[old.Coord] == old)
+	purgeCacheShards(shard, 1, 1<<62, time.Hour, time.Hour)
+	DoTestCheck("DoTestWorldCache one shard", cacheShardOf(old.Coord).chunks[old.Coord] == nil)
+	evictions := CacheStats.Evictions
+	n := NumCachedChunks()
+	purgeWorldCache(0, time.Hour, time.Hour)
+	DoTestCheck("DoTestWorldCache memory budget", NumCachedChunks() == 0 && CacheStats.Evictions == evictions+int64(n) && CacheStats.MemUsed == 0)
+}
+
+// Many simultaneous requests for the same chunk shall give the same chunk.
+func DoTestConcurrentChunkLoad() {
+	const n = 8
+	coord := chunkdb.CC{X: 1 << 20, Y: 1<<20 + 3, Z: 1 << 20}
+	defer os.Remove(DBChunkFileName(coord))
+	misses := CacheStats.Misses
+	ch := make(chan *chunk)
+	for i := 0; i < n; i++ {
+		go func() { ch <- ChunkFind_WLwWLc(coord) }()
+	}
+	first := <-ch
+	same := first != nil
+	for i := 1; i < n; i++ {
+		if <-ch != first {
+			same = false
+		}
+	}
+	DoTestCheck("DoTestConcurrentChunkLoad same chunk", same)
+	DoTestCheck("DoTestConcurrentChunkLoad loaded once", CacheStats.Misses == misses+1)
+}
+
+func DoTestPrefetchCandidates() {
+	pos := user_coord{CHUNK_SIZE / 2, CHUNK_SIZE / 2, CHUNK_SIZE / 2}
+	DoTestCheck("DoTestPrefetchCandidates not moving", prefetchCandidates(pos, pos, time.Second) == nil)
+	teleport := user_coord{pos.X + 100*CHUNK_SIZE, pos.Y, pos.Z}
+	DoTestCheck("DoTestPrefetchCandidates teleport", prefetchCandidates(pos, teleport, time.Second) == nil)
+	// Moving one chunk per second along X
+	next := user_coord{pos.X + CHUNK_SIZE, pos.Y, pos.Z}
+	list := prefetchCandidates(pos, next, time.Second)
+	current := next.GetChunkCoord()
+	ahead := true
+	for _, cc := range list {
+		if cc.X <= current.X || ccDist2(cc, current) <= CnfgMaxChunkReqDist*CnfgMaxChunkReqDist {
+			ahead = false
+		}
+	}
+	DoTestCheck("DoTestPrefetchCandidates only chunks ahead", len(list) > 0 && ahead)
+	f := float64(CnfgPrefetchAhead) / float64(time.Second)
+	predicted := user_coord{next.X + CHUNK_SIZE*f, next.Y, next.Z}
+	center := predicted.GetChunkCoord()
+	DoTestCheck("DoTestPrefetchCandidates nearest first", len(list) > 1 && ccDist2(list[0], center) <= ccDist2(list[len(list)-1], center))
 }
@@ -41,6 +41,27 @@ func SaveAllPlayers_RLa() {
 	allPlayersSem.RUnlock()
 }
 
+// Save all players now, and wait until it is done. Return the number of saved players.
+func SaveAllPlayersNow_RLaWLu() int {
+	var list []*user
+	allPlayersSem.RLock()
+	for i := 0; i < MAX_PLAYERS; i++ {
+		if up := allPlayers[i]; up != nil {
+			list = append(list, up)
+		}
+	}
+	allPlayersSem.RUnlock()
+	n := 0
+	for _, up := range list {
+		up.Lock()
+		if up.Id != 0 && up.Email != "" && up.connState == PlayerConnStateIn && up.Save_Bl() {
+			n++
+		}
+		up.Unlock()
+	}
+	return n
+}
+
 // Send a text message to a player, which must not be locked.
 // If the message can't be sent, discard it.
 func (up *user) Printf(format string, a ...interface{}) {
@@ -102,6 +123,36 @@ func (up *user) SendMessageBlockUpdate(cc chunkdb.CC, dx uint8, dy uint8, dz uin
 	up.writeNonBlocking(ans[:])
 }
 
+// A block that has changed, used for sending many changes in one message.
+type blockUpdate struct {
+	x, y, z uint8
+	bl      block
+}
+
+// Compose messages to the client to update many blocks in a chunk. The player must not be locked.
+func (up *user) SendMessageBlockUpdates(cc chunkdb.CC, list []blockUpdate) {
+	const maxBlocks = (math.MaxUint16 - 15) / 4 // Limited by the size of the message
+	for len(list) > 0 {
+		n := len(list)
+		if n > maxBlocks {
+			n = maxBlocks
+		}
+		length := 15 + 4*n
+		ans := make([]byte, length)
+		ans[0] = byte(length & 0xFF)
+		ans[1] = byte(length >> 8)
+		ans[2] = client_prot.CMD_BLOCK_UPDATE
+		EncodeUint32(uint32(cc.X), ans[3:7])
+		EncodeUint32(uint32(cc.Y), ans[7:11])
+		EncodeUint32(uint32(cc.Z), ans[11:15])
+		for i, b := range list[:n] {
+			ans[15+4*i], ans[16+4*i], ans[17+4*i], ans[18+4*i] = b.x, b.y, b.z, uint8(b.bl)
+		}
+		up.writeNonBlocking(ans)
+		list = list[n:]
+	}
+}
+
 // Report the inventory for one item to a player.
 // The amount can be 0. The purpose of this function is to update the client for a specific
 // inventory item.
@@ -138,10 +189,20 @@ func AddOneObjectToUser_WLuBl(up *user, Type ObjectCode) {
 	up.Lock()
 	level := MonsterDifficulty(&up.Coord) // We want an object of a level corresponding to the monsters at this place.
 	up.Inventory.AddOneObject(Type, level)
+	up.Journal("item " + string(Type))
 	up.Unlock()
 	ReportOneInventoryItem_WluBl(up, Type, level)
 }
 
+// Add a resource to the player inventory. Resources always have level 0, as they are the same
+// wherever they are found. It is not saved in the journal, as it happens for almost every block dug.
+func AddResourceToUser_WLuBl(up *user, Type ObjectCode) {
+	up.Lock()
+	up.Inventory.AddOneObject(Type, 0)
+	up.Unlock()
+	ReportOneInventoryItem_WluBl(up, Type, 0)
+}
+
 // Find all players near 'up', including self, and report the equipment of 'up'
 func ReportEquipmentToNear_Bl(up *user) {
 	nearPlayers := playerQuadtree.FindNearObjects_RLq(up.GetPreviousPos(), client_prot.NEAR_OBJECTS)
@@ -0,0 +1,292 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Players are only saved to the database now and then. To not lose important changes if the
+// server crashes, every important event (level up, items, territory and keys) is appended to a
+// journal file for the player. The journal is replayed when the player is loaded, and removed when
+// the player has been saved.
+//
+// Every entry is a BSON document with the absolute values of the important player state, not the
+// change. That way, it doesn't matter if an entry is replayed more than once. The journal is renamed
+// before the player is saved, so that events that happen during the save go into a new journal.
+// Every entry has a sequence number, which is also saved with the player. If the server stops after
+// the player was saved, but before the journal was removed, the entries that are already in the
+// database are not replayed, as they would roll back newer changes.
+//
+// The entries are written by a separate process, to not wait for the disk while the player is locked.
+// All entries that are created while the disk is busy are written together, with only one sync for
+// every journal file.
+//
+
+import (
+	"chunkdb"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"io/ioutil"
+	"keys"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The part of the player state that is saved in the journal.
+type journalState struct {
+	Level       uint32
+	Exp         float32
+	NumKill     uint32
+	WeaponGrade uint8
+	ArmorGrade  uint8
+	HelmetGrade uint8
+	WeaponLvl   uint32
+	ArmorLvl    uint32
+	HelmetLvl   uint32
+	ReviveSP    user_coord
+	Territory   []chunkdb.CC
+	Maxchunks   int
+	Keys        keys.KeyRing
+	Inventory   PlayerInv
+}
+
+type journalEntry struct {
+	Event string    // What caused the entry. Only used for logging.
+	Time  time.Time // When the entry was created
+	Seq   uint64    // The sequence number, counted for every player
+	State journalState
+}
+
+var (
+	journalLock sync.Mutex // Only one journal file operation at a time
+
+	journalPending     = make(map[uint32]*pendingJournal) // Entries not written yet, for every player id
+	journalPendingLock sync.Mutex
+	journalWake        = make(chan struct{}, 1) // Tell the journal process that there are new entries
+
+	JournalStats struct {
+		NumEntries  int // Number of entries appended
+		NumReplayed int // Number of entries replayed when loading players
+	}
+)
+
+type pendingJournal struct {
+	data []byte // The encoded entries
+	num  int    // Number of entries
+}
+
+func journalFileName(uid uint32) string {
+	return filepath.Join(CnfgJournalFolder, strconv.FormatUint(uint64(uid), 10))
+}
+
+// The journal that is being committed by a save
+func journalCommitFileName(uid uint32) string {
+	return journalFileName(uid) + ".save"
+}
+
+// Append the current state of the player to the journal. The player must be locked.
+// Test players are never saved, and so they have no journal.
+func (up *user) Journal(event string) {
+	if up.Email == "" || up.Id == 0 {
+		return
+	}
+	pl := &up.player
+	pl.JournalSeq++
+	entry := journalEntry{Event: event, Time: time.Now(), Seq: pl.JournalSeq, State: journalState{
+		Level: pl.Level, Exp: pl.Exp, NumKill: pl.NumKill,
+		WeaponGrade: pl.WeaponGrade, ArmorGrade: pl.ArmorGrade, HelmetGrade: pl.HelmetGrade,
+		WeaponLvl: pl.WeaponLvl, ArmorLvl: pl.ArmorLvl, HelmetLvl: pl.HelmetLvl,
+		ReviveSP: pl.ReviveSP, Territory: pl.Territory, Maxchunks: pl.Maxchunks,
+		Keys: pl.Keys, Inventory: pl.Inventory,
+	}}
+	b, err := bson.Marshal(&entry)
+	if err != nil {
+		log.Println("Journal", up.Name, err)
+		return
+	}
+	journalPendingLock.Lock()
+	pj := journalPending[up.Id]
+	if pj == nil {
+		pj = new(pendingJournal)
+		journalPending[up.Id] = pj
+	}
+	pj.data = append(pj.data, b...)
+	pj.num++
+	journalPendingLock.Unlock()
+	select {
+	case journalWake <- struct{}{}:
+	default: // The journal process is already told
+	}
+}
+
+// Write all pending entries to the journal files. journalLock must be locked.
+func writePendingJournals() {
+	journalPendingLock.Lock()
+	pending := journalPending
+	journalPending = make(map[uint32]*pendingJournal)
+	journalPendingLock.Unlock()
+	for uid, pj := range pending {
+		writeJournal(uid, pj)
+	}
+}
+
+// Write the pending entries of one player to the journal file. journalLock must be locked.
+func writePendingJournal(uid uint32) {
+	journalPendingLock.Lock()
+	pj := journalPending[uid]
+	delete(journalPending, uid)
+	journalPendingLock.Unlock()
+	if pj != nil {
+		writeJournal(uid, pj)
+	}
+}
+
+func writeJournal(uid uint32, pj *pendingJournal) {
+	err := os.MkdirAll(CnfgJournalFolder, 0777)
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(journalFileName(uid), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err == nil {
+			_, err = f.Write(pj.data)
+			if err == nil {
+				err = f.Sync() // The whole point is to survive a crash
+			}
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+		}
+	}
+	if err != nil {
+		log.Println("Journal", uid, err)
+		return
+	}
+	JournalStats.NumEntries += pj.num
+}
+
+func ProcJournal() {
+	for {
+		<-journalWake
+		journalLock.Lock()
+		writePendingJournals()
+		journalLock.Unlock()
+	}
+}
+
+// Read all complete entries from a journal file. A partially written entry at the end,
+// from a crash, is ignored.
+func readJournal(fn string) []journalEntry {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("readJournal", err)
+		}
+		return nil
+	}
+	var list []journalEntry
+	for len(data) >= 4 {
+		size := int(data[0]) | int(data[1])<<8 | int(data[2])<<16 | int(data[3])<<24
+		if size < 5 || size > len(data) {
+			log.Println("readJournal", fn, "truncated entry")
+			break
+		}
+		var entry journalEntry
+		if err := bson.Unmarshal(data[:size], &entry); err != nil {
+			log.Println("readJournal", fn, err)
+			break
+		}
+		list = append(list, entry)
+		data = data[size:]
+	}
+	return list
+}
+
+// Replay the journal of a player that was just loaded from the database. Return the number
+// of replayed entries. The journal that was being committed when the server stopped comes first.
+// Entries that are already included in the saved player are skipped. Entries from before there
+// were sequence numbers have number 0, and are always replayed.
+func (up *user) ReplayJournal() int {
+	journalLock.Lock()
+	writePendingJournal(up.Id)
+	list := append(readJournal(journalCommitFileName(up.Id)), readJournal(journalFileName(up.Id))...)
+	journalLock.Unlock()
+	pl := &up.player
+	var replayed int
+	for _, entry := range list {
+		if pl.JournalSeq != 0 && entry.Seq <= pl.JournalSeq {
+			continue
+		}
+		replayed++
+		if entry.Seq != 0 {
+			pl.JournalSeq = entry.Seq
+		}
+		st := &entry.State
+		pl.Level, pl.Exp, pl.NumKill = st.Level, st.Exp, st.NumKill
+		pl.WeaponGrade, pl.ArmorGrade, pl.HelmetGrade = st.WeaponGrade, st.ArmorGrade, st.HelmetGrade
+		pl.WeaponLvl, pl.ArmorLvl, pl.HelmetLvl = st.WeaponLvl, st.ArmorLvl, st.HelmetLvl
+		pl.ReviveSP, pl.Territory, pl.Maxchunks = st.ReviveSP, st.Territory, st.Maxchunks
+		pl.Keys, pl.Inventory = st.Keys, st.Inventory
+		if *verboseFlag > 1 {
+			log.Printf("Replay journal %s: %s at %v\n", up.Name, entry.Event, entry.Time)
+		}
+	}
+	journalLock.Lock()
+	JournalStats.NumReplayed += replayed
+	journalLock.Unlock()
+	return replayed
+}
+
+// Called before a player is saved. New entries will go into a new journal. If a previous save
+// failed, the old commit journal is still there, and the current journal is appended to it.
+func journalStartCommit(uid uint32) {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	writePendingJournal(uid) // Older entries must not end up in the new journal
+	fn, commit := journalFileName(uid), journalCommitFileName(uid)
+	if _, err := os.Stat(commit); err != nil {
+		if err = os.Rename(fn, commit); err != nil && !os.IsNotExist(err) {
+			log.Println("journalStartCommit", err)
+		}
+		return
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return // Nothing new
+	}
+	f, err := os.OpenFile(commit, os.O_WRONLY|os.O_APPEND, 0666)
+	if err == nil {
+		_, err = f.Write(data)
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+	}
+	if err != nil {
+		log.Println("journalStartCommit", err)
+		return
+	}
+	os.Remove(fn)
+}
+
+// Called when a player has been saved successfully. The committed journal is no longer needed.
+func journalEndCommit(uid uint32) {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	if err := os.Remove(journalCommitFileName(uid)); err != nil && !os.IsNotExist(err) {
+		log.Println("journalEndCommit", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// A coarse light level of blocks, from 0 (dark) to 15, used to decide where monsters may spawn.
+//
+// A block that has only transparent blocks above it, for some distance, gets the sky light. Every
+// block that emits light, as declared in blockTypes, lights the blocks around it. The light decreases
+// by one for every block of distance, counted along the axes. Walls don't stop the light, it is only
+// an approximation of what the client shows.
+//
+// The light sources of a chunk are found when needed, and then kept until the chunk is changed.
+// Chunks that are not loaded are never loaded to compute the light, they are skipped instead.
+//
+
+import (
+	"math"
+)
+
+const maxLight = 15 // The highest light level
+
+var (
+	skyLight        = uint8(CnfgSkyLight)        // The light of blocks exposed to the sky
+	monsterMaxLight = uint8(CnfgMonsterMaxLight) // Monsters don't spawn where the light is at this level, or higher
+)
+
+// A block that emits light
+type lightSource struct {
+	x, y, z uint8
+	light   uint8
+}
+
+// Get the light sources in the chunk. The list must not be modified.
+func (cp *chunk) lightSources_WLc() []lightSource {
+	cp.RLock()
+	list, known := cp.lights, cp.lightsKnown
+	cp.RUnlock()
+	if known {
+		return list
+	}
+	cp.Lock()
+	defer cp.Unlock()
+	list = nil
+	rc := cp.raw()
+	for x := 0; x < CHUNK_SIZE; x++ {
+		for y := 0; y < CHUNK_SIZE; y++ {
+			for z := 0; z < CHUNK_SIZE; z++ {
+				if light := rc[x][y][z].Light(); light > 0 {
+					list = append(list, lightSource{uint8(x), uint8(y), uint8(z), light})
+				}
+			}
+		}
+	}
+	cp.lights, cp.lightsKnown = list, true
+	return list
+}
+
+// True if there are only transparent blocks above 'bc', for CnfgSkyScan blocks. Blocks in chunks that
+// are not loaded are not tested.
+func skyExposed_RLwWLc(bc blockCoord) bool {
+	for z := bc.Z + 1; z <= bc.Z+CnfgSkyScan; z++ {
+		if bl, cp := GetLoadedBlock_RLwWLc(blockCoord{bc.X, bc.Y, z}); cp != nil && !bl.Transparent() {
+			return false
+		}
+	}
+	return true
+}
+
+// Compute the light level of a block.
+func LightLevel_RLwWLc(bc blockCoord) uint8 {
+	var light uint8
+	if skyLight > 0 && skyExposed_RLwWLc(bc) {
+		light = skyLight
+	}
+	abs := func(a int64) int64 {
+		if a < 0 {
+			return -a
+		}
+		return a
+	}
+	// Only the chunks within the range of the strongest light have to be tested.
+	lo := blockCoord{bc.X - maxLight, bc.Y - maxLight, bc.Z - maxLight}.GetChunkCoord()
+	hi := blockCoord{bc.X + maxLight, bc.Y + maxLight, bc.Z + maxLight}.GetChunkCoord()
+	for cc := lo; cc.X <= hi.X; cc.X++ {
+		for cc.Y = lo.Y; cc.Y <= hi.Y; cc.Y++ {
+			for cc.Z = lo.Z; cc.Z <= hi.Z; cc.Z++ {
+				cp := ChunkFindLoaded_RLw(cc)
+				if cp == nil {
+					continue
+				}
+				for _, ls := range cp.lightSources_WLc() {
+					lc := blockCoordOf(cc, ls.x, ls.y, ls.z)
+					dist := abs(lc.X-bc.X) + abs(lc.Y-bc.Y) + abs(lc.Z-bc.Z)
+					if dist < int64(ls.light) && ls.light-uint8(dist) > light {
+						light = ls.light - uint8(dist)
+					}
+				}
+			}
+		}
+	}
+	return light
+}
+
+// The probability that a monster spawns at a place with light level 'light'. It is highest
+// in complete darkness.
+func monsterSpawnProbability(light uint8) float64 {
+	if light >= monsterMaxLight {
+		return 0
+	}
+	return 1 - float64(light)/float64(monsterMaxLight)
+}
+
+// Get the block coordinate of a user coordinate
+func (uc *user_coord) blockCoord() blockCoord {
+	return blockCoord{int64(math.Floor(uc.X)), int64(math.Floor(uc.Y)), int64(math.Floor(uc.Z))}
+}
@@ -0,0 +1,193 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Flowing liquids. When a block is changed, the liquid next to it is scheduled for an update. Every
+// period, the scheduled liquid blocks flow one step into the air next to them: down if possible,
+// otherwise sideways. Liquid that flows sideways loses one level, and stops when the level is 1, so a
+// source can only flood a limited area. Liquid that falls keeps the level.
+//
+// Liquid that isn't a result of flowing is a source, with the highest level. The levels of flowing
+// liquid are kept in the chunk, and saved with it.
+//
+// Liquid only flows into chunks that are loaded, and that have the same owner as the chunk of the
+// liquid. It never flows into reserved chunks. The changes are saved as normal block changes, and
+// sent to near players with one message for every chunk.
+//
+
+import (
+	"chunkdb"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"time"
+	"timerstats"
+)
+
+var liquids struct {
+	sync.Mutex
+	pending map[blockCoord]bool // Blocks that shall be updated
+}
+
+// Statistics, protected by the liquids lock
+var LiquidStats struct {
+	Updated, Flowed int64 // Number of liquid blocks updated, and number of blocks they flowed into
+	Pending         int   // Number of liquid blocks waiting to be updated
+}
+
+func init() {
+	liquids.pending = make(map[blockCoord]bool)
+}
+
+// Block 'bl' was set at x,y,z in the chunk. Schedule an update of the liquid that may flow because of it.
+// This is called when the chunk is locked.
+func (cp *chunk) scheduleLiquids(x, y, z uint8, bl block) {
+	delete(cp.liquidLevels, [3]uint8{x, y, z}) // A new block, which is a source if it is a liquid
+	bc := blockCoordOf(cp.Coord, x, y, z)
+	liquids.Lock()
+	defer liquids.Unlock()
+	if bl.Liquid() {
+		liquids.pending[bc] = true
+		return
+	}
+	if bl.Solid() {
+		return
+	}
+	// Liquid above, or on the sides, may flow into this block
+	liquids.pending[blockCoord{bc.X, bc.Y, bc.Z + 1}] = true
+	liquids.pending[blockCoord{bc.X - 1, bc.Y, bc.Z}] = true
+	liquids.pending[blockCoord{bc.X + 1, bc.Y, bc.Z}] = true
+	liquids.pending[blockCoord{bc.X, bc.Y - 1, bc.Z}] = true
+	liquids.pending[blockCoord{bc.X, bc.Y + 1, bc.Z}] = true
+}
+
+// Get the level of the liquid at 'bc', and the owner of the chunk. Return false if the chunk isn't loaded.
+func liquidLevel_RLwWLc(bc blockCoord) (level uint8, owner uint32, ok bool) {
+	cc, x, y, z := bc.chunkOffset()
+	cp := ChunkFindLoaded_RLw(cc)
+	if cp == nil {
+		return 0, 0, false
+	}
+	cp.RLock()
+	defer cp.RUnlock()
+	level, found := cp.liquidLevels[[3]uint8{x, y, z}]
+	if !found {
+		level = CnfgLiquidLevels
+	}
+	return level, cp.owner, true
+}
+
+// The state of one update of the liquids.
+type liquidUpdate struct {
+	changed map[blockCoord]block         // Blocks changed in this update, not yet saved in the chunks
+	chunks  map[chunkdb.CC][]blockChange // The same changes, for every chunk
+}
+
+// Get a block, including the changes of this update. Return false if the chunk isn't loaded.
+func (lu *liquidUpdate) get_RLwWLc(bc blockCoord) (block, bool) {
+	if bl, ok := lu.changed[bc]; ok {
+		return bl, true
+	}
+	bl, cp := GetLoadedBlock_RLwWLc(bc)
+	return bl, cp != nil
+}
+
+// Let liquid 'bl' flow into 'bc', if it is air in a loaded chunk owned by 'owner'.
+func (lu *liquidUpdate) flow_RLwWLc(bc blockCoord, bl block, level uint8, owner uint32) bool {
+	if old, ok := lu.get_RLwWLc(bc); !ok || old != BT_Air {
+		return false
+	}
+	cc, x, y, z := bc.chunkOffset()
+	cp := ChunkFindLoaded_RLw(cc)
+	if cp == nil || owner == OWNER_RESERVED {
+		return false
+	}
+	cp.RLock()
+	other := cp.owner
+	cp.RUnlock()
+	if other != owner {
+		return false
+	}
+	if level == CnfgLiquidLevels {
+		level = 0 // Falling from a source, it is also a source
+	}
+	lu.changed[bc] = bl
+	lu.chunks[cc] = append(lu.chunks[cc], blockChange{blockUpdate{x, y, z, bl}, BT_Air, level})
+	return true
+}
+
+// Update the liquid blocks that are scheduled, at most 'budget' of them. Return the number of updated blocks.
+func updateLiquids_RLwWLcRLq(budget int) int {
+	liquids.Lock()
+	var list []blockCoord
+	for bc := range liquids.pending {
+		if len(list) == budget {
+			break
+		}
+		list = append(list, bc)
+		delete(liquids.pending, bc)
+	}
+	liquids.Unlock()
+
+	lu := &liquidUpdate{changed: make(map[blockCoord]block), chunks: make(map[chunkdb.CC][]blockChange)}
+	for _, bc := range list {
+		bl, ok := lu.get_RLwWLc(bc)
+		if !ok || !bl.Liquid() {
+			continue
+		}
+		level, owner, ok := liquidLevel_RLwWLc(bc)
+		if !ok {
+			continue
+		}
+		below := blockCoord{bc.X, bc.Y, bc.Z - 1}
+		if lu.flow_RLwWLc(below, bl, level, owner) {
+			continue // Falling liquid doesn't flow sideways
+		}
+		if b, ok := lu.get_RLwWLc(below); !ok || b == BT_Air || level <= 1 {
+			continue // Not on stable ground, or can't flow any further
+		}
+		lu.flow_RLwWLc(blockCoord{bc.X - 1, bc.Y, bc.Z}, bl, level-1, owner)
+		lu.flow_RLwWLc(blockCoord{bc.X + 1, bc.Y, bc.Z}, bl, level-1, owner)
+		lu.flow_RLwWLc(blockCoord{bc.X, bc.Y - 1, bc.Z}, bl, level-1, owner)
+		lu.flow_RLwWLc(blockCoord{bc.X, bc.Y + 1, bc.Z}, bl, level-1, owner)
+	}
+
+	flowed := 0
+	for cc, changes := range lu.chunks {
+		if cp := ChunkFindLoaded_RLw(cc); cp != nil { // It may have been purged from the cache since it was tested
+			flowed += cp.ChangeBlocks_WLcRLq(changes, true) // The new liquid blocks are scheduled to flow further
+		}
+	}
+
+	liquids.Lock()
+	LiquidStats.Updated += int64(len(list))
+	LiquidStats.Flowed += int64(flowed)
+	LiquidStats.Pending = len(liquids.pending)
+	liquids.Unlock()
+	return len(list)
+}
+
+func ProcLiquids_RLwWLcRLq() {
+	var elapsed time.Duration
+	timerstats.Add("ProcLiquids", CnfgLiquidPeriod, &elapsed)
+	for {
+		time.Sleep(CnfgLiquidPeriod)
+		start := time.Now()
+		updateLiquids_RLwWLcRLq(CnfgLiquidBudget)
+		elapsed = time.Now().Sub(start)
+	}
+}
@@ -405,6 +405,7 @@ func ManageOneClient2_WLuWLqWLmBlWLcWLw(conn net.Conn, i int) {
 			if val >= 0 {
 				up.Inventory.Remove(code, lvl)
 				up.AddExperience(val)
+				up.Journal("drop " + string(code))
 			}
 			up.Unlock()
 			// log.Println("CMD_DROP_ITEM", code, lvl, val)
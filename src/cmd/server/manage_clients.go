@@ -84,13 +84,14 @@ type user struct {
 
 // This the part of the user that shall be loaded from the DB
 type UserLoad struct {
-	player     `bson:",inline"` // This is what is saved. All other is read only from DB
-	Id         uint32           `bson:"_id"`
-	Email      string           // The owner, which is an email
-	License    string           // String created when player is registered
-	Password   string           // Encrypted password
-	AdminLevel uint8            // A constant from Admin*, used to control the rights.
-	Name       string           // The name of the avatar
+	player        `bson:",inline"` // This is what is saved. All other is read only from DB
+	Id            uint32           `bson:"_id"`
+	Email         string           // The owner, which is an email
+	License       string           // String created when player is registered
+	Password      string           // Encrypted password
+	AdminLevel    uint8            // A constant from Admin*, used to control the rights.
+	Name          string           // The name of the avatar
+	SchemaVersion int              // The version of the document, see ephenationdb.SchemaVersion
 }
 
 var (
@@ -392,6 +393,9 @@ func CmdAttachBlock_WLwWLcRLq(cc chunkdb.CC, dx, dy, dz uint8, blType block, ind
 		from.Printf("Not owner of chunk. See help for territory")
 		return
 	}
+	if !from.mayAdd(blType) {
+		return
+	}
 	if !cp.UpdateBlock_WLcWLw(dx, dy, dz, blType) {
 		return
 	}
@@ -405,7 +409,7 @@ func CmdAttachBlock_WLwWLcRLq(cc chunkdb.CC, dx, dy, dz uint8, blType block, ind
 	for _, o := range near {
 		// Only need to tell players, not monsters etc.
 		up, ok := o.(*user)
-		if ok {
+		if ok && (!blockTypes[blType].hidden || cp.showHidden(up)) {
 			up.SendMessageBlockUpdate(cc, dx, dy, dz, blType)
 		}
 	}
@@ -431,15 +435,22 @@ func (up *user) SendMsgUpdatedStats_Bl(ans []byte) {
 func (up *user) HitBlock_WLwWLcRLq(cc chunkdb.CC, dx, dy, dz uint8) {
 	// TODO: Check distance to player, only allow digging near blocks.
 	cp := ChunkFind_WLwWLc(cc)
-	if cp.owner != up.Id && up.AdminLevel < 1 {
-		up.Printf_Bl("#FAIL Not owner of chunk. See help for territory")
-		return
-	}
-
 	// Is this actually a teleport that shall be removed? It is a special case, as teleports are not
 	// stored as blocks in the chunk.
 	tx, ty, tz, teleport := superChunkManager.GetTeleport(&cc)
-	if teleport && dx == tx && dy == ty && dz == tz {
+	teleport = teleport && dx == tx && dy == ty && dz == tz
+	bl := BT_Teleport
+	if !teleport {
+		bl = cp.GetBlock_WLc(dx, dy, dz)
+	}
+	if bl == BT_Air {
+		return // Nothing to remove
+	}
+	if !up.mayRemove_Bl(cp, bl) {
+		return
+	}
+
+	if teleport {
 		superChunkManager.RemoveTeleport(&cc)
 		f := func(up *user) {
 			up.SuperChunkAnswer_Bl(&cc)
@@ -449,10 +460,14 @@ func (up *user) HitBlock_WLwWLcRLq(cc chunkdb.CC, dx, dy, dz uint8) {
 		return
 	}
 
-	if !cp.UpdateBlock_WLcWLw(dx, dy, dz, BT_Air) {
+	old, ok := cp.ReplaceBlock_WLcWLw(dx, dy, dz, BT_Air)
+	if !ok {
 		return
 	}
 	up.BlockRem += 1
+	if code := blockTypes[old].drops; code != "" {
+		AddResourceToUser_WLuBl(up, code)
+	}
 	// fmt.Println("CmdHitBlock: ", hbc.index, "Chunk: ", hbc.cc, "Offset: ", hbc.dx, hbc.dy, hbc.dz)
 	// fmt.Println(ans)
 	// Find near players and tell them about the change.
@@ -481,7 +496,7 @@ func CommandVerifyChunkCS_WLwWLcBl(i int, b []byte) {
 		// Error here does not cause any problems, other than that the chunk is sent
 		vfysum, _, _ := ParseUint32(b[3:7])
 
-		if ch.checkSum != vfysum {
+		if _, sum := ch.ClientData_WLc(up); sum != vfysum {
 			//fmt.Printf("CommandVerifyChunkCS mismatch: %v player coord %v, checksum %v\n", i, up.Coord, ch.checkSum)
 			up.CmdReadChunk_WLwWLcBl(coord) // Use exisiting method to send chunk
 		} else {
@@ -543,12 +558,13 @@ func (up *user) CmdReadChunk_WLwWLcBl(cc chunkdb.CC) {
 	{
 		// 'b' is in a local block to make sure 'b' isn't accessed outside of read lock.
 		b := ChunkFind_WLwWLc(cc)
-		b.RLock()
 		// The compressed data is ok to save for access outside of lock, as it will not be updated by anyone else.
 		// It may be that a new compressed block is allocated, in which case the old one will be saved here.
-		ch = b.ch_comp
+		var sum uint32
+		ch, sum = b.ClientData_WLc(up)
+		b.RLock()
 		EncodeUint32(b.flag, ans[3:7])
-		EncodeUint32(b.checkSum, ans[7:11])
+		EncodeUint32(sum, ans[7:11])
 		EncodeUint32(b.owner, ans[11:15])
 		b.RUnlock() // Clear the lock before writing, which may possibly block for a while.
 	}
@@ -570,10 +586,7 @@ func (uc *user_coord) NearLadder_WLwWLc() bool {
 	east := DBGetBlockCached_WLwWLc(user_coord{uc.X + 1, uc.Y, uc.Z + 1})
 	south := DBGetBlockCached_WLwWLc(user_coord{uc.X, uc.Y - 1, uc.Z + 1})
 	north := DBGetBlockCached_WLwWLc(user_coord{uc.X, uc.Y + 1, uc.Z + 1})
-	if west == BT_Ladder || east == BT_Ladder || south == BT_Ladder || north == BT_Ladder {
-		return true
-	}
-	return false
+	return west.Climbable() || east.Climbable() || south.Climbable() || north.Climbable()
 }
 
 // To simplify, only one command type is used for moving, with an argument that describes
@@ -598,7 +611,7 @@ func (up *user) CmdPlayerMove_WLuWLqWLmWLwWLc(cmd int) {
 		if up.Climbing {
 			feet := up.Coord
 			feet.Z += PlayerHeight + 1
-			if blockIsPermeable[DBGetBlockCached_WLwWLc(feet)] {
+			if !DBGetBlockCached_WLwWLc(feet).Solid() {
 				up.Coord.Z += 1
 				checktrigger = true
 				bl = DBGetBlockCached_WLwWLc(up.Coord)
@@ -608,11 +621,11 @@ func (up *user) CmdPlayerMove_WLuWLqWLmWLwWLc(cmd int) {
 			head1.Z += PlayerHeight + 1
 			head2 := head1
 			head2.Z++
-			if blockIsPermeable[DBGetBlockCached_WLwWLc(head1)] && blockIsPermeable[DBGetBlockCached_WLwWLc(head2)] {
+			if !DBGetBlockCached_WLwWLc(head1).Solid() && !DBGetBlockCached_WLwWLc(head2).Solid() {
 				up.Coord.Z += 2
 			}
 			checktrigger = true
-		} else if !blockIsPermeable[DBGetBlockCached_WLwWLc(user_coord{up.Coord.X, up.Coord.Y, up.Coord.Z - 0.1})] {
+		} else if DBGetBlockCached_WLwWLc(user_coord{up.Coord.X, up.Coord.Y, up.Coord.Z - 0.1}).Solid() {
 			up.ZSpeed = PlayerJumpSpeed
 		}
 		up.Unlock()
@@ -677,7 +690,7 @@ func (coord *user_coord) swimming() bool {
 	// Find out if main body is in water, in which case we consider the player swimming
 	bodyPos := user_coord{coord.X, coord.Y, coord.Z + SWIMMINGHEIGHT}
 	bodyBlock := DBGetBlockCached_WLwWLc(bodyPos)
-	return bodyBlock == BT_Water || bodyBlock == BT_BrownWater
+	return bodyBlock.Liquid()
 }
 
 var delayMovementScoreUpdate uint16
@@ -711,7 +724,7 @@ func (up *user) cmdUpdatePosition2_WLwWLc() (bool, block, bool) {
 	var sv, cv float64 = 0, 1 // Sin and Cos for the vertical angle
 	if !noGravity {
 		// Apply gravity
-		newSpeed := UpdateZPos_WLwWLc(deltaTime, up.ZSpeed, &up.Coord)
+		newSpeed := UpdateZPos_WLwWLc(deltaTime, up.ZSpeed, &up.Coord, playerBody)
 		if up.ZSpeed < -1.0 && newSpeed == 0 {
 			// Tell client that the player hit the ground with some speed (corresponding to falling two blocks)
 			up.flags |= client_prot.UserFlagJump
@@ -764,64 +777,42 @@ func (up *user) cmdUpdatePosition2_WLwWLc() (bool, block, bool) {
 	y2 := x*s + y*c
 	z2 := z
 	// log.Printf("Player moved from %d,%d to ", up.Coord.X, up.Coord.Y)
-	var newCoord user_coord = user_coord{up.Coord.X + x2, up.Coord.Y + y2, up.Coord.Z + z2}
-	bl := DBGetBlockCached_WLwWLc(newCoord)
-	if blockIsPermeable[bl] || (up.AdminLevel == 10 && up.Flying) {
-		// There was room for the feet, at least. Now check up to head height
+	var newCoord user_coord
+	if up.AdminLevel == 10 && up.Flying {
 		// A flying admin will always succeed, which will allow him to fly through ground.
-		delta := newCoord
-		for off := 1.0; off < PlayerHeight; off += 1.0 {
-			delta.Z += 1.0
-			if !blockIsPermeable[DBGetBlockCached_WLwWLc(delta)] && !(up.AdminLevel == 10 && up.Flying) {
-				// Sorry, hitting a roof here.
-				return false, 0, swimming
-			}
-		}
-
-		if swimming && !newCoord.swimming() {
-			// Check if the player was swimming upwards, and is now just above the water level
-			belowFeet := newCoord
-			belowFeet.Z--
-			bl := DBGetBlockCached_WLwWLc(belowFeet)
-			if bl == BT_Water || bl == BT_BrownWater {
-				// Player is still swimming, but got a little too high. Round it downwards, with a little
-				// delta to make sure the player stays in the water.
-				newCoord.Z = math.Floor(newCoord.Z+SWIMMINGHEIGHT) - SWIMMINGHEIGHT - 0.1
-			}
-		}
-		// The move has now been approved.
-		up.Coord = newCoord
-
-		// Update the score of this place, but not every time (to save some performance)
-		const DelayMovementReportFactor = 10
-		if delayMovementScoreUpdate++; delayMovementScoreUpdate == DelayMovementReportFactor {
-			delayMovementScoreUpdate = 0
-			cp := ChunkFindCached_WLwWLc(newCoord.GetChunkCoord())
-			owner := cp.owner
-			if owner != up.Id && !up.Dead && owner != OWNER_NONE && owner != OWNER_RESERVED && owner != OWNER_TEST && up.Id < math.MaxUint32/2 {
-				up.AddScore(owner, CnfgScoreMoveFact*DelayMovementReportFactor*dist)
-			}
+		newCoord = user_coord{up.Coord.X + x2, up.Coord.Y + y2, up.Coord.Z + z2}
+	} else {
+		newCoord, _ = playerBody.Move_WLwWLc(up.Coord, x2, y2, z2, true)
+	}
+	if newCoord == up.Coord {
+		// Stopped by a wall, or hitting a roof
+		return false, 0, swimming
+	}
+	if swimming && !newCoord.swimming() {
+		// Check if the player was swimming upwards, and is now just above the water level
+		belowFeet := newCoord
+		belowFeet.Z--
+		bl := DBGetBlockCached_WLwWLc(belowFeet)
+		if bl.Liquid() {
+			// Player is still swimming, but got a little too high. Round it downwards, with a little
+			// delta to make sure the player stays in the water.
+			newCoord.Z = math.Floor(newCoord.Z+SWIMMINGHEIGHT) - SWIMMINGHEIGHT - 0.1
 		}
-		return true, bl, swimming
-	}
-
-	// There is some obstacle. Allow the movement if it is one block of height difference.
-	oneStepUp := user_coord{newCoord.X, newCoord.Y, newCoord.Z + 1}
-	bl = DBGetBlockCached_WLwWLc(oneStepUp)
-	if blockIsPermeable[bl] {
-		// There was room for the feet, at least. Now check up to head height
-		delta := oneStepUp
-		for off := 1.0; off < PlayerHeight; off += 1.0 {
-			delta.Z += 1.0
-			if !blockIsPermeable[DBGetBlockCached_WLwWLc(delta)] {
-				// Sorry, hitting a roof here.
-				return false, 0, swimming
-			}
+	}
+	// The move has now been approved.
+	up.Coord = newCoord
+
+	// Update the score of this place, but not every time (to save some performance)
+	const DelayMovementReportFactor = 10
+	if delayMovementScoreUpdate++; delayMovementScoreUpdate == DelayMovementReportFactor {
+		delayMovementScoreUpdate = 0
+		cp := ChunkFindCached_WLwWLc(newCoord.GetChunkCoord())
+		owner := cp.owner
+		if owner != up.Id && !up.Dead && owner != OWNER_NONE && owner != OWNER_RESERVED && owner != OWNER_TEST && up.Id < math.MaxUint32/2 {
+			up.AddScore(owner, CnfgScoreMoveFact*DelayMovementReportFactor*dist)
 		}
-		up.Coord = oneStepUp
-		return true, bl, swimming
 	}
-	return false, 0, swimming
+	return true, DBGetBlockCached_WLwWLc(newCoord), swimming
 }
 
 // Restore mana. Return true if any restore was needed.
@@ -1108,6 +1099,7 @@ func (up *user) AddExperience(e float32) {
 	if up.Exp > 1 {
 		up.Level += 1
 		up.Exp -= 1
+		up.Journal("level up")
 	}
 	up.updatedStats = true
 }
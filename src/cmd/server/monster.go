@@ -499,8 +499,7 @@ func addMonsterToPlayer_WLwWLuWLqWLmWLc(up *user) {
 	found := false
 	var dz float64
 	for dz = -MaxMonsterSpawnHeightDiff; dz < MaxMonsterSpawnHeightDiff; dz++ {
-		// TODO: Not all monsters are 3 blocks high.
-		if ValidSpawnPoint_WLwWLc(user_coord{coord.X, coord.Y, coord.Z + dz}, 3) {
+		if ValidSpawnPoint_WLwWLc(user_coord{coord.X, coord.Y, coord.Z + dz}, monsterBody) {
 			coord.Z += dz
 			found = true
 		}
@@ -514,9 +513,14 @@ func addMonsterToPlayer_WLwWLuWLqWLmWLc(up *user) {
 	// Owner OWNER_NONE is the "world" and owner OWNER_RESERVED is the starting area
 	cc := coord.GetChunkCoord()
 	cp := ChunkFind_WLwWLc(cc)
-	if (cp.owner == OWNER_NONE) || (cp.owner == OWNER_RESERVED) || (cp.owner == OWNER_TEST) {
-		addMonsterToPlayerAtPos_WLuWLqWLm(up, &coord, 0)
+	if (cp.owner != OWNER_NONE) && (cp.owner != OWNER_RESERVED) && (cp.owner != OWNER_TEST) {
+		return
+	}
+	// Monsters spawn more often in the dark, and not at all in well lit places.
+	if rand.Float64() >= monsterSpawnProbability(LightLevel_RLwWLc(coord.blockCoord())) {
+		return
 	}
+	addMonsterToPlayerAtPos_WLuWLqWLm(up, &coord, 0)
 }
 
 // This is the second part, where a monster is added to a player.
@@ -655,31 +659,20 @@ func UpdateAllMonsterPos_RLmWLwWLqWLuWLc(fullReport bool) {
 
 // Move the monster, if it wants to.
 func (mp *monster) Move_WLwWLc(deltaTime time.Duration) {
-	mp.ZSpeed = UpdateZPos_WLwWLc(deltaTime, mp.ZSpeed, &mp.Coord)
+	mp.ZSpeed = UpdateZPos_WLwWLc(deltaTime, mp.ZSpeed, &mp.Coord, monsterBody)
 	// fmt.Println("New monster falling speed ", mp.ZSpeed, " at pos ", mp.Coord.Z)
 	if !mp.mvFwd {
 		return // Monsters aren't strafing, only moving in the direction they are looking
 	}
-	coord := mp.Coord
 	s, c := math.Sincos(float64(mp.dirHor))
 	dist := float64(mp.speed) * float64(deltaTime) / 1e9
 	// fmt.Println("Monster move ", dist)
-	dx := s * dist
-	dy := c * dist
-	coord.X += dx
-	coord.Y += dy
-	if blockIsPermeable[DBGetBlock_WLwWLc(coord)] {
-		// TODO: Should check up to monster height
+	coord, stopped := monsterBody.Move_WLwWLc(mp.Coord, s*dist, c*dist, 0, true)
+	if coord != mp.Coord {
 		mp.Coord = coord
 		mp.updatedStats = true
-		return
 	}
-
-	// There is some obstacle. Allow the movement if it is one block of height difference.
-	coord.Z += 1
-	if blockIsPermeable[DBGetBlock_WLwWLc(coord)] {
-		mp.Coord = coord
-		mp.updatedStats = true
+	if !stopped {
 		return
 	}
 
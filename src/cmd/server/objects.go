@@ -56,6 +56,14 @@ const (
 	ItemHelmet3ID                 = "HLM3"
 	ItemHelmet4ID                 = "HLM4"
 	ItemScrollRessID              = "S001" // A resurrection scroll
+	ItemStoneID                   = "RES0" // Resources, from digging
+	ItemSoilID                    = "RES1"
+	ItemSandID                    = "RES2"
+	ItemGravelID                  = "RES3"
+	ItemWoodID                    = "RES4"
+	ItemCoalID                    = "ORE1" // Ores, from digging
+	ItemIronOreID                 = "ORE2"
+	ItemGoldOreID                 = "ORE3"
 )
 
 var (
@@ -79,6 +87,14 @@ var (
 		"HLM3":             UseHelmet_Wlu,
 		"HLM4":             UseHelmet_Wlu,
 		"S001":             UseScroll_Wlu, // A resurrection scroll
+		"RES0":             UseResource_Wlu,
+		"RES1":             UseResource_Wlu,
+		"RES2":             UseResource_Wlu,
+		"RES3":             UseResource_Wlu,
+		"RES4":             UseResource_Wlu,
+		"ORE1":             UseResource_Wlu,
+		"ORE2":             UseResource_Wlu,
+		"ORE3":             UseResource_Wlu,
 	}
 )
 
@@ -141,6 +157,11 @@ func (inv *PlayerInv) Use_WluBl(up *user, t ObjectCode, lvl uint32) {
 	}
 	f := objectUseTable[t]
 	consumed, broadcast := f(up, t, lvl)
+	if consumed || broadcast {
+		up.RLock()
+		up.Journal("use " + string(t))
+		up.RUnlock()
+	}
 	if broadcast {
 		ReportEquipmentToNear_Bl(up)
 	}
@@ -194,6 +215,11 @@ func ConvertHelmetTypeToID(helmetgrade uint8) ObjectCode {
 	return ObjectCode(code)
 }
 
+// Resources can't be used directly, they are only collected.
+func UseResource_Wlu(up *user, t ObjectCode, lvl uint32) (bool, bool) {
+	return false, false
+}
+
 // Use a item of type 't' and level 'lvl'. The type can be counted on being 4 characters.
 // Return first flag for being consumed, and teh second to broadcast the action to other players
 func UsePotion_Wlu(up *user, t ObjectCode, lvl uint32) (consumed, broadcast bool) {
@@ -0,0 +1,108 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Ore deposits. The resources a player gets from digging are declared in blockTypes.
+//
+// The world is divided into cells. Every cell can be the start of a vein of ore, with a probability
+// that depends on the depth of the cell and the type of ore. A vein is a random walk from a random
+// position in the cell, replacing stone. The veins are shorter than a cell, so only the neighbor cells
+// have to be tested to find all veins that reach into a chunk. As the veins only depend on the cell
+// coordinates and the seed, they are seamless over chunk borders.
+//
+
+import (
+	"chunkdb"
+	"math"
+)
+
+const oreCellSize = 8 // Must be a divisor of CHUNK_SIZE
+
+type oreType struct {
+	bl                block
+	top, peak, bottom float64 // The probability increases from 0 at 'top' to 'prob' at 'peak', and is 0 again at 'bottom'
+	prob              float64 // The probability of a vein in a cell, at the peak
+	length            int     // Max number of blocks in a vein. Must be less than oreCellSize.
+}
+
+var oreTypes = []oreType{
+	{bl: BT_Coal, top: 40, peak: 0, bottom: -80, prob: 0.25, length: 7},
+	{bl: BT_IronOre, top: 0, peak: -40, bottom: -160, prob: 0.15, length: 6},
+	{bl: BT_GoldOre, top: -40, peak: -120, bottom: math.Inf(-1), prob: 0.06, length: 4},
+}
+
+// The probability of a vein of ore 'o' in a cell at height 'zf'.
+func (o *oreType) rate(zf float64) float64 {
+	switch {
+	case zf >= o.top || zf <= o.bottom:
+		return 0
+	case zf >= o.peak:
+		return o.prob * (o.top - zf) / (o.top - o.peak)
+	case math.IsInf(o.bottom, -1):
+		return o.prob
+	}
+	return o.prob * (zf - o.bottom) / (o.peak - o.bottom)
+}
+
+// Replace stone in 'rc' with the veins of ore that reach into chunk 'cc'.
+func addOres(seed int64, cc chunkdb.CC, rc *raw_chunk) {
+	const cells = CHUNK_SIZE / oreCellSize
+	x0, y0, z0 := int64(cc.X)*CHUNK_SIZE, int64(cc.Y)*CHUNK_SIZE, int64(cc.Z)*CHUNK_SIZE
+	// Include one cell outside of the chunk in all directions, as veins can cross cell borders.
+	for cx := x0/oreCellSize - 1; cx <= x0/oreCellSize+cells; cx++ {
+		for cy := y0/oreCellSize - 1; cy <= y0/oreCellSize+cells; cy++ {
+			for cz := z0/oreCellSize - 1; cz <= z0/oreCellSize+cells; cz++ {
+				zf := float64(cz*oreCellSize + oreCellSize/2)
+				// Use the cell height to get a different random sequence for every cell.
+				r := newStructRand(seed^int64(uint64(cz)*0xD6E8FEB86659FD93), cx, cy)
+				for i := range oreTypes {
+					o := &oreTypes[i]
+					if r.float() >= o.rate(zf) {
+						continue
+					}
+					x := cx*oreCellSize + int64(r.intn(oreCellSize))
+					y := cy*oreCellSize + int64(r.intn(oreCellSize))
+					z := cz*oreCellSize + int64(r.intn(oreCellSize))
+					for n := 2 + r.intn(o.length-1); n > 0; n-- {
+						if x >= x0 && x < x0+CHUNK_SIZE && y >= y0 && y < y0+CHUNK_SIZE && z >= z0 && z < z0+CHUNK_SIZE {
+							if p := &rc[x-x0][y-y0][z-z0]; *p == BT_Stone {
+								*p = o.bl
+							}
+						}
+						// Step in a random direction.
+						switch r.intn(6) {
+						case 0:
+							x++
+						case 1:
+							x--
+						case 2:
+							y++
+						case 3:
+							y--
+						case 4:
+							z++
+						default:
+							z--
+						}
+					}
+				}
+			}
+		}
+	}
+}
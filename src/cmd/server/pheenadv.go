@@ -47,12 +47,19 @@ var (
 	allowTestUser       = flag.Bool("testuser", false, "Allow connection of testusers without password named 'testX', where X is a number")
 	verboseFlag         = flag.Int("v", 0, "Verbose, Higher number gives more")
 	cpuprofile          = flag.String("cpuprofile", "", "write cpu profile to file")
-	convertChunkFiles   = flag.Bool("convertChunk", false, "Convert chunk files to new file format")
+	convertChunkFiles   = flag.Bool("convertChunk", false, "Convert chunk files to the current file format, and remove unmodified chunks")
 	welcomeMsgFile      = flag.String("welcome", "welcome.txt", "The file that is displayed at login")
 	logOnStdout         = flag.Bool("s", false, "Send log file to standard otput")
 	inhibitCreateChunks = flag.Bool("nocreate", false, "Only load modified chunks, and save no changes")
 	configFileName      = flag.String("configfile", "config.ini", "General configuration file")
 	createuser          = flag.String("createuser", "", "Create user from argument 'email,password,avatar'")
+	snapshotFlag        = flag.Bool("snapshot", false, "Take a snapshot of the world, and then terminate")
+	exportFlag          = flag.String("export", "", "Export the chunks 'x1,y1,z1:x2,y2,z2' to the schematic file, and then terminate")
+	exportBlocks        = flag.Bool("exportblocks", false, "The -export coordinates are block coordinates instead of chunk coordinates")
+	importFlag          = flag.String("import", "", "Import the schematic file at chunk 'x,y,z', and then terminate")
+	schematicFile       = flag.String("schematic", "region.schematic", "The schematic file used by -export and -import")
+	pregenFlag          = flag.String("pregen", "", "Generate and save all chunks 'x1,y1,z1:x2,y2,z2' (chunk coordinates) that don't exist, and then terminate")
+	goldensFlag         = flag.String("goldens", "", "Generate the terrain golden values again, save them as Go source in the file, and then terminate")
 	bootDate            = time.Now()
 
 	trafficStatistics = traffic.New()
@@ -88,6 +95,12 @@ func main() {
 		if err != nil {
 			log.Println("main: open DB:", err)
 			// Continue without DB. Only test users can connect.
+		} else if old, err := ephenationdb.CheckSchemaVersion(ephenationdb.New()); err != nil {
+			log.Println("main: database schema:", err)
+			fmt.Println("Database schema:", err, "- a newer server is needed")
+			os.Exit(1)
+		} else if old > 0 {
+			log.Printf("main: %d avatars need migration to schema version %d, use 'database -migrate'. They can't log in until then.\n", old, ephenationdb.SchemaVersion)
 		}
 	} else {
 		log.Println("Config file", *configFileName, "missing section", configSection)
@@ -95,6 +108,7 @@ func main() {
 	if encryptionSalt, err = cnfg.String("login", "salt"); err != nil {
 		encryptionSalt = "" // Effectively no salt
 	}
+	LoadWorldConfig(cnfg)
 
 	if *createuser != "" {
 		CreateUser(*createuser)
@@ -105,6 +119,35 @@ func main() {
 		ConvertFiles()
 		return
 	}
+	if *snapshotFlag {
+		fn, err := TakeSnapshot()
+		if err != nil {
+			fmt.Println("Snapshot failed:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Snapshot saved in", fn)
+		return
+	}
+	if *exportFlag != "" || *importFlag != "" {
+		if !RegionCommandLine(*exportFlag, *importFlag, *schematicFile, *exportBlocks) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *pregenFlag != "" {
+		if !PregenCommandLine(*pregenFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *goldensFlag != "" {
+		if err := WriteTerrainGoldens(*goldensFlag); err != nil {
+			fmt.Println("Terrain goldens failed:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Terrain goldens saved in", *goldensFlag)
+		return
+	}
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -124,6 +167,7 @@ func main() {
 	if *inhibitCreateChunks {
 		log.Println("No chunks will be created or saved")
 	}
+	log.Printf("World generator %s, seed %d\n", worldGenName, worldParams.Seed)
 	runtime.GOMAXPROCS(*procFlag)
 	rand.Seed(time.Now().UnixNano())
 	host, err := os.Hostname()
@@ -140,13 +184,96 @@ func main() {
 		os.Exit(1)
 	}
 	go ProcAutosave_RLu()
+	go ProcJournal()
 	go ProcPurgeOldChunks_WLw()
+	if prefetchBudget > 0 {
+		go ProcPrefetchChunks_RLaRLuWLwWLc()
+	}
+	go ProcSaveDirtyChunks()
+	go ProcLiquids_RLwWLcRLq()
+	go ProcRandomTicks_RLwWLcRLq()
 	go CatchSig()
 	ManageMonsters_WLwWLuWLqWLmBlWLc() // Will not return
 }
 
-// Read all chunks, update them, and write them back again
-// This function can also be used for convert from one chunk file format to another, with some tweaking.
+// Load the optional parameters from the "world" section of the config file.
+// Parameters that are not defined keep their default values.
+func LoadWorldConfig(cnfg *config.Config) {
+	const section = "world"
+	if !cnfg.HasSection(section) {
+		return
+	}
+	if sec, err := cnfg.Float(section, "chunksaveperiod"); err == nil && sec > 0 {
+		chunkSavePeriod = time.Duration(sec * float64(time.Second))
+	}
+	if n, err := cnfg.Int(section, "chunkhistory"); err == nil && n >= 0 {
+		chunkHistorySize = n
+	}
+	if sec, err := cnfg.Float(section, "chunkhistoryinterval"); err == nil && sec >= 0 {
+		chunkHistoryInterval = time.Duration(sec * float64(time.Second))
+	}
+	if mb, err := cnfg.Int(section, "cachememory"); err == nil && mb > 0 {
+		worldCacheBudget = int64(mb) * 1e6
+	}
+	if n, err := cnfg.Int(section, "chunkloaders"); err == nil && n > 0 {
+		chunkLoaders = make(chan struct{}, n)
+	}
+	if n, err := cnfg.Int(section, "prefetchbudget"); err == nil && n >= 0 {
+		prefetchBudget = n
+	}
+	if n, err := cnfg.Int(section, "randomticks"); err == nil && n >= 0 {
+		tickRates.Ticks = n
+	}
+	if n, err := cnfg.Int(section, "maxplants"); err == nil && n >= 0 {
+		tickRates.MaxPlants = n
+	}
+	for key, rate := range map[string]*float64{"plantgrowth": &tickRates.Plants, "treegrowth": &tickRates.Trees, "snowfall": &tickRates.Snow, "plantdecay": &tickRates.Decay} {
+		if f, err := cnfg.Float(section, key); err == nil && f >= 0 && f <= 1 {
+			*rate = f
+		}
+	}
+	if n, err := cnfg.Int(section, "skylight"); err == nil && n >= 0 && n <= maxLight {
+		skyLight = uint8(n)
+	}
+	if n, err := cnfg.Int(section, "monstermaxlight"); err == nil && n >= 0 && n <= maxLight+1 {
+		monsterMaxLight = uint8(n)
+	}
+	if f, err := cnfg.Float(section, "playerwidth"); err == nil && f > 0 && f < 1 {
+		playerBody.width = f
+	}
+	params := worldParams
+	if seed, err := cnfg.Int(section, "seed"); err == nil {
+		params.Seed = int64(seed)
+	}
+	if f, err := cnfg.Float(section, "soillevel"); err == nil {
+		params.SoilLevel = f
+	}
+	if f, err := cnfg.Float(section, "floatingislands"); err == nil {
+		params.FloatingIslandsLim = f
+	}
+	if f, err := cnfg.Float(section, "floatingislandsprob"); err == nil && f > 0 && f < 1 {
+		params.FloatingIslandsProb = f
+	}
+	if f, err := cnfg.Float(section, "cavewidth"); err == nil && f >= 0 {
+		params.CaveWidth = f
+	}
+	if b, err := cnfg.Bool(section, "structures"); err == nil {
+		params.Structures = b
+	}
+	if b, err := cnfg.Bool(section, "ores"); err == nil {
+		params.Ores = b
+	}
+	name, err := cnfg.String(section, "generator")
+	if err != nil {
+		name = worldGenName
+	}
+	if !SetWorldGenerator(name, params) {
+		log.Println("Unknown world generator", name, "should be one of", WorldGeneratorNames())
+	}
+}
+
+// Read all chunks, update them, and write them back again.
+// Unmodified chunks are removed, and modified chunks are saved using the current file format version.
 func ConvertFiles() {
 	dir, err := ioutil.ReadDir(CnfgChunkFolder)
 	if err != nil {
@@ -179,8 +306,15 @@ func ConvertFiles() {
 		}
 		c := chunkdb.CC{X: int32(x), Y: int32(y), Z: int32(z)}
 		ch := dBFindChunkFromFS(c)
+		if ch.unreadable {
+			fmt.Printf("Chunk %v could not be read, kept as it is\n", fn)
+			continue
+		}
 		if ch.flag&CHF_MODIFIED != 0 {
 			mod++
+			if _, ok := ch.writeFile(); !ok {
+				fmt.Printf("Failed to save %v in new format\n", fn)
+			}
 		} else {
 			unmod++
 			name := DBChunkFileName(c)
@@ -190,7 +324,7 @@ func ConvertFiles() {
 			}
 		}
 	}
-	fmt.Printf("%d Modified, %d non modified\n", mod, unmod)
+	fmt.Printf("%d Modified (saved as version %d), %d non modified\n", mod, CHUNK_FILE_VERSION, unmod)
 }
 
 // Helper function to create a user (license) and an avatar for that user
@@ -218,6 +352,7 @@ func CreateUser(str string) {
 		return
 	}
 	up.Id = id.C
+	up.SchemaVersion = ephenationdb.SchemaVersion
 	db := ephenationdb.New()
 	err = db.C("avatars").Insert(&up)
 	if err != nil {
@@ -70,6 +70,7 @@ type player struct {
 	Keys        keys.KeyRing // The list of keys that the player has
 	Lastseen    time.Time    // When player weas last seen in the game
 	Inventory   PlayerInv
+	JournalSeq  uint64 // The sequence number of the last journal entry, see journal.go
 }
 
 func (up *user) String() string {
@@ -89,22 +90,19 @@ func (up *user) Load_WLwBlWLc(email string) bool {
 		log.Println("Avatar for", email, err)
 		return false
 	}
+	// Missing values are initialized by the database migrations.
+	if up.SchemaVersion != ephenationdb.SchemaVersion {
+		log.Printf("Avatar for %s has schema version %d, not %d. Use 'database -migrate'\n", email, up.SchemaVersion, ephenationdb.SchemaVersion)
+		return false
+	}
 
-	// Some post processing
-
-	if up.Maxchunks == 0 {
-		// This parameter was not initialized.
-		up.Maxchunks = CnfgMaxOwnChunk
+	// Important changes since the last save are in the journal. Save as soon as the player is in.
+	if up.ReplayJournal() > 0 {
+		up.forceSave = true
 	}
 
 	up.logonTimer = time.Now()
 
-	if up.ReviveSP.X == 0 && up.ReviveSP.Y == 0 && up.ReviveSP.Z == 0 {
-		// Check if there is any spawn point defined.
-		up.ReviveSP = up.Coord
-		up.HomeSP = up.Coord
-	}
-
 	score.Initialize(up.Id)
 	return true
 }
@@ -122,6 +120,7 @@ func (up *user) Save_Bl() bool {
 	up.Lastseen = start                                             // Update last seen online
 	up.TimeOnline += uint32(start.Sub(up.logonTimer) / time.Second) // Update total time online, in seconds
 	up.logonTimer = start
+	journalStartCommit(up.Id)
 	db := ephenationdb.New()
 	err := db.C("avatars").UpdateId(up.Id, bson.M{"$set": &up.player}) // Only update the fields found in 'pl'.
 
@@ -130,6 +129,7 @@ func (up *user) Save_Bl() bool {
 		log.Printf("%#v\n", up)
 		return false
 	}
+	journalEndCommit(up.Id)
 
 	if *verboseFlag > 1 {
 		log.Printf("up.Save_Bl saved %v\n", up.Name)
@@ -165,10 +165,10 @@ func (up *user) New_WLwWLc(name string) {
 		// fmt.Printf("Test prefix, substr: %v, x,y : (%d,%d)\n", name[len(TestPlayerNamePrefix):], x, y)
 	}
 
-	coord := user_coord{x, y, FLOATING_ISLANDS_LIM - 1} // Try this
+	coord := user_coord{x, y, worldParams.FloatingIslandsLim - 1} // Try this
 
 	for ; coord.Z >= 0; coord.Z -= 1 {
-		if !blockIsPermeable[DBGetBlockCached_WLwWLc(coord)] {
+		if DBGetBlockCached_WLwWLc(coord).Solid() {
 			break
 		}
 	}
@@ -0,0 +1,154 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Chunks are loaded into the cache before players need them. The movement of every player
+// is used to predict where the player will be a few seconds later, and the chunks near that
+// position that are not near the current position are loaded. Only a limited number of chunks
+// are loaded every period, and only one at a time, so there are always loaders available for
+// chunks that are requested by the clients.
+//
+
+import (
+	"chunkdb"
+	"sort"
+	"sync/atomic"
+	"time"
+	"timerstats"
+)
+
+var (
+	prefetchBudget = CnfgPrefetchBudget // Max number of chunks to load every period. 0 to disable.
+
+	// Statistics, updated atomically
+	PrefetchStats struct {
+		Loaded     int64 // Number of chunks loaded in advance
+		OverBudget int64 // Number of chunks that would have been loaded, but the budget was used up
+	}
+)
+
+// A list of chunks, sorted on the distance to a chunk
+type ccDistList struct {
+	list   []chunkdb.CC
+	center chunkdb.CC
+}
+
+func ccDist2(a, b chunkdb.CC) int64 {
+	dx, dy, dz := int64(a.X-b.X), int64(a.Y-b.Y), int64(a.Z-b.Z)
+	return dx*dx + dy*dy + dz*dz
+}
+
+func (l *ccDistList) Len() int { return len(l.list) }
+func (l *ccDistList) Less(i, j int) bool {
+	return ccDist2(l.list[i], l.center) < ccDist2(l.list[j], l.center)
+}
+func (l *ccDistList) Swap(i, j int) { l.list[i], l.list[j] = l.list[j], l.list[i] }
+
+// Compute the chunks that a player will need soon. The player moved from 'prev' to 'pos' in 'elapsed'.
+// Return the chunks near the predicted position, that are not near the current position, the nearest first.
+func prefetchCandidates(prev, pos user_coord, elapsed time.Duration) []chunkdb.CC {
+	const maxDist = CnfgMaxChunkReqDist * CHUNK_SIZE // Further than this means a teleport
+	dx, dy, dz := pos.X-prev.X, pos.Y-prev.Y, pos.Z-prev.Z
+	if elapsed <= 0 || (dx == 0 && dy == 0 && dz == 0) || dx*dx+dy*dy+dz*dz > maxDist*maxDist {
+		return nil
+	}
+	f := float64(CnfgPrefetchAhead) / float64(elapsed)
+	predicted := user_coord{pos.X + dx*f, pos.Y + dy*f, pos.Z + dz*f}
+	current, center := pos.GetChunkCoord(), predicted.GetChunkCoord()
+	if current == center {
+		return nil
+	}
+	const d = CnfgMaxChunkReqDist
+	l := &ccDistList{center: center}
+	for x := center.X - d; x <= center.X+d; x++ {
+		for y := center.Y - d; y <= center.Y+d; y++ {
+			for z := center.Z - d; z <= center.Z+d; z++ {
+				cc := chunkdb.CC{X: x, Y: y, Z: z}
+				if ccDist2(cc, center) <= d*d && ccDist2(cc, current) > d*d {
+					l.list = append(l.list, cc)
+				}
+			}
+		}
+	}
+	sort.Sort(l)
+	return l.list
+}
+
+// Test if a chunk is in the cache, without loading it.
+func chunkInCache(cc chunkdb.CC) bool {
+	shard := cacheShardOf(cc)
+	shard.RLock()
+	_, ok := shard.chunks[cc]
+	shard.RUnlock()
+	return ok
+}
+
+// Periodically load chunks that players will need soon.
+func ProcPrefetchChunks_RLaRLuWLwWLc() {
+	var elapsed time.Duration
+	timerstats.Add("ProcPrefetchChunks", CnfgPrefetchPeriod, &elapsed)
+	prevPos := make(map[uint32]user_coord)
+	prevTime := time.Now()
+	first := 0 // Rotate the player that is served first, to share the budget
+	for {
+		time.Sleep(CnfgPrefetchPeriod)
+		start := time.Now()
+		period := start.Sub(prevTime)
+		prevTime = start
+
+		// Get the position of all players, without holding the lock while loading chunks
+		positions := make(map[uint32]user_coord)
+		var order []uint32
+		allPlayersSem.RLock()
+		for i := 0; i < MAX_PLAYERS; i++ {
+			up := allPlayers[(first+i)%MAX_PLAYERS]
+			if up == nil || up.connState != PlayerConnStateIn {
+				continue
+			}
+			up.RLock()
+			positions[up.Id] = up.Coord
+			up.RUnlock()
+			order = append(order, up.Id)
+		}
+		allPlayersSem.RUnlock()
+		first++
+
+		budget := prefetchBudget
+		for _, uid := range order {
+			prev, ok := prevPos[uid]
+			if !ok {
+				continue
+			}
+			for _, cc := range prefetchCandidates(prev, positions[uid], period) {
+				if chunkInCache(cc) {
+					continue
+				}
+				if budget <= 0 {
+					atomic.AddInt64(&PrefetchStats.OverBudget, 1)
+					continue
+				}
+				ChunkFind_WLwWLc(cc)
+				atomic.AddInt64(&PrefetchStats.Loaded, 1)
+				budget--
+			}
+		}
+		prevPos = positions
+		elapsed = time.Now().Sub(start)
+	}
+}
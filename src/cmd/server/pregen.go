@@ -0,0 +1,130 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Generate all chunks in a box in advance, while the server is stopped, so that players exploring
+// the world don't have to wait for new chunks. Chunks that already have a file are skipped. As
+// chunk files are written under a temporary name and then renamed, an interrupted run can simply be
+// started again, and it continues where it stopped.
+//
+
+import (
+	"chunkdb"
+	"fmt"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Statistics of a pre-generation.
+type pregenStats struct {
+	Total, Created, Skipped int64
+}
+
+// Generate and save all chunks in the box of chunk coordinates, using 'workers' processes. A progress
+// line is printed every 'interval', if it isn't 0.
+func PregenerateChunks(lo, hi chunkdb.CC, workers int, interval time.Duration) *pregenStats {
+	stats := &pregenStats{Total: int64(hi.X-lo.X+1) * int64(hi.Y-lo.Y+1) * int64(hi.Z-lo.Z+1)}
+	if workers < 1 {
+		workers = 1
+	}
+	// Z is iterated last, to make it likely that the base terrain of the neighbor chunks is still
+	// in the cache when decorating.
+	coords := make(chan chunkdb.CC, workers*2)
+	go func() {
+		for x := lo.X; x <= hi.X; x++ {
+			for y := lo.Y; y <= hi.Y; y++ {
+				for z := lo.Z; z <= hi.Z; z++ {
+					coords <- chunkdb.CC{X: x, Y: y, Z: z}
+				}
+			}
+		}
+		close(coords)
+	}()
+
+	done := make(chan bool)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for cc := range coords {
+				if _, err := os.Stat(DBChunkFileName(cc)); err == nil {
+					atomic.AddInt64(&stats.Skipped, 1)
+					continue
+				}
+				dBCreateAndSaveChunk(cc)
+				atomic.AddInt64(&stats.Created, 1)
+			}
+			done <- true
+		}()
+	}
+
+	start := time.Now()
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for running := workers; running > 0; {
+		select {
+		case <-done:
+			running--
+		case <-tick:
+			stats.report(time.Since(start))
+		}
+	}
+	return stats
+}
+
+// Print the progress, and an estimate of the remaining time.
+func (stats *pregenStats) report(elapsed time.Duration) {
+	created, skipped := atomic.LoadInt64(&stats.Created), atomic.LoadInt64(&stats.Skipped)
+	done := created + skipped
+	fmt.Printf("%d of %d chunks (%.1f%%), %d created, %d existed", done, stats.Total, float64(done)*100/float64(stats.Total), created, skipped)
+	if created > 0 && done < stats.Total {
+		perChunk := elapsed / time.Duration(created)
+		remaining := perChunk * time.Duration(stats.Total-done)
+		fmt.Printf(", %v remaining", remaining-remaining%time.Second)
+	}
+	fmt.Println()
+}
+
+// Handle the command line option "-pregen x1,y1,z1:x2,y2,z2". Return false if it failed.
+func PregenCommandLine(box string) bool {
+	if *inhibitCreateChunks {
+		fmt.Println("Chunks can't be pre-generated when chunks are not saved (-nocreate)")
+		return false
+	}
+	lo, hi, err := parseBox(box)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	workers := runtime.NumCPU()
+	runtime.GOMAXPROCS(workers)
+	ccLo := chunkdb.CC{X: int32(lo.X), Y: int32(lo.Y), Z: int32(lo.Z)}
+	ccHi := chunkdb.CC{X: int32(hi.X), Y: int32(hi.Y), Z: int32(hi.Z)}
+	fmt.Printf("Generating chunks %v to %v with world generator %s, seed %d, using %d processes\n", ccLo, ccHi, worldGenName, worldParams.Seed, workers)
+	start := time.Now()
+	stats := PregenerateChunks(ccLo, ccHi, workers, 10*time.Second)
+	elapsed := time.Since(start)
+	stats.report(elapsed)
+	fmt.Printf("Done in %v\n", elapsed-elapsed%time.Millisecond)
+	return true
+}
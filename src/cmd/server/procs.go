@@ -49,30 +49,6 @@ func CatchSig() {
 	}
 }
 
-func ProcPurgeOldChunks_WLw() {
-	for i := 0; ; i++ {
-		if i == WORLD_CACHE_SIZE {
-			i = 0
-		}
-		worldCacheLock.Lock()
-		for pc := world_cache[i]; pc != nil; {
-			next := pc.next // Save the next pointer now, as the current 'pc' may get released
-			if !pc.touched {
-				// No one used this chunk since last checked, so it is released
-				RemoveChunkFromHashTable(pc)
-				// fmt.Printf("ProcPurgeOldChunks: free %v\n", pc.Coord)
-			} else {
-				// The chunk was touched. Give it another chance.
-				pc.touched = false
-				// fmt.Printf("ProcPurgeOldChunks: keep %v\n", pc.Coord)
-			}
-			pc = next
-		}
-		worldCacheLock.Unlock()
-		time.Sleep(1e8)
-	}
-}
-
 func ProcUpdateMonsterState() {
 	var elapsed time.Duration
 	timerstats.Add("ProcUpdateMonsterState", MonstersUpdateDirPeriod, &elapsed)
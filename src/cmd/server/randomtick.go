@@ -0,0 +1,187 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Random ticks make the world change slowly by itself. Every period, a few random blocks in every
+// chunk in use are updated, and may change depending on their type and the blocks around them:
+//  * Soil with air above grows tufts and flowers.
+//  * Soil with air above, higher up than the snow line, is covered by snow.
+//  * Bushes grow into trees, and trees into big trees, when there is soil below and air above.
+//  * Tufts and flowers wither when there is no soil below them.
+// Soil with air above is shown as topsoil by the client, BT_Topsoil is never stored in a chunk.
+//
+// Soil doesn't grow new plants when there are already many plants near.
+//
+// Chunks that only keep the compressed copy in the cache haven't been used for a while, and are not
+// updated. Owners can stop the changes in their territory with "/territory growth off". The changes
+// are only saved in chunks that have an owner. Elsewhere, they are lost when the chunk is thrown away
+// from the cache, so that the wilderness doesn't fill the disk with chunk files.
+//
+
+import (
+	"chunkdb"
+	"math/rand"
+	"time"
+	"timerstats"
+)
+
+var tickRates = struct {
+	Ticks                      int     // Number of random blocks updated in every chunk, every period. 0 to disable.
+	Plants, Trees, Snow, Decay float64 // The probability that an updated block changes, for every kind of change
+	SnowLine                   int64
+	MaxPlants                  int // Soil doesn't grow a plant if there are this many plants near
+}{CnfgRandomTicks, CnfgPlantGrowth, CnfgTreeGrowth, CnfgSnowfall, CnfgPlantDecay, CnfgSnowLine, CnfgMaxPlants}
+
+const plantArea = 2 // The distance, in blocks, where plants are counted
+
+// Count the plants at the same height as 'bc', in a square around it. Only loaded chunks are used.
+func plantsNear_RLwWLc(bc blockCoord) int {
+	var n int
+	for x := bc.X - plantArea; x <= bc.X+plantArea; x++ {
+		for y := bc.Y - plantArea; y <= bc.Y+plantArea; y++ {
+			if bl, _ := GetLoadedBlock_RLwWLc(blockCoord{x, y, bc.Z}); bl == BT_Tuft || bl == BT_Flowers {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Find the change of block 'bl' at 'bc', if any, when it is updated. The changed block is not
+// always the updated block. Neighbor blocks in chunks that are not loaded are not used.
+func tickBlock_RLwWLc(bc blockCoord, bl block, r *rand.Rand) (target blockCoord, old, bl2 block, ok bool) {
+	above := blockCoord{bc.X, bc.Y, bc.Z + 1}
+	below := blockCoord{bc.X, bc.Y, bc.Z - 1}
+	is := func(bc blockCoord, bl block) bool {
+		b, cp := GetLoadedBlock_RLwWLc(bc)
+		return cp != nil && b == bl
+	}
+	switch bl {
+	case BT_Soil:
+		switch {
+		case bc.Z > tickRates.SnowLine:
+			if r.Float64() < tickRates.Snow && is(above, BT_Air) {
+				return bc, bl, BT_Snow, true
+			}
+		case r.Float64() < tickRates.Plants && is(above, BT_Air) && plantsNear_RLwWLc(above) < tickRates.MaxPlants:
+			if r.Intn(4) == 0 {
+				return above, BT_Air, BT_Flowers, true
+			}
+			return above, BT_Air, BT_Tuft, true
+		}
+	case BT_Tree1, BT_Tree2:
+		if r.Float64() < tickRates.Trees && is(below, BT_Soil) && is(above, BT_Air) {
+			return bc, bl, bl + 1, true // The trees have consecutive block types
+		}
+	case BT_Tuft, BT_Flowers:
+		if b, cp := GetLoadedBlock_RLwWLc(below); r.Float64() < tickRates.Decay && cp != nil && b != BT_Soil {
+			return bc, bl, BT_Air, true
+		}
+	}
+	return
+}
+
+// Update 'n' random blocks in the chunk. Return the number of changed blocks.
+func (cp *chunk) RandomTicks_RLwWLcRLq(n int, r *rand.Rand) int {
+	if cp.noGrowth_RLc() {
+		return 0
+	}
+	changes := make(map[chunkdb.CC][]blockChange)
+	for i := 0; i < n; i++ {
+		x, y, z := uint8(r.Intn(CHUNK_SIZE)), uint8(r.Intn(CHUNK_SIZE)), uint8(r.Intn(CHUNK_SIZE))
+		target, old, bl, ok := tickBlock_RLwWLc(blockCoordOf(cp.Coord, x, y, z), cp.GetBlock_WLc(x, y, z), r)
+		if ok {
+			cc, x, y, z := target.chunkOffset()
+			changes[cc] = append(changes[cc], blockChange{blockUpdate{x, y, z, bl}, old, 0})
+		}
+	}
+	var changed int
+	for cc, list := range changes {
+		// The changed block can be in the chunk above, which may not allow it.
+		if tp := ChunkFindLoaded_RLw(cc); tp != nil && !tp.noGrowth_RLc() {
+			tp.RLock()
+			save := tp.owner != OWNER_NONE
+			tp.RUnlock()
+			changed += tp.ChangeBlocks_WLcRLq(list, save)
+		}
+	}
+	return changed
+}
+
+func (cp *chunk) noGrowth_RLc() bool {
+	cp.RLock()
+	defer cp.RUnlock()
+	return cp.flag&CHF_NOGROWTH != 0
+}
+
+// Update random blocks in all chunks that are in use.
+func randomTicks_RLwWLcRLq(r *rand.Rand) {
+	if tickRates.Ticks == 0 {
+		return
+	}
+	// Take a copy of the list, to not hold the shard lock while the chunks are locked.
+	var list []*chunk
+	for i := range worldCache {
+		shard := &worldCache[i]
+		shard.RLock()
+		for _, cp := range shard.chunks {
+			list = append(list, cp)
+		}
+		shard.RUnlock()
+	}
+	for _, cp := range list {
+		if cp.rc.Load() == nil {
+			continue // Not used for a while
+		}
+		cp.RandomTicks_RLwWLcRLq(tickRates.Ticks, r)
+	}
+}
+
+func ProcRandomTicks_RLwWLcRLq() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var elapsed time.Duration
+	timerstats.Add("ProcRandomTicks", CnfgRandomTickPeriod, &elapsed)
+	for {
+		time.Sleep(CnfgRandomTickPeriod)
+		start := time.Now()
+		randomTicks_RLwWLcRLq(r)
+		elapsed = time.Now().Sub(start)
+	}
+}
+
+// Handle "/territory growth on|off", for all chunks in the territory of the player.
+func (up *user) TerritoryGrowth_WLc(arg []string) {
+	if len(arg) != 1 || arg[0] != "on" && arg[0] != "off" {
+		up.Printf_Bl("#FAIL Usage: /territory growth on|off")
+		return
+	}
+	for _, cc := range up.Territory {
+		cp := ChunkFind_WLwWLc(cc)
+		cp.Lock()
+		if arg[0] == "on" {
+			cp.flag &^= CHF_NOGROWTH
+		} else {
+			cp.flag |= CHF_NOGROWTH
+		}
+		cp.flag |= CHF_MODIFIED
+		cp.WriteDelayed()
+		cp.Unlock()
+	}
+	up.Printf_Bl("Growth turned %s in %d chunks", arg[0], len(up.Territory))
+}
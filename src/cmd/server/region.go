@@ -0,0 +1,398 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Export and import of regions of the world, using the schematic format. This is used to move
+// creations between servers. A region is a box of blocks, including the activator messages and
+// the teleports.
+//
+
+import (
+	"chunkdb"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"schematic"
+	"strconv"
+	"strings"
+)
+
+// A block coordinate in the world
+type blockCoord struct {
+	X, Y, Z int64
+}
+
+// Get the chunk a block coordinate belongs to
+func (bc blockCoord) GetChunkCoord() chunkdb.CC {
+	f := func(a int64) int32 {
+		if a < 0 {
+			return int32((a+1)/CHUNK_SIZE - 1)
+		}
+		return int32(a / CHUNK_SIZE)
+	}
+	return chunkdb.CC{X: f(bc.X), Y: f(bc.Y), Z: f(bc.Z)}
+}
+
+// Get the chunk a block coordinate belongs to, and the offset in the chunk
+func (bc blockCoord) chunkOffset() (cc chunkdb.CC, x, y, z uint8) {
+	cc = bc.GetChunkCoord()
+	return cc, uint8(bc.X - int64(cc.X)*CHUNK_SIZE), uint8(bc.Y - int64(cc.Y)*CHUNK_SIZE), uint8(bc.Z - int64(cc.Z)*CHUNK_SIZE)
+}
+
+// The block coordinate of an offset in a chunk
+func blockCoordOf(cc chunkdb.CC, x, y, z uint8) blockCoord {
+	return blockCoord{int64(cc.X)*CHUNK_SIZE + int64(x), int64(cc.Y)*CHUNK_SIZE + int64(y), int64(cc.Z)*CHUNK_SIZE + int64(z)}
+}
+
+// Parse a coordinate of the form "x,y,z".
+func parseCoord(s string) (blockCoord, error) {
+	var ret blockCoord
+	list := strings.Split(s, ",")
+	if len(list) != 3 {
+		return ret, fmt.Errorf("bad coordinate '%s', expected x,y,z", s)
+	}
+	var v [3]int64
+	for i, str := range list {
+		var err error
+		v[i], err = strconv.ParseInt(strings.TrimSpace(str), 10, 32)
+		if err != nil {
+			return ret, fmt.Errorf("bad coordinate '%s': %v", s, err)
+		}
+	}
+	return blockCoord{v[0], v[1], v[2]}, nil
+}
+
+// Parse a box of the form "x1,y1,z1:x2,y2,z2". The corners can be given in any order,
+// the lowest corner is returned first.
+func parseBox(s string) (lo, hi blockCoord, err error) {
+	list := strings.Split(s, ":")
+	if len(list) != 2 {
+		err = fmt.Errorf("bad box '%s', expected x1,y1,z1:x2,y2,z2", s)
+		return
+	}
+	if lo, err = parseCoord(list[0]); err != nil {
+		return
+	}
+	if hi, err = parseCoord(list[1]); err != nil {
+		return
+	}
+	if lo.X > hi.X {
+		lo.X, hi.X = hi.X, lo.X
+	}
+	if lo.Y > hi.Y {
+		lo.Y, hi.Y = hi.Y, lo.Y
+	}
+	if lo.Z > hi.Z {
+		lo.Z, hi.Z = hi.Z, lo.Z
+	}
+	return
+}
+
+// Convert a box of chunks to a box of blocks
+func chunkBoxToBlocks(lo, hi blockCoord) (blockCoord, blockCoord) {
+	return blockCoord{lo.X * CHUNK_SIZE, lo.Y * CHUNK_SIZE, lo.Z * CHUNK_SIZE},
+		blockCoord{hi.X*CHUNK_SIZE + CHUNK_SIZE - 1, hi.Y*CHUNK_SIZE + CHUNK_SIZE - 1, hi.Z*CHUNK_SIZE + CHUNK_SIZE - 1}
+}
+
+// Iterate over all chunks overlapping a box of blocks. For every chunk, 'f' is called with
+// the chunk coordinate, the block coordinate of the chunk origin, and the range of chunk
+// offsets (inclusive) that are inside the box.
+func forEachChunkInBox(lo, hi blockCoord, f func(cc chunkdb.CC, origin blockCoord, from, to [3]int64)) {
+	ccLo, ccHi := lo.GetChunkCoord(), hi.GetChunkCoord()
+	clamp := func(a, min, max int64) int64 {
+		if a < min {
+			return min
+		}
+		if a > max {
+			return max
+		}
+		return a
+	}
+	for cx := ccLo.X; cx <= ccHi.X; cx++ {
+		for cy := ccLo.Y; cy <= ccHi.Y; cy++ {
+			for cz := ccLo.Z; cz <= ccHi.Z; cz++ {
+				cc := chunkdb.CC{X: cx, Y: cy, Z: cz}
+				origin := blockCoord{int64(cx) * CHUNK_SIZE, int64(cy) * CHUNK_SIZE, int64(cz) * CHUNK_SIZE}
+				from := [3]int64{clamp(lo.X-origin.X, 0, CHUNK_SIZE-1), clamp(lo.Y-origin.Y, 0, CHUNK_SIZE-1), clamp(lo.Z-origin.Z, 0, CHUNK_SIZE-1)}
+				to := [3]int64{clamp(hi.X-origin.X, 0, CHUNK_SIZE-1), clamp(hi.Y-origin.Y, 0, CHUNK_SIZE-1), clamp(hi.Z-origin.Z, 0, CHUNK_SIZE-1)}
+				f(cc, origin, from, to)
+			}
+		}
+	}
+}
+
+// Test if a chunk offset is inside the range given by forEachChunkInBox.
+func inRange(from, to [3]int64, x, y, z int64) bool {
+	return x >= from[0] && x <= to[0] && y >= from[1] && y <= to[1] && z >= from[2] && z <= to[2]
+}
+
+// Export a box of blocks, including activator messages and teleports. No chunks are created or saved.
+func ExportRegion_RLwWLc(lo, hi blockCoord) (*schematic.Schematic, error) {
+	s, err := schematic.New(uint32(hi.X-lo.X+1), uint32(hi.Y-lo.Y+1), uint32(hi.Z-lo.Z+1))
+	if err != nil {
+		return nil, err
+	}
+	// Convert a chunk offset to a position in the schematic
+	pos := func(origin blockCoord, x, y, z int64) schematic.Pos {
+		return schematic.Pos{X: uint32(origin.X + x - lo.X), Y: uint32(origin.Y + y - lo.Y), Z: uint32(origin.Z + z - lo.Z)}
+	}
+	forEachChunkInBox(lo, hi, func(cc chunkdb.CC, origin blockCoord, from, to [3]int64) {
+		cp := ChunkFindReadOnly_RLw(cc)
+		cp.RLock()
+		rc := cp.raw()
+		for x := from[0]; x <= to[0]; x++ {
+			for y := from[1]; y <= to[1]; y++ {
+				for z := from[2]; z <= to[2]; z++ {
+					p := pos(origin, x, y, z)
+					s.Set(p.X, p.Y, p.Z, uint8(rc[x][y][z]))
+				}
+			}
+		}
+		for _, tm := range cp.triggerMsgs {
+			if len(tm.Message) > 0 && inRange(from, to, int64(tm.X), int64(tm.Y), int64(tm.Z)) {
+				p := pos(origin, int64(tm.X), int64(tm.Y), int64(tm.Z))
+				s.Activators = append(s.Activators, schematic.Activator{Pos: p, Message: tm.Message})
+			}
+		}
+		cp.RUnlock()
+		if x, y, z, ok := superChunkManager.GetTeleport(&cc); ok {
+			if inRange(from, to, int64(x), int64(y), int64(z)) {
+				s.Teleports = append(s.Teleports, pos(origin, int64(x), int64(y), int64(z)))
+			}
+		}
+	})
+	return s, nil
+}
+
+// Test that all blocks in a schematic can be stored in a chunk. The file may come from another server.
+func checkSchematicBlocks(s *schematic.Schematic) error {
+	for _, b := range s.Blocks {
+		if bl := block(b); !bl.Registered() || blockTypes[bl].virtual {
+			return fmt.Errorf("bad block type %d in schematic", b)
+		}
+	}
+	return nil
+}
+
+// Import a schematic, placing the lower corner at the origin of chunk 'target'. Existing blocks in the
+// region are replaced, regardless of the owner of the chunks. Return the number of chunks updated.
+func ImportRegion_WLwWLcRLq(s *schematic.Schematic, target chunkdb.CC) (int, error) {
+	if *inhibitCreateChunks {
+		return 0, errors.New("changes are not saved when chunks can't be created")
+	}
+	if err := checkSchematicBlocks(s); err != nil {
+		return 0, err
+	}
+	lo := blockCoord{int64(target.X) * CHUNK_SIZE, int64(target.Y) * CHUNK_SIZE, int64(target.Z) * CHUNK_SIZE}
+	hi := blockCoord{lo.X + int64(s.SizeX) - 1, lo.Y + int64(s.SizeY) - 1, lo.Z + int64(s.SizeZ) - 1}
+	var num int
+	forEachChunkInBox(lo, hi, func(cc chunkdb.CC, origin blockCoord, from, to [3]int64) {
+		// The schematic position of the chunk origin. It can be negative, as the chunk may only be partially inside.
+		sx, sy, sz := origin.X-lo.X, origin.Y-lo.Y, origin.Z-lo.Z
+		cp := ChunkFind_WLwWLc(cc)
+		cp.Lock()
+		if cp.jellyBlocks != nil {
+			cp.RestoreJellyBlocks(true)
+		}
+		rc := cp.raw()
+		for x := from[0]; x <= to[0]; x++ {
+			for y := from[1]; y <= to[1]; y++ {
+				for z := from[2]; z <= to[2]; z++ {
+					rc[x][y][z] = block(s.Get(uint32(sx+x), uint32(sy+y), uint32(sz+z)))
+					delete(cp.liquidLevels, [3]uint8{uint8(x), uint8(y), uint8(z)}) // Imported liquid is a source
+				}
+			}
+		}
+		// Add the messages to the current list, the links will take care of removing messages that no longer have an activator.
+		for _, act := range s.Activators {
+			x, y, z := int64(act.X)-sx, int64(act.Y)-sy, int64(act.Z)-sz
+			if !inRange(from, to, x, y, z) {
+				continue
+			}
+			msgp := cp.FindActivator(uint8(x), uint8(y), uint8(z))
+			if msgp != nil {
+				*msgp = act.Message
+			} else {
+				cp.triggerMsgs = append(cp.triggerMsgs, textMsgActivator{X: uint8(x), Y: uint8(y), Z: uint8(z), Message: act.Message})
+			}
+		}
+		cp.ComputeLinks()
+		cp.compressAndChecksum()
+		cp.flag |= CHF_MODIFIED
+		cp.WriteDelayed()
+		cp.Unlock()
+		teleport := false
+		for _, tp := range s.Teleports {
+			x, y, z := int64(tp.X)-sx, int64(tp.Y)-sy, int64(tp.Z)-sz
+			if inRange(from, to, x, y, z) {
+				superChunkManager.SetTeleport(&cc, uint8(x), uint8(y), uint8(z))
+				teleport = true
+			}
+		}
+		ResendChunkToNearPlayers_RLq(cc, teleport)
+		num++
+	})
+	return num, nil
+}
+
+// The file name used for a named schematic.
+func schematicFileName(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/\\.") {
+		return "", fmt.Errorf("bad schematic name '%s'", name)
+	}
+	return filepath.Join(CnfgSchematicFolder, name+".schematic"), nil
+}
+
+func saveSchematic(s *schematic.Schematic, fn string) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	err = s.Write(f)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func loadSchematic(fn string) (*schematic.Schematic, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return schematic.Read(f)
+}
+
+// Handle the command line flags for export and import, for use when the server isn't running.
+// Return false if there was an error.
+func RegionCommandLine(export, importTo, fn string, blocks bool) bool {
+	switch {
+	case export != "":
+		lo, hi, err := parseBox(export)
+		if err != nil {
+			fmt.Println(err)
+			return false
+		}
+		if !blocks {
+			lo, hi = chunkBoxToBlocks(lo, hi)
+		}
+		s, err := ExportRegion_RLwWLc(lo, hi)
+		if err == nil {
+			err = saveSchematic(s, fn)
+		}
+		if err != nil {
+			fmt.Println("Export failed:", err)
+			return false
+		}
+		fmt.Printf("Exported %dx%dx%d blocks, %d activators, %d teleports to %s\n", s.SizeX, s.SizeY, s.SizeZ, len(s.Activators), len(s.Teleports), fn)
+	case importTo != "":
+		c, err := parseCoord(importTo)
+		if err != nil {
+			fmt.Println(err)
+			return false
+		}
+		s, err := loadSchematic(fn)
+		if err != nil {
+			fmt.Println("Import failed:", err)
+			return false
+		}
+		n, err := ImportRegion_WLwWLcRLq(s, chunkdb.CC{X: int32(c.X), Y: int32(c.Y), Z: int32(c.Z)})
+		if err != nil {
+			fmt.Println("Import failed:", err)
+			return false
+		}
+		FlushDirtyChunks()
+		fmt.Printf("Imported %s into %d chunks\n", fn, n)
+	}
+	return true
+}
+
+// Handle the admin command "/region".
+func (up *user) RegionCommand_WLwWLcRLqBl(cmd []string) {
+	const usage = "#FAIL !Usage: /region export chunks|blocks x1,y1,z1:x2,y2,z2 name, /region import name [x,y,z]"
+	if up.AdminLevel < 8 {
+		up.Printf_Bl("#FAIL !Not allowed")
+		return
+	}
+	switch {
+	case cmd[0] == "export" && len(cmd) == 4:
+		lo, hi, err := parseBox(cmd[2])
+		if err != nil {
+			up.Printf_Bl("#FAIL !%v", err)
+			return
+		}
+		switch cmd[1] {
+		case "chunks":
+			lo, hi = chunkBoxToBlocks(lo, hi)
+		case "blocks":
+		default:
+			up.Printf_Bl(usage)
+			return
+		}
+		fn, err := schematicFileName(cmd[3])
+		if err != nil {
+			up.Printf_Bl("#FAIL !%v", err)
+			return
+		}
+		s, err := ExportRegion_RLwWLc(lo, hi)
+		if err == nil {
+			err = saveSchematic(s, fn)
+		}
+		if err != nil {
+			up.Printf_Bl("#FAIL !Export failed: %v", err)
+			return
+		}
+		up.Printf_Bl("!Exported %dx%dx%d blocks to %s", s.SizeX, s.SizeY, s.SizeZ, fn)
+	case cmd[0] == "import" && (len(cmd) == 2 || len(cmd) == 3):
+		target := up.Coord.GetChunkCoord()
+		if len(cmd) == 3 {
+			c, err := parseCoord(cmd[2])
+			if err != nil {
+				up.Printf_Bl("#FAIL !%v", err)
+				return
+			}
+			target = chunkdb.CC{X: int32(c.X), Y: int32(c.Y), Z: int32(c.Z)}
+		}
+		fn, err := schematicFileName(cmd[1])
+		if err != nil {
+			up.Printf_Bl("#FAIL !%v", err)
+			return
+		}
+		s, err := loadSchematic(fn)
+		if err != nil {
+			up.Printf_Bl("#FAIL !Import failed: %v", err)
+			return
+		}
+		n, err := ImportRegion_WLwWLcRLq(s, target)
+		if err != nil {
+			up.Printf_Bl("#FAIL !Import failed: %v", err)
+			return
+		}
+		log.Printf("%s imported %s at chunk %v\n", up.Name, fn, target)
+		up.Printf_Bl("!Imported %s at chunk %v, %d chunks updated", fn, target, n)
+	default:
+		up.Printf_Bl(usage)
+	}
+}
@@ -32,6 +32,7 @@ import (
 	"score"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"timerstats"
 )
@@ -109,17 +110,27 @@ func (up *user) playerStringMessage_RLuWLwRLqBlWLaWLc(buff []byte) {
 		var m runtime.MemStats
 		runtime.ReadMemStats(&m)
 		up.Printf_Bl("!!Status")
-		up.Printf_Bl("!Chunks loaded: %d, super chunks %d", worldCacheNumChunks, superChunkManager.Size())
+		up.Printf_Bl("!Chunks loaded: %d, super chunks %d", NumCachedChunks(), superChunkManager.Size())
+		up.Printf_Bl("!Chunk cache: %d hits, %d misses, %d waits for loads, %d evictions, %dMB used of %dMB", atomic.LoadInt64(&CacheStats.Hits),
+			atomic.LoadInt64(&CacheStats.Misses), atomic.LoadInt64(&CacheStats.Waits), atomic.LoadInt64(&CacheStats.Evictions),
+			atomic.LoadInt64(&CacheStats.MemUsed)/1e6, atomic.LoadInt64(&worldCacheBudget)/1e6)
+		up.Printf_Bl("!Uncompressed chunks released %d, rebuilt %d, %dMB saved", atomic.LoadInt64(&CacheStats.RawReleased),
+			atomic.LoadInt64(&CacheStats.RawRebuilt), atomic.LoadInt64(&CacheStats.RawSaved)/1e6)
+		up.Printf_Bl("!Prefetched chunks: %d, over budget %d", atomic.LoadInt64(&PrefetchStats.Loaded), atomic.LoadInt64(&PrefetchStats.OverBudget))
 		up.Printf_Bl("!Num players:%v, monsters %v, near monsters %d", numPlayers, len(monsterData.m), CountNearMonsters_RLq(up.GetPreviousPos()))
 		up.Printf_Bl("!Mem in use %vMB, total alloc %vMB, num malloc %vM, num free %vM",
 			m.Alloc/1e6, m.TotalAlloc/1e6, m.Mallocs/1e6, m.Frees/1e6)
 		up.Printf_Bl("!Worst message write %.6f s, Worst chunk read %.6f s", float64(WorstWriteTime)/float64(time.Second), float64(DBStats.WorstRead)/float64(time.Second))
 		up.Printf_Bl("!Num chunks read: %d, average read time %.6f", DBStats.NumRead, float64(DBStats.TotRead)/float64(DBStats.NumRead)/float64(time.Second))
 		up.Printf_Bl("!Created chunks: %d, average time %.6f", DBCreateStats.Num, float64(DBCreateStats.TotTime)/float64(DBCreateStats.Num)/float64(time.Second))
+		up.Printf_Bl("!Player journal entries: %d, replayed %d", JournalStats.NumEntries, JournalStats.NumReplayed)
+		up.Printf_Bl("!Chunks waiting to be saved: %d, save requests %d, saved %d in %d batches", NumDirtyChunks(), ChunkSaveStats.NumRequests, ChunkSaveStats.NumWrites, ChunkSaveStats.NumBatches)
 		up.Printf_Bl("!Server booted %v", bootDate)
 		up.Printf_Bl("!%s", trafficStatistics)
 		WorstWriteTime = 0
+		DBStats.Lock()
 		DBStats.WorstRead = 0
+		DBStats.Unlock()
 	case "/players":
 		up.ReportPlayers()
 	case "/flying":
@@ -168,6 +179,23 @@ func (up *user) playerStringMessage_RLuWLwRLqBlWLaWLc(buff []byte) {
 			GraceFulShutdown()
 			// Will not return
 		}
+	case "/snapshot":
+		if up.AdminLevel >= 8 {
+			// Takes some time, and waits for players to be saved, so it can't be done by the player process.
+			go func() {
+				fn, err := TakeSnapshot()
+				if err != nil {
+					up.Printf("#FAIL !Snapshot failed: %v", err)
+				} else {
+					up.Printf("!Snapshot saved in %s", fn)
+				}
+			}()
+		}
+	case "/region":
+		if len(message) < 2 {
+			return
+		}
+		up.RegionCommand_WLwWLcRLqBl(strings.Split(message[1], " "))
 	case "/evalsync":
 		for _, str := range evalsync.Eval() {
 			up.Printf_Bl("!%s", str)
@@ -175,7 +203,7 @@ func (up *user) playerStringMessage_RLuWLwRLqBlWLaWLc(buff []byte) {
 	case "/resetpos":
 		up.Coord.X = 0
 		up.Coord.Y = 0
-		up.Coord.Z = FLOATING_ISLANDS_LIM - PlayerHeight // As high as possible
+		up.Coord.Z = worldParams.FloatingIslandsLim - PlayerHeight // As high as possible
 		up.Flying = false
 		up.Climbing = false
 	case "/prof":
@@ -259,6 +287,10 @@ func (up *user) TerritoryCommand_WLwWLcBl(msg []string) {
 		}
 	case "claim":
 		up.TerritoryClaim_WLwWLc(msg[1:])
+	case "history", "rollback":
+		up.TerritoryHistory_WLwWLcRLaRLqBl(msg)
+	case "growth":
+		up.TerritoryGrowth_WLc(msg[1:])
 	case "grant":
 		if up.AdminLevel < 5 || len(msg) != 2 {
 			up.Printf_Bl("#FAIL")
@@ -277,11 +309,9 @@ func (up *user) TerritoryCommand_WLwWLcBl(msg []string) {
 			return
 		}
 		// Remove the old chunk and make a new one from scratch
-		worldCacheLock.Lock()
-		RemoveChunkFromHashTable(cp)
 		cp = dBCreateAndSaveChunk(cc)
-		AddChunkToHashTable(cp)
-		worldCacheLock.Unlock()
+		AddChunkToCache(cp)
+		cp.WriteDelayed()            // Replace any pending save of the old chunk
 		up.CmdReadChunk_WLwWLcBl(cc) // Use exisiting method to send chunk
 	default:
 		up.Printf_Bl("#FAIL Unknown territory command %v", msg[0])
@@ -296,9 +326,12 @@ func (up *user) TerritoryGrant(arg string) {
 		up.Printf_Bl("%v", err)
 		return
 	}
-	up.Printf_Bl("Changed owner from %d to %d", cp.owner, newOwner)
+	cp.Lock()
+	oldOwner := cp.owner
 	cp.owner = uint32(newOwner)
-	cp.Write()
+	cp.WriteDelayed()
+	cp.Unlock()
+	up.Printf_Bl("Changed owner from %d to %d", oldOwner, newOwner)
 }
 
 func (up *user) TerritoryClaim_WLwWLc(arg []string) {
@@ -350,9 +383,11 @@ func (up *user) TerritoryClaim_WLwWLc(arg []string) {
 	// Make sure either it is the first chunk, or an adjacent chunk is already allocated, or the request will be denied.
 	approved := len(up.Territory) == 0 || up.AdminLevel > 0
 	adjacent := dBGetAdjacentChunks(&cc)
+	var growth uint32 // The growth setting is taken from the adjacent chunk
 	for _, cp := range adjacent {
 		if cp.owner == up.Id {
 			approved = true
+			growth = cp.flag & CHF_NOGROWTH
 			break
 		}
 	}
@@ -364,8 +399,8 @@ func (up *user) TerritoryClaim_WLwWLc(arg []string) {
 	// All tests are approved, allocate the chunk
 	ChunkFind_WLwWLc(chunkdb.CC{X: cc.X, Y: cc.Y, Z: cc.Z})
 	cp.owner = up.Id
-	cp.flag |= CHF_MODIFIED
-	cp.Write()
+	cp.flag |= CHF_MODIFIED | growth
+	cp.WriteDelayed()
 	cp.Unlock()
 	up.Printf_Bl("!Congratulations, you now own chunk %v", cc)
 	if up.Territory == nil {
@@ -379,6 +414,7 @@ func (up *user) TerritoryClaim_WLwWLc(arg []string) {
 		}
 		up.Territory = append(up.Territory, cc)
 	}
+	up.Journal("territory")
 	up.Save_Bl()
 }
 
@@ -447,8 +483,13 @@ func (up *user) FriendCommand_RLaWLu(arg string) {
 func GraceFulShutdown() {
 	log.Println("User requested shut down")
 	score.Close()
+	n := FlushDirtyChunks()
+	log.Println("Saved", n, "modified chunks")
 	SaveAllPlayers_RLa() // This will only set the flag to save
 	time.Sleep(1e9)      // TODO: not a pretty way. Wait for players to be saved.
+	journalLock.Lock()
+	writePendingJournals() // In case a save failed
+	journalLock.Unlock()
 	log.Println("Goodbye!")
 	os.Exit(0)
 }
@@ -483,7 +524,7 @@ func (up *user) ActivatorControl(msg string) {
 		} else {
 			log.Println("Failed to find text message", x, y, z, cp.Coord)
 		}
-		cp.Write()
+		cp.WriteDelayed()
 		cp.Unlock()
 	case "add":
 		if len(cmd) < 2 {
@@ -511,7 +552,7 @@ func (up *user) ActivatorControl(msg string) {
 		} else {
 			log.Println("Failed to find text message", x, y, z, cp.Coord)
 		}
-		cp.Write()
+		cp.WriteDelayed()
 		cp.Unlock()
 	}
 }
@@ -0,0 +1,339 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Structures, like ruins, dungeons and villages, are added to new chunks by the world generator.
+// The world is divided into square cells, and the seed and the coordinate of a cell decide if there
+// is a structure in the cell, and what it looks like. A structure is always inside its cell, but it
+// can span several chunks. Every time a chunk is created, the structure of the cell is planned again,
+// and the part inside the chunk is added. That way, the chunks can be created in any order.
+//
+// Structures come with triggers and activators. As links are not followed between chunks, every
+// trigger is placed in the same chunk as its activator.
+//
+
+import (
+	"chunkdb"
+	"fmt"
+	"math"
+)
+
+const (
+	structureCellSize = 4 * CHUNK_SIZE // Must be a multiple of the chunk size, so every chunk is inside one cell
+	structureMargin   = 24             // Structures are at least this far from the border of the cell
+)
+
+// A world generator that can have structures tells where they can be placed.
+type StructureSite interface {
+	GroundHeight(x, y float64) float64 // The level of the top block of the ground, not counting holes
+	IsCave(x, y, z float64) bool       // True if the block is inside a cave
+}
+
+type structBlock struct {
+	x, y, z   int64
+	bl        block
+	onlySolid bool // Only replace solid blocks, to keep caves open
+}
+
+type structText struct {
+	x, y, z int64
+	message []string
+}
+
+// A structure, in world block coordinates.
+type structure struct {
+	name   string
+	lo, hi blockCoord    // The box that contains all blocks
+	blocks []structBlock // Later blocks replace earlier ones
+	texts  []structText  // Messages of the text activators
+}
+
+func (s *structure) add(b structBlock) {
+	if len(s.blocks) == 0 {
+		s.lo = blockCoord{b.x, b.y, b.z}
+		s.hi = s.lo
+	}
+	s.lo = blockCoord{minInt64(s.lo.X, b.x), minInt64(s.lo.Y, b.y), minInt64(s.lo.Z, b.z)}
+	s.hi = blockCoord{maxInt64(s.hi.X, b.x), maxInt64(s.hi.Y, b.y), maxInt64(s.hi.Z, b.z)}
+	s.blocks = append(s.blocks, b)
+}
+
+func (s *structure) set(x, y, z int64, bl block) {
+	s.add(structBlock{x: x, y: y, z: z, bl: bl})
+}
+
+// Fill a box, including both corners.
+func (s *structure) box(x1, y1, z1, x2, y2, z2 int64, bl block, onlySolid bool) {
+	for x := x1; x <= x2; x++ {
+		for y := y1; y <= y2; y++ {
+			for z := z1; z <= z2; z++ {
+				s.add(structBlock{x, y, z, bl, onlySolid})
+			}
+		}
+	}
+}
+
+// Add a trigger, and an activator next to it that is in the same chunk.
+func (s *structure) trigger(x, y, z int64, activator block, message ...string) {
+	s.set(x, y, z, BT_Trigger)
+	az := z - 1 // Below the trigger, if possible
+	if (blockCoord{x, y, z}).GetChunkCoord() != (blockCoord{x, y, az}).GetChunkCoord() {
+		az = z + 1
+	}
+	s.set(x, y, az, activator)
+	if activator == BT_Text {
+		s.texts = append(s.texts, structText{x, y, az, message})
+	}
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// A random generator that always gives the same sequence for the same seed (splitmix64).
+type structRand uint64
+
+func newStructRand(seed int64, cellX, cellY int64) structRand {
+	r := structRand(uint64(seed) ^ uint64(cellX)*0x9E3779B97F4A7C15 ^ uint64(cellY)*0xC2B2AE3D27D4EB4F)
+	r.next()
+	return r
+}
+
+func (r *structRand) next() uint64 {
+	*r += 0x9E3779B97F4A7C15
+	z := uint64(*r)
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+// A number in the range 0 to n-1.
+func (r *structRand) intn(n int) int {
+	return int(r.next() % uint64(n))
+}
+
+// A number in the range 0 to 1.
+func (r *structRand) float() float64 {
+	return float64(r.next()>>11) / (1 << 53)
+}
+
+// Plan the structure of a cell. Return nil if there is none.
+func planStructure(site StructureSite, params WorldParams, cellX, cellY int64) *structure {
+	x0, y0 := cellX*structureCellSize, cellY*structureCellSize
+	// Keep the area around the start, where the chunks are reserved, free.
+	if y0 < 5*CHUNK_SIZE && y0+structureCellSize > -4*CHUNK_SIZE {
+		return nil
+	}
+	r := newStructRand(params.Seed, cellX, cellY)
+	// A random position in the cell, not too near the border
+	const free = structureCellSize - 2*structureMargin
+	x, y := x0+structureMargin+int64(r.intn(free)), y0+structureMargin+int64(r.intn(free))
+	switch p := r.float(); {
+	case p < 0.25:
+		return planRuin(site, params, &r, x, y)
+	case p < 0.40:
+		return planVillage(site, params, &r, x, y)
+	case p < 0.55:
+		return planDungeon(site, &r, x, y)
+	}
+	return nil
+}
+
+// The level of the ground where a building can be placed, or false if it is in the water or too high.
+func buildingGround(site StructureSite, params WorldParams, x, y int64) (int64, bool) {
+	z := site.GroundHeight(float64(x), float64(y))
+	if z < 1 || z > params.FloatingIslandsLim-10 {
+		return 0, false
+	}
+	return int64(z), true
+}
+
+// Make a flat ground for a building. The ground is filled below, and everything above is removed.
+func (s *structure) foundation(x1, y1, x2, y2, ground int64, bl block, height int64) {
+	s.box(x1, y1, ground-3, x2, y2, ground, bl, false)
+	s.box(x1, y1, ground+1, x2, y2, ground+height, BT_Air, false)
+}
+
+// The remains of a small stone building, with a treasure inside.
+func planRuin(site StructureSite, params WorldParams, r *structRand, x, y int64) *structure {
+	ground, ok := buildingGround(site, params, x, y)
+	if !ok {
+		return nil
+	}
+	const size = 7
+	s := &structure{name: "ruin"}
+	s.foundation(x, y, x+size-1, y+size-1, ground, BT_Cobblestone, 5)
+	// Walls of random height, to make them look broken
+	for i := int64(0); i < size; i++ {
+		for _, p := range [][2]int64{{x + i, y}, {x + i, y + size - 1}, {x, y + i}, {x + size - 1, y + i}} {
+			h := int64(r.intn(4))
+			for z := ground + 1; z <= ground+h; z++ {
+				bl := block(BT_Cobblestone)
+				if r.intn(4) == 0 {
+					bl = BT_Brick
+				}
+				s.set(p[0], p[1], z, bl)
+			}
+		}
+	}
+	cx, cy := x+size/2, y+size/2
+	s.set(cx, cy, ground+1, BT_Treasure)
+	rewards := []ObjectCode{ItemHealthPotionID, ItemManaPotionID, ItemWeapon1ID, ItemArmor1ID, ItemHelmet1ID}
+	s.trigger(cx, cy-1, ground+1, BT_Text, fmt.Sprintf("/inhibit:3600 /invadd:%s You found something among the ruins.", rewards[r.intn(len(rewards))]))
+	return s
+}
+
+// A room in the ground, where a cave passes through. Monsters are waiting for intruders.
+func planDungeon(site StructureSite, r *structRand, x, y int64) *structure {
+	// Look for a cave, at a couple of places near the chosen position.
+	for try := 0; try < 20; try++ {
+		cx, cy := x+int64(r.intn(17))-8, y+int64(r.intn(17))-8
+		cz := -10 - int64(r.intn(30))
+		if !site.IsCave(float64(cx), float64(cy), float64(cz)) {
+			continue
+		}
+		const half, height = 5, 5
+		s := &structure{name: "dungeon"}
+		// The walls only replace solid blocks, to keep the entrances from the cave open.
+		s.box(cx-half, cy-half, cz-1, cx+half, cy+half, cz+height, BT_Brick, true)
+		s.box(cx-half+1, cy-half+1, cz-1, cx+half-1, cy+half-1, cz-1, BT_TiledStone, false)
+		s.box(cx-half+1, cy-half+1, cz, cx+half-1, cy+half-1, cz+height-1, BT_Air, false)
+		s.set(cx-half+1, cy-half+1, cz+height-1, BT_Lamp1)
+		s.set(cx+half-1, cy+half-1, cz+height-1, BT_Lamp1)
+		s.trigger(cx, cy, cz, BT_Spawn)
+		s.set(cx+half-1, cy-half+1, cz, BT_Treasure)
+		s.trigger(cx+half-2, cy-half+1, cz, BT_Text, "/inhibit:3600 /invadd:"+ItemWeapon2ID+" You found a weapon left by an earlier visitor.")
+		return s
+	}
+	return nil
+}
+
+var villageSyllables = []string{"ba", "den", "el", "fa", "gor", "ha", "in", "ka", "lo", "mir", "na", "or", "ra", "sen", "tal", "u", "vin", "wy"}
+
+// A couple of small houses around a well.
+func planVillage(site StructureSite, params WorldParams, r *structRand, x, y int64) *structure {
+	ground, ok := buildingGround(site, params, x, y)
+	if !ok {
+		return nil
+	}
+	s := &structure{name: "village"}
+	s.foundation(x-1, y-1, x+1, y+1, ground, BT_Cobblestone, 4)
+	s.set(x, y, ground, BT_Water)
+	name := villageSyllables[r.intn(len(villageSyllables))] + villageSyllables[r.intn(len(villageSyllables))]
+	name = string(name[0]-'a'+'A') + name[1:]
+	s.trigger(x, y-2, ground+1, BT_Text, "/inhibit:60 Welcome to "+name+".")
+
+	houses := 3 + r.intn(4)
+	angle := r.float() * 2 * math.Pi
+	for i := 0; i < houses; i++ {
+		a := angle + 2*math.Pi*float64(i)/float64(houses)
+		sin, cos := math.Sincos(a)
+		hx, hy := x+int64(13*cos)-2, y+int64(13*sin)-2 // The corner of the house
+		hg, ok := buildingGround(site, params, hx+2, hy+2)
+		if !ok {
+			continue
+		}
+		const size = 5
+		s.foundation(hx, hy, hx+size-1, hy+size-1, hg, BT_Cobblestone, 5)
+		s.box(hx, hy, hg+1, hx+size-1, hy+size-1, hg+3, BT_Logs, false)
+		s.box(hx+1, hy+1, hg+1, hx+size-2, hy+size-2, hg+3, BT_Air, false)
+		s.box(hx, hy, hg+4, hx+size-1, hy+size-1, hg+4, BT_Bark, false) // The roof
+		// A door facing the well, and windows
+		door := [2]int64{hx + 2, hy}
+		switch {
+		case math.Abs(cos) > math.Abs(sin) && cos > 0:
+			door = [2]int64{hx, hy + 2}
+		case math.Abs(cos) > math.Abs(sin):
+			door = [2]int64{hx + size - 1, hy + 2}
+		case sin < 0:
+			door = [2]int64{hx + 2, hy + size - 1}
+		}
+		s.set(door[0], door[1], hg+1, BT_Air)
+		s.set(door[0], door[1], hg+2, BT_Air)
+		s.set(hx+2, hy, hg+2, BT_Window)
+		s.set(hx+2, hy+size-1, hg+2, BT_Window)
+		s.set(hx, hy+2, hg+2, BT_Window)
+		s.set(hx+size-1, hy+2, hg+2, BT_Window)
+		s.set(door[0], door[1], hg+2, BT_Air) // The window may have replaced the door
+		s.set(hx+1, hy+1, hg+3, BT_Lamp1)
+		if i == 0 {
+			s.set(hx+3, hy+3, hg+1, BT_Treasure)
+			s.trigger(hx+2, hy+3, hg+1, BT_Text, "/inhibit:3600 /invadd:"+string(ItemHealthPotionID)+" The villagers share a potion with you.")
+		}
+	}
+	return s
+}
+
+// Add the part of the structure that is inside chunk 'cc'. Return the activator messages of the chunk.
+func (s *structure) apply(cc chunkdb.CC, rc *raw_chunk) []textMsgActivator {
+	ox, oy, oz := int64(cc.X)*CHUNK_SIZE, int64(cc.Y)*CHUNK_SIZE, int64(cc.Z)*CHUNK_SIZE
+	if s.hi.X < ox || s.lo.X >= ox+CHUNK_SIZE || s.hi.Y < oy || s.lo.Y >= oy+CHUNK_SIZE || s.hi.Z < oz || s.lo.Z >= oz+CHUNK_SIZE {
+		return nil
+	}
+	for _, b := range s.blocks {
+		x, y, z := b.x-ox, b.y-oy, b.z-oz
+		if x < 0 || x >= CHUNK_SIZE || y < 0 || y >= CHUNK_SIZE || z < 0 || z >= CHUNK_SIZE {
+			continue
+		}
+		if b.onlySolid && !rc[x][y][z].Solid() {
+			continue
+		}
+		rc[x][y][z] = b.bl
+	}
+	var msgs []textMsgActivator
+	for _, t := range s.texts {
+		x, y, z := t.x-ox, t.y-oy, t.z-oz
+		if x < 0 || x >= CHUNK_SIZE || y < 0 || y >= CHUNK_SIZE || z < 0 || z >= CHUNK_SIZE {
+			continue
+		}
+		msgs = append(msgs, textMsgActivator{X: uint8(x), Y: uint8(y), Z: uint8(z), Message: t.message})
+	}
+	return msgs
+}
+
+// Add the structures that are inside a new chunk, if the world generator supports them.
+// Return the activator messages of the chunk.
+func addStructures(gen WorldGenerator, params WorldParams, cc chunkdb.CC, rc *raw_chunk) []textMsgActivator {
+	site, ok := gen.(StructureSite)
+	if !ok || !params.Structures {
+		return nil
+	}
+	cell := func(c int32) int64 {
+		a := int64(c) * CHUNK_SIZE
+		if a < 0 {
+			return (a+1)/structureCellSize - 1
+		}
+		return a / structureCellSize
+	}
+	s := planStructure(site, params, cell(cc.X), cell(cc.Y))
+	if s == nil {
+		return nil
+	}
+	return s.apply(cc, rc)
+}
@@ -0,0 +1,219 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Golden values of generated terrain. Chunks that are not modified are not saved, they are generated
+// again when needed. If the world generators change their output, every unmodified chunk in a live
+// world changes. The test suite generates a fixed set of chunks, and compares them with the golden
+// values in terraingolden_data.go. The test fails if there are no golden values.
+//
+// When the terrain is changed on purpose, the golden values are regenerated with
+// "server -goldens=terraingolden_data.go".
+// The golden values also include some values from the noise library, as all terrain depends on it.
+// If these differ, the noise library is not the same as the one used to create the golden values.
+//
+
+import (
+	"bytes"
+	"chunkdb"
+	"fmt"
+	"github.com/larspensjo/Go-simplex-noise/simplexnoise"
+	"go/format"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"sort"
+)
+
+// The golden values, set by terraingolden_data.go
+var (
+	terrainGoldenNoiseValues []float64
+	terrainGoldens           []terrainGolden
+)
+
+// The golden values of one generated chunk.
+type terrainGolden struct {
+	generator string
+	seed      int64
+	cc        chunkdb.CC
+	checksum  uint32        // Of all blocks and text activators
+	blocks    map[block]int // The number of every block type
+}
+
+// The generators, and the seeds, that have golden values. The seed 0 of "simplex" is the original world.
+var terrainGoldenWorlds = []struct {
+	generator string
+	seed      int64
+}{{"simplex", 0}, {"simplex", 1234}, {"biome", 0}}
+
+// The chunks tested for every world. They are on the ground, in caves, deep down where there is ore, on
+// floating islands, and where there are structures.
+var terrainGoldenChunks = []chunkdb.CC{
+	{X: 0, Y: 0, Z: 0}, {X: 0, Y: 0, Z: -1}, {X: -1, Y: -1, Z: -1}, {X: 5, Y: -7, Z: 0}, {X: -3, Y: 12, Z: -1},
+	{X: 20, Y: 20, Z: 1}, {X: -40, Y: 9, Z: -2}, {X: 7, Y: 3, Z: 3}, {X: 100, Y: -200, Z: 0}, {X: 13, Y: 31, Z: -4},
+	{X: -17, Y: -29, Z: -6}, {X: 2, Y: 41, Z: 0}, {X: 6, Y: 42, Z: 0}, {X: 40, Y: 41, Z: 0}, {X: -250, Y: 170, Z: 0},
+}
+
+// The noise values saved together with the golden values.
+func terrainGoldenNoise() []float64 {
+	return []float64{
+		simplexnoise.Noise1(12.345),
+		simplexnoise.Noise2(-3.21, 45.6),
+		simplexnoise.Noise3(0.5, -17.25, 100.125),
+		simplexnoise.Noise3(-1234.5, 678.9, -0.01),
+	}
+}
+
+// Generate a chunk with the current world generator, and compute the checksum and the block histogram.
+func terrainFingerprint(cc chunkdb.CC) (uint32, map[block]int) {
+	ch := dBCreateChunk(cc)
+	rc := ch.raw()
+	h := crc32.NewIEEE()
+	blocks := make(map[block]int)
+	var column [CHUNK_SIZE]byte
+	for x := 0; x < CHUNK_SIZE; x++ {
+		for y := 0; y < CHUNK_SIZE; y++ {
+			for z := 0; z < CHUNK_SIZE; z++ {
+				column[z] = byte(rc[x][y][z])
+				blocks[rc[x][y][z]]++
+			}
+			h.Write(column[:])
+		}
+	}
+	for _, tm := range ch.triggerMsgs {
+		fmt.Fprintf(h, "%d,%d,%d:%q", tm.X, tm.Y, tm.Z, tm.Message)
+	}
+	return h.Sum32(), blocks
+}
+
+// Generate all chunks that have golden values. The world generator is restored afterwards.
+func computeTerrainGoldens() []terrainGolden {
+	name, params := worldGenName, worldParams
+	defer SetWorldGenerator(name, params)
+	var list []terrainGolden
+	for _, w := range terrainGoldenWorlds {
+		p := DefaultWorldParams() // Not the configured parameters, they may differ between servers
+		p.Seed = w.seed
+		p.Structures, p.Ores = true, true // Test also the optional parts of the terrain
+		SetWorldGenerator(w.generator, p)
+		for _, cc := range terrainGoldenChunks {
+			sum, blocks := terrainFingerprint(cc)
+			list = append(list, terrainGolden{w.generator, w.seed, cc, sum, blocks})
+		}
+	}
+	return list
+}
+
+// Compare the generated chunks with the golden values. Return the differences, one per line.
+func compareTerrainGoldens() (diffs []string) {
+	noise := terrainGoldenNoise()
+	for i := range noise {
+		if i >= len(terrainGoldenNoiseValues) || noise[i] != terrainGoldenNoiseValues[i] {
+			diffs = append(diffs, fmt.Sprintf("noise library: got %v, golden %v", noise, terrainGoldenNoiseValues))
+			break
+		}
+	}
+	golden := make(map[string]*terrainGolden)
+	key := func(g *terrainGolden) string { return fmt.Sprint(g.generator, g.seed, g.cc) }
+	for i := range terrainGoldens {
+		golden[key(&terrainGoldens[i])] = &terrainGoldens[i]
+	}
+	for _, g := range computeTerrainGoldens() {
+		old := golden[key(&g)]
+		switch {
+		case old == nil:
+			diffs = append(diffs, fmt.Sprintf("%s seed %d chunk %v: no golden value", g.generator, g.seed, g.cc))
+		case old.checksum != g.checksum:
+			var changed []string
+			for _, bl := range histogramBlocks(g.blocks, old.blocks) {
+				if g.blocks[bl] != old.blocks[bl] {
+					changed = append(changed, fmt.Sprintf("%d: %d (golden %d)", bl, g.blocks[bl], old.blocks[bl]))
+				}
+			}
+			diffs = append(diffs, fmt.Sprintf("%s seed %d chunk %v: checksum %#x (golden %#x), blocks %v", g.generator, g.seed, g.cc, g.checksum, old.checksum, changed))
+		}
+	}
+	return
+}
+
+// The sorted block types of one or more histograms.
+func histogramBlocks(histograms ...map[block]int) []block {
+	found := make(map[block]bool)
+	for _, h := range histograms {
+		for bl := range h {
+			found[bl] = true
+		}
+	}
+	var list blockList
+	for bl := range found {
+		list = append(list, bl)
+	}
+	sort.Sort(list)
+	return list
+}
+
+type blockList []block
+
+func (l blockList) Len() int           { return len(l) }
+func (l blockList) Less(i, j int) bool { return l[i] < l[j] }
+func (l blockList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Generate the golden values again, and save them as Go source in 'fileName'. This shall only be done
+// when the terrain is changed on purpose.
+func WriteTerrainGoldens(fileName string) error {
+	var b bytes.Buffer
+	b.WriteString(copyrightHeader)
+	b.WriteString("\npackage main\n\n// Generated by \"server -goldens\". Do not edit, generate it again when the terrain is changed on purpose.\n\n")
+	b.WriteString("import \"chunkdb\"\n\n")
+	b.WriteString("func init() {\n")
+	fmt.Fprintf(&b, "terrainGoldenNoiseValues = %#v\n\n", terrainGoldenNoise())
+	b.WriteString("terrainGoldens = []terrainGolden{\n")
+	for _, g := range computeTerrainGoldens() {
+		fmt.Fprintf(&b, "{%q, %d, chunkdb.CC{X: %d, Y: %d, Z: %d}, %#x, map[block]int{", g.generator, g.seed, g.cc.X, g.cc.Y, g.cc.Z, g.checksum)
+		for _, bl := range histogramBlocks(g.blocks) {
+			fmt.Fprintf(&b, "%d: %d, ", bl, g.blocks[bl])
+		}
+		b.WriteString("}},\n")
+	}
+	b.WriteString("}\n}\n")
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Println("WriteTerrainGoldens", err)
+		return err
+	}
+	return ioutil.WriteFile(fileName, src, 0644)
+}
+
+const copyrightHeader = `// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+`
@@ -32,17 +32,19 @@ package main
 
 import (
 	"DynamicBuffer"
+	"activator"
 	"bytes"
 	"chunkdb"
 	"client_prot"
-	"encoding/gob"
 	"fmt"
 	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
+	"sync/atomic"
 	"time"
 	"twof"
 )
@@ -53,7 +55,7 @@ const (
 )
 
 // These are the block types.
-// Make sure to update blockIsInvisible and blockIsPermeable below.
+// Make sure to register the properties of new block types in blockTypes (blocks.go).
 // Do not use the "iota" mechanism to automatically increment the number, as the number must stay the same even if
 // old block types are removed.
 const (
@@ -91,6 +93,9 @@ const (
 	BT_RedLight      = block(31) // Add red light
 	BT_GreenLight    = block(32) // Add green light
 	BT_BlueLight     = block(33) // Add blue light
+	BT_Coal          = block(34) // Ore, found near the surface
+	BT_IronOre       = block(35) // Ore, found deeper down
+	BT_GoldOre       = block(36) // Ore, only found deep down
 
 	BT_Stone2   = block(127)
 	BT_Topsoil  = block(128) // This block is never stored in a chunk.
@@ -107,6 +112,7 @@ const (
 // These are saved with the chunk to external files, do not change the value of them.
 const (
 	CHF_MODIFIED = 1 << 0 // True if the chunk is modified compared to the automatically generated original
+	CHF_NOGROWTH = 1 << 1 // True if plants, trees and snow shall not change by themselves in the chunk
 )
 
 // This const group defines partition types (sections saved for every chunk on the file).
@@ -114,8 +120,20 @@ const (
 type TPartition uint16
 
 const (
-	PART_COMP_CHUNK      = TPartition(iota) // A compressed chunk
-	PART_TEXT_ACTIVATORS = TPartition(iota) // List of text messages associated with text activators in this chunk
+	PART_COMP_CHUNK       = TPartition(iota) // A compressed chunk
+	PART_TEXT_ACTIVATORS  = TPartition(iota) // Legacy list of text messages associated with text activators in this chunk, encoded with gob
+	PART_TEXT_ACTIVATORS2 = TPartition(iota) // List of text messages associated with text activators, encoded with the activator package
+	PART_LIQUID_LEVELS    = TPartition(iota) // The levels of flowing liquid blocks, 4 bytes each: x, y, z and level
+)
+
+// The version of the chunk file format, saved in the header. Files saved before the version was
+// introduced have 0 in this field, and use version 1 of the format.
+// Version 1: Partitions have a 16-bit length. All partition types must be known.
+// Version 2: Partitions have a 32-bit length. Unknown partition types are skipped when reading.
+const (
+	CHUNK_FILE_V1      = 1
+	CHUNK_FILE_V2      = 2
+	CHUNK_FILE_VERSION = CHUNK_FILE_V2 // The version used when saving
 )
 
 // This structure is used to associate a trigger with an activation block. It is a many-to-many association.
@@ -125,6 +143,7 @@ type BlockTrigger struct {
 	x, y, z    uint8             // Coordinate of the trigger
 	x2, y2, z2 uint8             // Coordinates of an activator
 	msg        *textMsgActivator // Pointer to the corresponding text message. Used as a cache to speed up reference.
+	inhibit    time.Time         // A BT_Spawn activator is inhibited until this time
 }
 
 // There is one instance of this struct for each BT_Text block in the chunk. This information is saved with the chunk
@@ -145,19 +164,23 @@ type jellyBlock struct {
 
 // Description of a chunk. A chunk mainly consists of 32x32x32 blocks.
 type chunk struct {
-	next         *chunk             // Linked list with all chunks at the same hash value
-	Coord        chunkdb.CC         // The chunk coordinate for this chunk
-	rc           *raw_chunk         // nil if no unpacked data. This may be the case now and then, to save RAM.
-	ch_comp      []byte             // This pointer always points to something. If no read lock, the pointer may change.
-	ch_comp2     []byte             // Same as ch_comp, but all invisible blocks replaced by air. This is only used for sending to clients. Can be nil to save RAM.
-	checkSum     uint32             // A checksum for this chunk. This is used by clients to identify when there is a new version of the chunk and the old one has to be discarded.
-	flag         uint32             // A bit mapped flag field for this chunk. They are all named CHF_*.
-	blTriggers   []*BlockTrigger    // List of triggers and detriggers, and what they are connected to. This list is recomputed when chunk is restored from file.
-	sync.RWMutex                    // Provide read and write mutex.
-	owner        uint32             // The owner of this chunk, see OWNER_* below for definitions.
-	touched      bool               // Flag used to determine if a chunk can be discarded
-	triggerMsgs  []textMsgActivator // List of all activators and their text messages. This list is saved and restored from file.
-	jellyBlocks  []jellyBlock       // The current list of jelly blocks. nil when empty. It is sorted in time order, with the first being the oldest.
+	lastUsed     int64                     // When the chunk was last used, in ns. Used by the cache. Must be first, as it is accessed atomically.
+	Coord        chunkdb.CC                // The chunk coordinate for this chunk
+	rc           atomic.Pointer[raw_chunk] // nil if no unpacked data. This may be the case now and then, to save RAM. Use raw() to get it.
+	ch_comp      []byte                    // This pointer always points to something. If no read lock, the pointer may change.
+	ch_comp2     []byte                    // Same as ch_comp, but all hidden blocks replaced by air. This is sent to players that don't own the chunk. Created when needed, nil if not.
+	checkSum     uint32                    // A checksum for this chunk. This is used by clients to identify when there is a new version of the chunk and the old one has to be discarded.
+	checkSum2    uint32                    // The checksum of ch_comp2
+	flag         uint32                    // A bit mapped flag field for this chunk. They are all named CHF_*.
+	blTriggers   []*BlockTrigger           // List of triggers and detriggers, and what they are connected to. This list is recomputed when chunk is restored from file.
+	sync.RWMutex                           // Provide read and write mutex.
+	owner        uint32                    // The owner of this chunk, see OWNER_* below for definitions.
+	triggerMsgs  []textMsgActivator        // List of all activators and their text messages. This list is saved and restored from file.
+	jellyBlocks  []jellyBlock              // The current list of jelly blocks. nil when empty. It is sorted in time order, with the first being the oldest.
+	lights       []lightSource             // The blocks that emit light, if lightsKnown is true.
+	lightsKnown  bool
+	unreadable   bool               // The chunk file could not be read. The chunk is a placeholder, and never saved over the file.
+	liquidLevels map[[3]uint8]uint8 // The levels of flowing liquid blocks. Liquid blocks not in the map are sources. nil when empty.
 }
 
 const (
@@ -216,18 +239,41 @@ func DBChunkFileName(c chunkdb.CC) string {
 	return fmt.Sprintf(CnfgChunkFolder+"/%d,%d,%d", c.X, c.Y, c.Z)
 }
 
-// Write the chunk out to a file.
+// Write the chunk out to a file. A copy of modified chunks is also saved in the history.
 // The chunk is already locked and compressed.
-func (ch *chunk) Write() {
-	// Create file name for this chunk
+func (ch *chunk) Write() bool {
+	data, ok := ch.writeFile()
+	if ok && ch.flag&CHF_MODIFIED != 0 {
+		saveChunkHistory(ch.Coord, data)
+	}
+	return ok
+}
+
+// Write the chunk to the file system, and return the content of the file.
+func (ch *chunk) writeFile() ([]byte, bool) {
+	if ch.unreadable {
+		log.Printf("chunk.Write: chunk %v not saved, the file could not be read\n", ch.Coord)
+		return nil, false
+	}
+	var buf bytes.Buffer
+	if !ch.WriteFS(&buf) {
+		return nil, false
+	}
+	// Create file name for this chunk. The file is first saved under a temporary name, to make
+	// sure a reader never sees a partially written chunk.
 	fn := DBChunkFileName(ch.Coord)
-	file, err := os.Create(fn)
+	tmp := fn + ".tmp"
+	err := ioutil.WriteFile(tmp, buf.Bytes(), 0666)
 	if err != nil {
-		log.Printf("chunk.Write open %s failed: %v\n", fn, err)
-		return
+		log.Printf("chunk.Write %s failed: %v\n", tmp, err)
+		os.Remove(tmp)
+		return nil, false
 	}
-	ch.WriteFS(file)
-	file.Close()
+	if err = os.Rename(tmp, fn); err != nil {
+		log.Printf("chunk.Write rename %s failed: %v\n", tmp, err)
+		return nil, false
+	}
+	return buf.Bytes(), true
 }
 
 func (ch *chunk) WriteFS(file io.Writer) bool {
@@ -236,7 +282,7 @@ func (ch *chunk) WriteFS(file io.Writer) bool {
 	EncodeUint32(ch.flag, b[0:4])
 	EncodeUint32(ch.checkSum, b[4:8])
 	EncodeUint32(ch.owner, b[8:12])
-	EncodeUint32(0, b[12:16]) // Reserved for future usage
+	EncodeUint32(CHUNK_FILE_VERSION, b[12:16])
 	EncodeUint32(0, b[16:20]) // Reserved for future usage
 	EncodeUint32(0, b[20:24]) // Reserved for future usage
 	n, err := file.Write(b[:])
@@ -253,36 +299,47 @@ func (ch *chunk) WriteFS(file io.Writer) bool {
 	}
 
 	if len(ch.triggerMsgs) > 0 {
-		// Save the activator messages, if there is any, encode using the gob package
-		// As the size of the encoded data isn't known, if must be computed before the header is written.
-		// A temporary buffer is used for that.
-		var buffer bytes.Buffer
-		encoder := gob.NewEncoder(&buffer)
-		err = encoder.Encode(&ch.triggerMsgs)
+		// Save the activator messages, if there is any
+		list := make([]activator.Activator, len(ch.triggerMsgs))
+		for i, tm := range ch.triggerMsgs {
+			list[i] = activator.Activator{X: tm.X, Y: tm.Y, Z: tm.Z, Message: tm.Message}
+		}
+		err = ch.WritePartition(file, activator.Encode(list), PART_TEXT_ACTIVATORS2)
 		if err != nil {
-			log.Printf("WriteFS: encode failed %v (for chunk %v)\n", err, ch.Coord)
+			log.Printf("WriteFS: PART_TEXT_ACTIVATORS2 write failed %v (for chunk %v)\n", err, ch.Coord)
 			return false
 		}
-		err = ch.WritePartition(file, buffer.Bytes(), PART_TEXT_ACTIVATORS)
+	}
+
+	if len(ch.liquidLevels) > 0 {
+		levels := make([]byte, 0, 4*len(ch.liquidLevels))
+		for pos, level := range ch.liquidLevels {
+			levels = append(levels, pos[0], pos[1], pos[2], level)
+		}
+		err = ch.WritePartition(file, levels, PART_LIQUID_LEVELS)
 		if err != nil {
-			log.Printf("WriteFS: PART_TEXT_ACTIVATORS write failed %v (for chunk %v)\n", err, ch.Coord)
+			log.Printf("WriteFS: PART_LIQUID_LEVELS write failed %v (for chunk %v)\n", err, ch.Coord)
 			return false
 		}
 	}
 	return true
 }
 
+// Write a partition, using the current file format version.
 func (ch *chunk) WritePartition(file io.Writer, data []byte, pType TPartition) error {
 	// fmt.Printf("Write chunk %v partition %v size %v\n", ch.Coord, pType, len(data))
-	var b [4]byte
+	if int64(len(data)) > math.MaxUint32 {
+		return fmt.Errorf("partition %d too big (%d bytes)", pType, len(data))
+	}
+	var b [6]byte
 	EncodeUint16(uint16(pType), b[0:2])
-	EncodeUint16(uint16(len(data)), b[2:4])
+	EncodeUint32(uint32(len(data)), b[2:6])
 	_, err := file.Write(b[:])
 	if err != nil {
 		return err
 	}
 	_, err = file.Write(data)
-	return nil
+	return err
 }
 
 func dBCreateAndSaveChunk(c chunkdb.CC) *chunk {
@@ -290,12 +347,31 @@ func dBCreateAndSaveChunk(c chunkdb.CC) *chunk {
 	if c.Y <= 4 && c.Y >= -4 && c.Z <= 2 && c.Z >= -1 {
 		ch.owner = OWNER_RESERVED
 	}
+	// Not while a snapshot is taken
+	chunkFlushLock.RLock()
 	ch.Write()
+	chunkFlushLock.RUnlock()
+	return ch
+}
+
+// A chunk file that exists, but can't be read, must not be replaced. It may have been saved by a newer
+// version of the server, or be repaired by hand. Instead, a placeholder chunk is used that nobody can
+// change, and that is never saved.
+func dBUnreadableChunk(c chunkdb.CC) *chunk {
+	log.Printf("dBUnreadableChunk: ***** CHUNK %v COULD NOT BE LOADED. THE FILE IS KEPT, AND THE CHUNK IS READ ONLY *****\n", c)
+	ch := dBCreateChunk(c)
+	ch.owner = OWNER_RESERVED
+	ch.unreadable = true
 	return ch
 }
 
 // No lock needed here, as no other process can access this chunk.
 func dBFindChunkFromFS(c chunkdb.CC) *chunk {
+	return dBLoadChunkFromFS(c, true)
+}
+
+// Load a chunk from the file. If there is no file, the chunk is created, and saved if 'save'.
+func dBLoadChunkFromFS(c chunkdb.CC, save bool) *chunk {
 	// log.Printf("dBFindChunkFromFS %v\n", c)
 	// Create file name for this chunk
 	fn := DBChunkFileName(c)
@@ -303,71 +379,94 @@ func dBFindChunkFromFS(c chunkdb.CC) *chunk {
 	if err != nil {
 		// This chunk did not exist yet
 		// log.Printf("dBFindChunkFromFS: Chunk %s new, creating it\n", fn)
+		if !save {
+			return dBCreateChunk(c)
+		}
 		return dBCreateAndSaveChunk(c)
 	}
 	// Chunk found. Load it.
 	defer file.Close()
 	fi, err := file.Stat()
 	if err != nil {
-		log.Printf("dBFindChunkFromFS: Loading chunk %s failure: %s. Creating a new instead.\n", fn, err)
-		return dBCreateAndSaveChunk(c)
+		log.Printf("dBFindChunkFromFS: Loading chunk %s failure: %s\n", fn, err)
+		return dBUnreadableChunk(c)
 	}
 	// log.Printf("dBFindChunkFromFS: Found %s, size %d\n", fn, fi.Size)
 	return dBReadChunk(c, file, fi.Size())
 }
 
 var DBStats struct {
-	WorstRead time.Duration
-	NumRead   int
-	TotRead   time.Duration
+	sync.Mutex // Chunks can be read concurrently
+	WorstRead  time.Duration
+	NumRead    int
+	TotRead    time.Duration
 }
 
 func dBReadChunk(c chunkdb.CC, file io.Reader, size int64) *chunk {
 	start := time.Now()
 	b := make([]byte, size)
-	n, err := file.Read(b)
+	n, err := io.ReadFull(file, b)
 	if err != nil {
-		log.Printf("DBReadChunk: Loading chunk %v failure: %s. Creating a new instead.\n", c, err)
-		return dBCreateAndSaveChunk(c)
+		log.Printf("DBReadChunk: Loading chunk %v failure: %s (got %d of %d bytes)\n", c, err, n, size)
+		return dBUnreadableChunk(c)
 	}
-	if n != int(size) {
-		log.Printf("DBReadChunk: Loading chunk %v only got %d(%d) bytes. Creating a new.\n", c, n, size)
-		return dBCreateAndSaveChunk(c)
+	ch := dBDecodeChunk(c, b)
+	if ch == nil {
+		return dBUnreadableChunk(c)
 	}
+	delta := time.Now().Sub(start)
+	DBStats.Lock()
+	DBStats.NumRead++
+	DBStats.TotRead += delta
+	if delta > DBStats.WorstRead {
+		DBStats.WorstRead = delta
+	}
+	DBStats.Unlock()
+	return ch
+}
+
+// Decode the content of a chunk file. Return nil if it failed.
+func dBDecodeChunk(c chunkdb.CC, b []byte) *chunk {
 	var ok bool
 	ch := new(chunk)
 	ch.flag, b, ok = ParseUint32(b)
 	if !ok {
 		log.Printf("DBReadChunk: ParseUint32 flag failed\n")
-		return dBCreateAndSaveChunk(c)
+		return nil
 	}
 	ch.checkSum, b, ok = ParseUint32(b)
 	if !ok {
 		log.Printf("DBReadChunk: ParseUint32 checksum failed\n")
-		return dBCreateAndSaveChunk(c)
+		return nil
 	}
 	ch.owner, b, ok = ParseUint32(b)
 	if !ok {
 		log.Printf("DBReadChunk: ParseUint32 owner failed\n")
-		return dBCreateAndSaveChunk(c)
+		return nil
 	}
 	var pType TPartition
-	var pLength uint16
-	// If we are not converting old chunk files, then assume it is the "new" format.
-	_, b, ok = ParseUint32(b)
+	var version uint32
+	version, b, ok = ParseUint32(b)
 	if !ok {
-		log.Printf("DBReadChunk: ParseUint32 reserved1 failed\n")
-		return dBCreateAndSaveChunk(c)
+		log.Printf("DBReadChunk: ParseUint32 version failed\n")
+		return nil
+	}
+	if version == 0 {
+		version = CHUNK_FILE_V1 // Saved before the version was introduced
+	}
+	if version > CHUNK_FILE_VERSION {
+		log.Printf("DBReadChunk: chunk %v has unknown file version %d\n", c, version)
+		return nil
 	}
 	_, b, ok = ParseUint32(b)
 	if !ok {
 		log.Printf("DBReadChunk: ParseUint32 reserved2 failed\n")
-		return dBCreateAndSaveChunk(c)
+		return nil
 	}
 	_, b, ok = ParseUint32(b)
 	if !ok {
 		log.Printf("DBReadChunk: ParseUint32 reserved3 failed\n")
-		return dBCreateAndSaveChunk(c)
+		return nil
 	}
 
 	// Iterate through each partition
@@ -376,48 +475,75 @@ func dBReadChunk(c chunkdb.CC, file io.Reader, size int64) *chunk {
 		tmp, b, ok = ParseUint16(b)
 		if !ok {
 			log.Printf("DBReadChunk: ParseUint16 partition type failed\n")
-			return dBCreateAndSaveChunk(c)
+			return nil
 		}
 		pType = TPartition(tmp)
-		pLength, b, ok = ParseUint16(b)
+		var pLength uint32
+		if version == CHUNK_FILE_V1 {
+			tmp, b, ok = ParseUint16(b)
+			pLength = uint32(tmp)
+		} else {
+			pLength, b, ok = ParseUint32(b)
+		}
 		if !ok {
-			log.Printf("DBReadChunk: ParseUint16 partition length failed\n")
-			return dBCreateAndSaveChunk(c)
+			log.Printf("DBReadChunk: partition length failed\n")
+			return nil
 		}
-		if pLength > uint16(len(b)) {
+		if pLength > uint32(len(b)) {
 			log.Printf("DBReadChunk: bad partition type %d or partition length %d (%d)\n", pType, pLength, len(b))
-			return dBCreateAndSaveChunk(c)
+			return nil
 		}
 		switch pType {
 		case PART_COMP_CHUNK:
 			// TODO: The compressed chunk is the slice offset into the whole file. That means there are wasted bytes that will never
 			// be used, and not released until the chunk is released. However, doing a copy of the data is maybe expensive.
 			ch.ch_comp = b[0:pLength]
-			ch.rc = decompressChunk(ch.ch_comp)
+			ch.rc.Store(decompressChunk(ch.ch_comp))
 			ch.Coord = c // Must define the chunk coordinate before following trigger links.
-		case PART_TEXT_ACTIVATORS:
-			buffer := bytes.NewBuffer(b[0:pLength])
-			decoder := gob.NewDecoder(buffer)
-			err := decoder.Decode(&ch.triggerMsgs)
+		case PART_TEXT_ACTIVATORS, PART_TEXT_ACTIVATORS2:
+			var list []activator.Activator
+			var err error
+			if pType == PART_TEXT_ACTIVATORS {
+				list, err = activator.DecodeGob(b[0:pLength])
+			} else {
+				list, err = activator.Decode(b[0:pLength])
+			}
 			if err != nil {
 				log.Printf("DBReadChunk: decode failed %v (from %v)\n", err, b[0:pLength])
-				return dBCreateAndSaveChunk(c)
+				return nil
+			}
+			ch.triggerMsgs = make([]textMsgActivator, len(list))
+			for i, act := range list {
+				ch.triggerMsgs[i] = textMsgActivator{X: act.X, Y: act.Y, Z: act.Z, Message: act.Message}
 			}
 			// fmt.Printf("DBReadChunk ch(%v) activator messages: %v\n", ch.Coord, ch.triggerMsgs)
+		case PART_LIQUID_LEVELS:
+			levels := b[0:pLength]
+			if len(levels)%4 != 0 {
+				log.Printf("DBReadChunk: chunk %v bad liquid levels length %d\n", c, len(levels))
+				return nil
+			}
+			ch.liquidLevels = make(map[[3]uint8]uint8, len(levels)/4)
+			for i := 0; i < len(levels); i += 4 {
+				if levels[i] >= CHUNK_SIZE || levels[i+1] >= CHUNK_SIZE || levels[i+2] >= CHUNK_SIZE {
+					log.Printf("DBReadChunk: chunk %v bad liquid level position %v\n", c, levels[i:i+3])
+					return nil
+				}
+				ch.liquidLevels[[3]uint8{levels[i], levels[i+1], levels[i+2]}] = levels[i+3]
+			}
 		default:
-			log.Printf("DBReadChunk: bad partition type %d or partition length %d (%d)\n", pType, pLength, len(b))
-			return dBCreateAndSaveChunk(c)
+			if version == CHUNK_FILE_V1 {
+				log.Printf("DBReadChunk: bad partition type %d or partition length %d (%d)\n", pType, pLength, len(b))
+				return nil
+			}
+			// Saved by a newer version of the server. Skip it.
+			if *verboseFlag > 0 {
+				log.Printf("DBReadChunk: chunk %v skipping unknown partition type %d (%d bytes)\n", c, pType, pLength)
+			}
 		}
 		b = b[pLength:] // the next partition
 	}
 	ch.ComputeLinks() // No lock needed yet as the chunk is not available anywhere else
-	ch.touched = true // Prevent this chunk from being discarded too soon
-	delta := time.Now().Sub(start)
-	DBStats.NumRead++
-	DBStats.TotRead += delta
-	if delta > DBStats.WorstRead {
-		DBStats.WorstRead = delta
-	}
 	return ch
 }
 
@@ -428,17 +554,57 @@ func dBReadChunk(c chunkdb.CC, file io.Reader, size int64) *chunk {
 func (ch *chunk) compressAndChecksum() {
 	// TODO: It is important that the compression algorithm does not waste too much memory,
 	// But it must still be quick.
+	ch.ch_comp, _ = compressBlocks(ch.raw(), false)
+	ch.checkSum = crc32.ChecksumIEEE(ch.ch_comp)
+	ch.ch_comp2 = nil // Created again when needed
+	ch.lightsKnown = false
+}
+
+// Compress the blocks of a chunk. If 'hide' is true, hidden blocks are replaced by air. Return true
+// if any block was replaced.
+func compressBlocks(rc *raw_chunk, hide bool) ([]byte, bool) {
 	buff := DynamicBuffer.MakeCompressedBuffer(CHUNK_VOL / 100) // A rough guess for a size
+	replaced := false
 	// Fill this byte array with data
 	for x := uint(0); x < CHUNK_SIZE; x++ {
 		for y := uint(0); y < CHUNK_SIZE; y++ {
 			for z := uint(0); z < CHUNK_SIZE; z++ {
-				buff.Add(byte(ch.rc[x][y][z]))
+				bl := rc[x][y][z]
+				if hide && blockTypes[bl].hidden {
+					bl = BT_Air
+					replaced = true
+				}
+				buff.Add(byte(bl))
 			}
 		}
 	}
-	ch.ch_comp = buff.Bytes()
-	ch.checkSum = crc32.ChecksumIEEE(ch.ch_comp)
+	return buff.Bytes(), replaced
+}
+
+// Get the compressed chunk, and the checksum, that shall be sent to player 'up'. Players that don't
+// own the chunk get a copy where the hidden blocks, like triggers, are replaced by air.
+func (cp *chunk) ClientData_WLc(up *user) ([]byte, uint32) {
+	cp.RLock()
+	if cp.showHidden(up) {
+		defer cp.RUnlock()
+		return cp.ch_comp, cp.checkSum
+	}
+	if cp.ch_comp2 != nil {
+		defer cp.RUnlock()
+		return cp.ch_comp2, cp.checkSum2
+	}
+	cp.RUnlock()
+	cp.Lock()
+	defer cp.Unlock()
+	if cp.ch_comp2 == nil {
+		comp, replaced := compressBlocks(cp.raw(), true)
+		if replaced {
+			cp.ch_comp2, cp.checkSum2 = comp, crc32.ChecksumIEEE(comp)
+		} else {
+			cp.ch_comp2, cp.checkSum2 = cp.ch_comp, cp.checkSum // Nothing hidden, use the same data
+		}
+	}
+	return cp.ch_comp2, cp.checkSum2
 }
 
 func decompressChunk(ch []byte) *raw_chunk {
@@ -460,6 +626,21 @@ func decompressChunk(ch []byte) *raw_chunk {
 	return rc
 }
 
+// Get the raw chunk, decompressing it again if it was released to save memory. The content
+// of ch_comp always match the raw chunk, so it can be rebuilt at any time. The pointer is
+// set atomically, a copy can be used without a lock.
+func (cp *chunk) raw() *raw_chunk {
+	if rc := cp.rc.Load(); rc != nil {
+		return rc
+	}
+	rc := decompressChunk(cp.ch_comp)
+	if !cp.rc.CompareAndSwap(nil, rc) {
+		return cp.rc.Load() // Someone else rebuilt it at the same time
+	}
+	atomic.AddInt64(&CacheStats.RawRebuilt, 1)
+	return rc
+}
+
 // Find the block type at a given user coordinate. This is a speed critical function, it is used very frequently.
 func DBGetBlock_WLwWLc(uc user_coord) block {
 	cc := uc.GetChunkCoord()
@@ -467,7 +648,7 @@ func DBGetBlock_WLwWLc(uc user_coord) block {
 	x_off := int32(math.Floor(uc.X)) - cc.X*CHUNK_SIZE
 	y_off := int32(math.Floor(uc.Y)) - cc.Y*CHUNK_SIZE
 	z_off := int32(math.Floor(uc.Z)) - cc.Z*CHUNK_SIZE
-	rc := cp.rc
+	rc := cp.raw()
 	return rc[x_off][y_off][z_off]
 }
 
@@ -483,6 +664,7 @@ func ChunkFindCached_WLwWLc(cc chunkdb.CC) *chunk {
 		cp = ChunkFind_WLwWLc(cc)
 		dbGetBlockLastChunk = cp
 	} else {
+		cp.touch() // It wasn't found through the cache
 		if cp.jellyBlocks != nil {
 			// There may be jelly blocks that should be restored
 			cp.Lock()
@@ -502,7 +684,7 @@ func DBGetBlockCached_WLwWLc(uc user_coord) block {
 	x_off := int32(math.Floor(uc.X)) - cc.X*CHUNK_SIZE
 	y_off := int32(math.Floor(uc.Y)) - cc.Y*CHUNK_SIZE
 	z_off := int32(math.Floor(uc.Z)) - cc.Z*CHUNK_SIZE
-	rc := cp.rc
+	rc := cp.raw()
 	dbGetBlockLastChunk = cp // Save this chunk pointer for next
 	return rc[x_off][y_off][z_off]
 }
@@ -511,43 +693,116 @@ func DBGetBlockCached_WLwWLc(uc user_coord) block {
 // Return true if successful.
 // The update of the chunk should possibly be done by a worldDB process.
 func (cp *chunk) UpdateBlock_WLcWLw(x_off, y_off, z_off uint8, blType block) bool {
+	_, ok := cp.ReplaceBlock_WLcWLw(x_off, y_off, z_off, blType)
+	return ok
+}
+
+// The same as UpdateBlock_WLcWLw, but also return the block that was there before.
+func (cp *chunk) ReplaceBlock_WLcWLw(x_off, y_off, z_off uint8, blType block) (block, bool) {
 	cp.Lock()
 	defer cp.Unlock()
 	if cp.jellyBlocks != nil {
 		cp.RestoreJellyBlocks(true)
 	}
-	rc := cp.rc
-	if rc[x_off][y_off][z_off] != BT_Air && blType != BT_Air {
+	rc := cp.raw()
+	old := rc[x_off][y_off][z_off]
+	if old != BT_Air && blType != BT_Air {
 		// Non fatal problem, a client maybe tried twice.
 		log.Printf("UpdateBlock (%d,%d,%d) chunk %v had type %d already\n", x_off, y_off, z_off, cp.Coord, blType)
-		return false
+		return old, false
 	}
 
 	rc[x_off][y_off][z_off] = blType
+	cp.scheduleLiquids(x_off, y_off, z_off, blType)
 	cp.compressAndChecksum() // Create the compressed copy
 	cp.flag |= CHF_MODIFIED
-	// Save it permanently. TODO: Use delayed write to improve performance.
-	// However, a delayed compress can't be used as that would delay the
-	// checksum, which must be updated before this function is ended.
+	// Save it permanently, but delayed. A delayed compress can't be used as that would
+	// delay the checksum, which must be updated before this function is ended.
 	if !*inhibitCreateChunks {
-		cp.Write()
+		cp.WriteDelayed()
 	}
 	cp.ComputeLinks()
-	return true
+	return old, true
+}
+
+// A change of a block, that is only done if the block is still 'old'.
+type blockChange struct {
+	blockUpdate
+	old   block
+	level uint8 // The level, for flowing liquid. 0 for other blocks, and for liquid sources.
+}
+
+// Change blocks in the chunk, for changes that are not done by players. Changes of blocks that are no longer
+// the expected type are skipped. The changes that were done are sent to near players, and the number
+// of them is returned. If 'save' is false, the chunk is not marked as modified, and the changes are lost
+// when the chunk is thrown away from the cache.
+func (cp *chunk) ChangeBlocks_WLcRLq(list []blockChange, save bool) int {
+	cp.Lock()
+	rc := cp.raw()
+	var changed []blockUpdate
+	for _, c := range list {
+		// Jelly blocks have to be restored first, they are not changed.
+		if rc[c.x][c.y][c.z] != c.old || cp.blockAt(c.x, c.y, c.z) != c.old {
+			continue
+		}
+		rc[c.x][c.y][c.z] = c.bl
+		cp.scheduleLiquids(c.x, c.y, c.z, c.bl)
+		if c.level > 0 {
+			if cp.liquidLevels == nil {
+				cp.liquidLevels = make(map[[3]uint8]uint8)
+			}
+			cp.liquidLevels[[3]uint8{c.x, c.y, c.z}] = c.level
+		}
+		changed = append(changed, c.blockUpdate)
+	}
+	if len(changed) > 0 {
+		cp.compressAndChecksum()
+		if save {
+			cp.flag |= CHF_MODIFIED
+			if !*inhibitCreateChunks {
+				cp.WriteDelayed()
+			}
+		}
+	}
+	cp.Unlock()
+	if len(changed) > 0 {
+		cc := cp.Coord
+		center := user_coord{float64(cc.X)*CHUNK_SIZE + CHUNK_SIZE/2, float64(cc.Y)*CHUNK_SIZE + CHUNK_SIZE/2, float64(cc.Z)*CHUNK_SIZE + CHUNK_SIZE/2}
+		center.CallNearPlayers_RLq(func(up *user) { up.SendMessageBlockUpdates(cc, changed) }, nil)
+	}
+	return len(changed)
+}
+
+// Get a block in the chunk. A jelly block gives the original block.
+func (cp *chunk) GetBlock_WLc(x, y, z uint8) block {
+	cp.RLock()
+	defer cp.RUnlock()
+	return cp.blockAt(x, y, z)
+}
+
+// The same as GetBlock_WLc, but the chunk must be locked.
+func (cp *chunk) blockAt(x, y, z uint8) block {
+	for _, jb := range cp.jellyBlocks {
+		if jb.x == x && jb.y == y && jb.z == z {
+			return jb.original
+		}
+	}
+	return cp.raw()[x][y][z]
 }
 
 // Turn one block to jelly (transparent and permeable), and set the timer for he it shall be
 // reverted.
 // The chunk must be write locked.
 func (cp *chunk) TurnToJelly(x, y, z uint8, timeout time.Time) {
-	orig := cp.rc[x][y][z]
+	rc := cp.raw()
+	orig := rc[x][y][z]
 	if orig == BT_Air {
 		log.Println("Tried to make jelly of air at", cp.Coord, x, y, z)
 		return
 	}
 	jb := jellyBlock{x: x, y: y, z: z, original: orig, timeOut: timeout}
 	cp.jellyBlocks = append(cp.jellyBlocks, jb)
-	cp.rc[x][y][z] = BT_Air
+	rc[x][y][z] = BT_Air
 }
 
 // Look at the list of all jelly blocks and revert those that have timed out.
@@ -556,11 +811,12 @@ func (cp *chunk) RestoreJellyBlocks(unconditionally bool) {
 	remain := 0 // Index of the first jelly block that shall remain in the list
 	now := time.Now()
 	jb := cp.jellyBlocks
+	rc := cp.raw()
 	for i, j := range jb {
 		if j.timeOut.After(now) && !unconditionally {
 			break
 		}
-		cp.rc[j.x][j.y][j.z] = j.original
+		rc[j.x][j.y][j.z] = j.original
 		remain = i + 1
 	}
 	jb = jb[remain:] // Remove all jelly blocks that have timed out.
@@ -574,98 +830,26 @@ func (cp *chunk) RestoreJellyBlocks(unconditionally bool) {
 	cp.jellyBlocks = jb
 }
 
-// Investigate if the player coord "c" is a valid place to spawn at. The 'height' is
-// measured in blocks.
-func ValidSpawnPoint_WLwWLc(c user_coord, height float64) bool {
+// Investigate if the coord "c" is a valid place to spawn a body at.
+func ValidSpawnPoint_WLwWLc(c user_coord, body bodySize) bool {
 	if c.Z < 0 {
 		// Too low
 		return false
 	}
 	// There must be stable ground below on the block below the feet
-	if blockIsPermeable[DBGetBlockCached_WLwWLc(user_coord{c.X, c.Y, c.Z - 1})] {
+	if !DBGetBlockCached_WLwWLc(user_coord{c.X, c.Y, c.Z - 1}).Solid() {
 		return false
 	}
 	// Check that there is empty space available above
-	for i := float64(0); i < height; i++ {
-		if !blockIsPermeable[DBGetBlockCached_WLwWLc(user_coord{c.X, c.Y, c.Z + i})] {
-			return false
-		}
-	}
-	return true
+	return body.Fits_WLwWLc(c)
 }
 
-var (
-	// The purpose of these arrauys is to quickly be able to determine properties of blocks
-	blockIsInvisible [256]bool // These will not be shown normally
-	blockIsPermeable [256]bool // You can walk through these blocks
-)
-
-func init() {
-	blockIsInvisible[BT_Air] = true
-	blockIsInvisible[BT_DeTrigger] = true
-	blockIsInvisible[BT_Spawn] = true
-	blockIsInvisible[BT_Link] = true
-	blockIsInvisible[BT_Trigger] = true
-	blockIsInvisible[BT_Text] = true
-	blockIsInvisible[BT_SmallFog] = true
-	blockIsInvisible[BT_BigFog] = true
-	blockIsInvisible[BT_RedLight] = true
-	blockIsInvisible[BT_GreenLight] = true
-	blockIsInvisible[BT_BlueLight] = true
-
-	blockIsPermeable[BT_Air] = true
-	blockIsPermeable[BT_DeTrigger] = true
-	blockIsPermeable[BT_Spawn] = true
-	blockIsPermeable[BT_Link] = true
-	blockIsPermeable[BT_Trigger] = true
-	blockIsPermeable[BT_Text] = true
-	blockIsPermeable[BT_Water] = true
-	blockIsPermeable[BT_BrownWater] = true
-	blockIsPermeable[BT_Tree1] = true
-	blockIsPermeable[BT_Tree2] = true
-	blockIsPermeable[BT_Tree3] = true
-	blockIsPermeable[BT_Flowers] = true
-	blockIsPermeable[BT_Tuft] = true
-	blockIsPermeable[BT_SmallFog] = true
-	blockIsPermeable[BT_BigFog] = true
-	blockIsPermeable[BT_Treasure] = true
-	blockIsPermeable[BT_Quest] = true
-	blockIsPermeable[BT_Lamp1] = true
-	blockIsPermeable[BT_Lamp2] = true
-	blockIsPermeable[BT_RedLight] = true
-	blockIsPermeable[BT_GreenLight] = true
-	blockIsPermeable[BT_BlueLight] = true
-}
-
-// Update the Z position of an object, taking into account ground level and z speed. The argument is updated,
+// Update the Z position of a body, taking into account ground level, roofs and z speed. The argument is updated,
 // and the new z speed is returned.
-// TODO: This algorihm can be optimized
-func UpdateZPos_WLwWLc(deltaTime time.Duration, ZSpeed float64, coord *user_coord) (newZSpeed float64) {
+func UpdateZPos_WLwWLc(deltaTime time.Duration, ZSpeed float64, coord *user_coord, body bodySize) (newZSpeed float64) {
 	newZSpeed = ZSpeed - float64(deltaTime)*GRAVITY/1e9 // Accelerate downwards
-	if newZSpeed > 0 {
-		// TODO: Do not allow jumping through the roof of a tunnel
-		coord.Z += newZSpeed
-	} else if newZSpeed < 0 {
-		// Falling downwards. If moving more than one block, be careful not to fall through a block.
-		zspeed := -newZSpeed                 // The downward speed, which is now a value bigger than 0
-		start := zspeed - math.Floor(zspeed) // Get the decimals
-		var ok float64 = 0                   // The eventual allowance to fall downward, limited from zspeed
-		testCoord := *coord
-		// Test for presence of ground every block, until player has been moved according to
-		// the current downward speed.
-		for d := start; d <= zspeed; d += 1 {
-			testCoord.Z = coord.Z - d
-			// fmt.Printf("Check d %d, z %d\n", d, testCoord.z)
-			if !blockIsPermeable[DBGetBlockCached_WLwWLc(testCoord)] {
-				// Stop the fall, move player to above ground.
-				ok = coord.Z - math.Floor(testCoord.Z) - 1
-				newZSpeed = 0
-				// fmt.Printf("Ground, ok = %d, coord.Z = %d, round = %d\n", ok, coord.Z,
-				break
-			}
-			ok = d
-		}
-		coord.Z -= ok
+	if body.MoveVert_WLwWLc(coord, newZSpeed) {
+		newZSpeed = 0 // Stopped by the ground, or a roof
 	}
 	return
 }
@@ -714,3 +898,16 @@ func (cp *chunk) SetTeleport(cc chunkdb.CC, up *user, x, y, z uint8) {
 	}
 	up.Coord.CallNearPlayers_RLq(f, nil)
 }
+
+// The content of a chunk was replaced. Send the new chunk to all players near it. If 'teleport' is true,
+// the super chunk is also sent, as the teleport was changed.
+func ResendChunkToNearPlayers_RLq(cc chunkdb.CC, teleport bool) {
+	center := user_coord{X: float64(cc.X*CHUNK_SIZE + CHUNK_SIZE/2), Y: float64(cc.Y*CHUNK_SIZE + CHUNK_SIZE/2), Z: float64(cc.Z*CHUNK_SIZE + CHUNK_SIZE/2)}
+	f := func(up *user) {
+		up.CmdReadChunk_WLwWLcBl(cc)
+		if teleport {
+			up.SuperChunkAnswer_Bl(&cc)
+		}
+	}
+	center.CallNearPlayers_RLq(f, nil)
+}
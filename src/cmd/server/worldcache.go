@@ -18,59 +18,157 @@
 package main
 
 //
-// All chunks loaded in memory are managed by a hash table to make them quick and
-// easy to find.
-// TODO: A mechanism is needed to throw away chunks when there are too many
+// All chunks loaded in memory are managed by a cache to make them quick and easy to find.
+// The cache is divided into shards, each with its own lock, so that lookups of different
+// chunks seldom block each other. Every chunk has a time stamp of when it was last used.
+// When the estimated memory use of all chunks is above the budget, the least recently
+// used chunks are thrown away. Chunks that haven't been used for a long time are also
+// thrown away.
+//
+// The cache is checked a few shards at a time, so that every check is quick also with a big cache.
+// Every shard gets an equal part of the budget.
+//
+// Before throwing away chunks, the uncompressed copy of the least recently used chunks is
+// released. It is the biggest part of a chunk, and it is decompressed again when needed. This
+// is also done for chunks that haven't been used for a while, even if the budget isn't used up.
+//
+// Chunks that are not in the cache are loaded, or created, without holding the lock of the shard.
+// If several processes need the same chunk at the same time, only the first one will load it and
+// the others wait for it. The number of chunks loaded at the same time is limited.
 //
 
 import (
-	// "fmt"
 	"chunkdb"
 	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"sort"
+	"sync/atomic"
+	"time"
+	"timerstats"
 )
 
 const (
-	WORLD_CACHE_SIZE = 32767 // An even number, like 1000, doesn't work good with the random number
+	worldCacheShards = 64 // Should be a power of two
 )
 
+type cacheShard struct {
+	sync.RWMutex
+	chunks   map[chunkdb.CC]*chunk
+	loading  map[chunkdb.CC]*chunkLoad // Chunks currently being loaded
+	memUsed  int64                     // Estimated memory used, from the last purge of the shard. Updated atomically.
+	rawSaved int64                     // Memory saved by released uncompressed chunks, from the last purge of the shard
+}
+
+// A chunk that is being loaded. The channel is closed when the chunk is available.
+type chunkLoad struct {
+	done chan struct{}
+	cp   *chunk
+}
+
 var (
-	world_cache                [WORLD_CACHE_SIZE]*chunk
-	worldCacheLock             sync.RWMutex
-	cache_average_search_depth float32 // Keep track of how much searching is needed
-	worldCacheNumChunks        int
+	worldCache [worldCacheShards]cacheShard
+
+	worldCacheBudget = int64(CnfgCacheMemory) // Max number of bytes used by chunks in the cache
+
+	chunkLoaders = make(chan struct{}, CnfgChunkLoaders) // Limits the number of chunks loaded at the same time
+
+	// Statistics, updated atomically
+	CacheStats struct {
+		Hits, Misses, Evictions int64
+		Waits                   int64 // Number of times waiting for a chunk loaded by someone else
+		MemUsed                 int64 // Estimated memory used, from the last purge of every shard
+		RawReleased, RawRebuilt int64 // Number of times the uncompressed chunk was released and rebuilt
+		RawSaved                int64 // Memory saved by released uncompressed chunks, from the last purge of every shard
+	}
 )
 
-const cache_depth_decay = 0.99
+func init() {
+	for i := range worldCache {
+		worldCache[i].chunks = make(map[chunkdb.CC]*chunk)
+		worldCache[i].loading = make(map[chunkdb.CC]*chunkLoad)
+	}
+}
 
-func chunkFindHash(coord chunkdb.CC) uint {
+// Get the shard a chunk belongs to.
+func cacheShardOf(coord chunkdb.CC) *cacheShard {
 	hash := uint(coord.X)*871 + uint(coord.Y)*988261 + uint(coord.Z)*79261
-	return hash % WORLD_CACHE_SIZE
+	return &worldCache[hash%worldCacheShards]
 }
 
-// Find the chunk, if it exists. Otherwise, return nil. There is already a lock in place for the cache.
-func chunkFindRO(coord chunkdb.CC) *chunk {
-	ind := chunkFindHash(coord)
-	var pc *chunk
-	var n int
-	for pc = world_cache[ind]; pc != nil; pc = pc.next {
-		n++ // Number of searches
-		if pc.Coord.X == coord.X && pc.Coord.Y == coord.Y && pc.Coord.Z == coord.Z {
-			pc.touched = true
-			break
-		}
+// Mark the chunk as used now.
+func (cp *chunk) touch() {
+	atomic.StoreInt64(&cp.lastUsed, time.Now().UnixNano())
+}
+
+// Estimate the memory used by a chunk. The chunk must be locked.
+func (cp *chunk) memSize() int64 {
+	size := int64(200 + len(cp.ch_comp) + len(cp.ch_comp2)) // Add some for the struct
+	if cp.rc.Load() != nil {
+		size += CHUNK_VOL
+	}
+	return size
+}
+
+// Release the uncompressed copy of the chunk, unless it is used by someone. Return true if it was released.
+// It is kept if there are jelly blocks, as these are not included in the compressed copy.
+func (cp *chunk) releaseRaw(lastUsed int64) bool {
+	cp.Lock()
+	defer cp.Unlock()
+	if cp.rc.Load() == nil || cp.jellyBlocks != nil || atomic.LoadInt64(&cp.lastUsed) != lastUsed {
+		return false
+	}
+	cp.rc.Store(nil)
+	return true
+}
+
+// Find the chunk, if it exists. Otherwise, return nil. The shard must be locked.
+func (shard *cacheShard) find(coord chunkdb.CC) *chunk {
+	pc := shard.chunks[coord]
+	if pc != nil {
+		pc.touch()
 	}
-	cache_average_search_depth = cache_depth_decay*cache_average_search_depth + (1-cache_depth_decay)*float32(n)
 	return pc
 }
 
+// Find the chunk if it is loaded. Otherwise, return nil.
+func ChunkFindLoaded_RLw(coord chunkdb.CC) *chunk {
+	shard := cacheShardOf(coord)
+	shard.RLock()
+	defer shard.RUnlock()
+	return shard.find(coord)
+}
+
+// Find the chunk, only for reading. It is not added to the cache, and a chunk that doesn't exist
+// is generated but not saved.
+func ChunkFindReadOnly_RLw(coord chunkdb.CC) *chunk {
+	if pc := ChunkFindLoaded_RLw(coord); pc != nil {
+		return pc
+	}
+	if pc := dirtyChunkFind(coord); pc != nil {
+		return pc // Purged from the cache, but not saved yet
+	}
+	return dBLoadChunkFromFS(coord, false)
+}
+
+// Get a block, if the chunk is loaded. The chunk is also returned, or nil if it isn't loaded.
+func GetLoadedBlock_RLwWLc(bc blockCoord) (block, *chunk) {
+	cc, x, y, z := bc.chunkOffset()
+	cp := ChunkFindLoaded_RLw(cc)
+	if cp == nil {
+		return BT_Unused, nil
+	}
+	return cp.GetBlock_WLc(x, y, z), cp
+}
+
 // Find the chunk. If it doesn't exist, create it.
 // This is a speed critical function.
 func ChunkFind_WLwWLc(coord chunkdb.CC) *chunk {
-	// Need a read lock on the cache, no changes will be done (yet). Assume the chunk is found, which is the normal case.
-	worldCacheLock.RLock()
-	pc := chunkFindRO(coord)
-	worldCacheLock.RUnlock()
+	shard := cacheShardOf(coord)
+	// Need a read lock on the shard, no changes will be done (yet). Assume the chunk is found, which is the normal case.
+	shard.RLock()
+	pc := shard.find(coord)
+	shard.RUnlock()
 	if pc != nil {
+		atomic.AddInt64(&CacheStats.Hits, 1)
 		if pc.jellyBlocks != nil {
 			// There may be jelly blocks that should be restored
 			pc.Lock()
@@ -81,39 +179,178 @@ func ChunkFind_WLwWLc(coord chunkdb.CC) *chunk {
 		return pc
 	}
 
-	// Now a write lock is needed to save the new chunk in the cache.
-	worldCacheLock.Lock()
+	// Now a write lock is needed to register the load of the chunk.
+	shard.Lock()
 	// Meanwhile, before the lock was created, the chunk may have been created by another process.
-	// It may look wasteful to call chunkFindRO again, but it only happens for new chunks.
-	pc = chunkFindRO(coord)
+	pc = shard.find(coord)
 	if pc != nil {
-		worldCacheLock.Unlock()
+		shard.Unlock()
+		atomic.AddInt64(&CacheStats.Hits, 1)
 		return pc
 	}
-	// Didn't find the chunk (again), get it from disk or create one.
-	pc = dBFindChunkFromFS(coord)
+	if load, ok := shard.loading[coord]; ok {
+		// Someone else is already loading it
+		shard.Unlock()
+		atomic.AddInt64(&CacheStats.Waits, 1)
+		<-load.done
+		return load.cp
+	}
+	load := &chunkLoad{done: make(chan struct{})}
+	shard.loading[coord] = load
+	shard.Unlock()
+	atomic.AddInt64(&CacheStats.Misses, 1)
 
-	AddChunkToHashTable(pc)
-	worldCacheLock.Unlock()
+	// Didn't find the chunk (again). It may have been purged from the cache while waiting
+	// to be saved, in which case the file isn't up to date. Otherwise, get it from disk or create one.
+	pc = dirtyChunkFind(coord)
+	if pc == nil {
+		chunkLoaders <- struct{}{}
+		pc = dBFindChunkFromFS(coord)
+		<-chunkLoaders
+	}
+
+	pc.touch()
+	shard.Lock()
+	shard.chunks[coord] = pc
+	delete(shard.loading, coord)
+	shard.Unlock()
+	load.cp = pc
+	close(load.done)
 
 	return pc
 }
 
-func AddChunkToHashTable(pc *chunk) {
-	ind := chunkFindHash(pc.Coord)
-	pc.next = world_cache[ind]
-	world_cache[ind] = pc // Insert the new pointer first
-	worldCacheNumChunks++
+// Add a chunk to the cache, replacing any chunk with the same coordinate.
+func AddChunkToCache(pc *chunk) {
+	shard := cacheShardOf(pc.Coord)
+	pc.touch()
+	shard.Lock()
+	shard.chunks[pc.Coord] = pc
+	shard.Unlock()
 }
 
-func RemoveChunkFromHashTable(pc *chunk) {
-	ind := chunkFindHash(pc.Coord)
-	for ppc := &world_cache[ind]; *ppc != nil; ppc = &(*ppc).next {
-		if *ppc == pc {
-			*ppc = pc.next
-			pc.next = nil
-			worldCacheNumChunks--
-			return
+// The number of chunks in the cache
+func NumCachedChunks() int {
+	var n int
+	for i := range worldCache {
+		shard := &worldCache[i]
+		shard.RLock()
+		n += len(shard.chunks)
+		shard.RUnlock()
+	}
+	return n
+}
+
+type cacheEntry struct {
+	cp       *chunk
+	lastUsed int64
+	size     int64 // 0 when it has been removed
+	shard    int
+}
+
+type cacheEntryList []cacheEntry
+
+func (l cacheEntryList) Len() int           { return len(l) }
+func (l cacheEntryList) Less(i, j int) bool { return l[i].lastUsed < l[j].lastUsed }
+func (l cacheEntryList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Release uncompressed chunks and then remove chunks from the cache, the least recently used first,
+// until the memory used is within the budget. Chunks not used for 'rawIdle' are always released, and
+// chunks not used for 'maxIdle' are always removed. Return the number of removed chunks.
+// Modified chunks that are not yet saved can be removed, as they will be found by ChunkFind_WLwWLc
+// until they are saved.
+func purgeWorldCache(budget int64, rawIdle, maxIdle time.Duration) int {
+	return purgeCacheShards(0, worldCacheShards, budget, rawIdle, maxIdle)
+}
+
+// Purge 'num' shards, starting with 'first', using their part of the budget.
+func purgeCacheShards(first, num int, budget int64, rawIdle, maxIdle time.Duration) int {
+	budget = budget / worldCacheShards * int64(num)
+	// Take a copy of the list, to not hold the shard lock while the chunks are locked. Some
+	// functions lock a chunk and then look for a neighbor chunk.
+	var list cacheEntryList
+	for i := first; i < first+num; i++ {
+		shard := &worldCache[i%worldCacheShards]
+		shard.RLock()
+		for _, cp := range shard.chunks {
+			list = append(list, cacheEntry{cp: cp, lastUsed: atomic.LoadInt64(&cp.lastUsed), shard: i % worldCacheShards})
 		}
+		shard.RUnlock()
+	}
+	var total int64
+	for i := range list {
+		cp := list[i].cp
+		cp.RLock()
+		list[i].size = cp.memSize()
+		cp.RUnlock()
+		total += list[i].size
+	}
+	sort.Sort(list)
+
+	now := time.Now()
+	rawOldest := now.Add(-rawIdle).UnixNano()
+	var released int64
+	for i := range list {
+		e := &list[i]
+		if total <= budget && e.lastUsed > rawOldest {
+			break
+		}
+		if e.cp.releaseRaw(e.lastUsed) {
+			e.size -= CHUNK_VOL
+			total -= CHUNK_VOL
+			released++
+		}
+	}
+
+	oldest := now.Add(-maxIdle).UnixNano()
+	var removed int
+	for i := range list {
+		e := &list[i]
+		if total <= budget && e.lastUsed > oldest {
+			break
+		}
+		shard := &worldCache[e.shard]
+		shard.Lock()
+		// Don't remove it if it was used, or replaced, after the list was made.
+		if shard.chunks[e.cp.Coord] == e.cp && atomic.LoadInt64(&e.cp.lastUsed) == e.lastUsed {
+			delete(shard.chunks, e.cp.Coord)
+			total -= e.size
+			e.size = 0
+			removed++
+		}
+		shard.Unlock()
+	}
+
+	var mem, saved [worldCacheShards]int64
+	for _, e := range list {
+		mem[e.shard] += e.size
+		if e.size > 0 && e.cp.rc.Load() == nil {
+			saved[e.shard] += CHUNK_VOL
+		}
+	}
+	for i := first; i < first+num; i++ {
+		atomic.StoreInt64(&worldCache[i%worldCacheShards].memUsed, mem[i%worldCacheShards])
+		atomic.StoreInt64(&worldCache[i%worldCacheShards].rawSaved, saved[i%worldCacheShards])
+	}
+	var totMem, totSaved int64
+	for i := range worldCache {
+		totMem += atomic.LoadInt64(&worldCache[i].memUsed)
+		totSaved += atomic.LoadInt64(&worldCache[i].rawSaved)
+	}
+	atomic.StoreInt64(&CacheStats.MemUsed, totMem)
+	atomic.StoreInt64(&CacheStats.RawSaved, totSaved)
+	atomic.AddInt64(&CacheStats.RawReleased, released)
+	atomic.AddInt64(&CacheStats.Evictions, int64(removed))
+	return removed
+}
+
+func ProcPurgeOldChunks_WLw() {
+	var elapsed time.Duration
+	timerstats.Add("ProcPurgeOldChunks", CnfgCachePurgePeriod, &elapsed)
+	for next := 0; ; next = (next + CnfgCachePurgeShards) % worldCacheShards {
+		time.Sleep(CnfgCachePurgePeriod)
+		start := time.Now()
+		purgeCacheShards(next, CnfgCachePurgeShards, atomic.LoadInt64(&worldCacheBudget), CnfgRawChunkIdle, CnfgCacheMaxIdle)
+		elapsed = time.Now().Sub(start)
 	}
 }
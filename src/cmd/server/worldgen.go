@@ -0,0 +1,246 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// New chunks are created by a world generator. The generator is selected in the configuration file,
+// together with a seed and parameters for the terrain. The same generator, seed and parameters always
+// give the same world, regardless of the order the chunks are created in.
+//
+// Generators can create chunks in two phases. First the base terrain is generated, and then it is
+// decorated. The decoration of a chunk can look at the base terrain of the neighbor chunks, which makes
+// it possible to add things that are seamless over chunk borders. The base terrain of neighbor chunks
+// is generated when needed, and the last ones are saved as they are usually needed again soon.
+//
+
+import (
+	"chunkdb"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"sort"
+)
+
+// A WorldGenerator fills new chunks with content. It must only depend on the chunk coordinate
+// and the parameters, and it must be possible to call it from many processes at the same time.
+type WorldGenerator interface {
+	// Fill 'rc', which is all air, with the blocks of chunk 'cc'.
+	Generate(cc chunkdb.CC, rc *raw_chunk)
+}
+
+// A Decorator is a WorldGenerator with a second phase. Generate only creates the base terrain, and
+// Decorate adds the rest. It must only change blocks in 'rc', but it can read the base terrain of
+// other chunks.
+type Decorator interface {
+	WorldGenerator
+	// Decorate 'rc', which is the base terrain of chunk 'cc'.
+	Decorate(cc chunkdb.CC, rc *raw_chunk, base *baseTerrain)
+}
+
+// The parameters used by the world generators. Not all generators use all of them.
+type WorldParams struct {
+	Seed                int64   // Different seeds give different worlds. 0 is the original world, without structures and ores.
+	SoilLevel           float64 // No soil above this level
+	FloatingIslandsLim  float64 // No floating islands are created below this level
+	FloatingIslandsProb float64 // The density required for a floating island
+	CaveWidth           float64 // A bigger number will make cave tunnels wider
+	Structures          bool    // Add ruins, dungeons and villages, if the generator supports it
+	Ores                bool    // Add veins of ore, if the generator supports it
+}
+
+// The parameters used when nothing else is configured. This is the original world.
+func DefaultWorldParams() WorldParams {
+	return WorldParams{
+		SoilLevel:           WORLD_SOIL_LEVEL,
+		FloatingIslandsLim:  FLOATING_ISLANDS_LIM,
+		FloatingIslandsProb: FLOATING_ISLANDS_PROB,
+		CaveWidth:           CnfgCaveWidth,
+		Structures:          false,
+		Ores:                false,
+	}
+}
+
+var (
+	worldParams = DefaultWorldParams()
+
+	// All world generators, by the name used in the configuration file.
+	worldGenerators = map[string]func(WorldParams) WorldGenerator{
+		"simplex": newSimplexGenerator,
+		"flat":    newFlatGenerator,
+		"empty":   newEmptyGenerator,
+		"biome":   newBiomeGenerator,
+	}
+
+	worldGenName = "simplex"
+	worldGen     = newSimplexGenerator(worldParams) // The generator used for new chunks
+)
+
+// Select the world generator. Return false if there is no generator with that name.
+func SetWorldGenerator(name string, params WorldParams) bool {
+	f, ok := worldGenerators[name]
+	if !ok {
+		return false
+	}
+	worldParams = params
+	worldGenName = name
+	worldGen = f(params)
+	baseTerrainCache.Lock()
+	baseTerrainCache.chunks = nil // Not valid for the new generator
+	baseTerrainCache.order = nil
+	baseTerrainCache.Unlock()
+	return true
+}
+
+// The base terrain of the last chunks generated by the current world generator.
+var baseTerrainCache struct {
+	sync.Mutex
+	chunks map[chunkdb.CC]*raw_chunk
+	order  []chunkdb.CC // The oldest first
+}
+
+// Access to the base terrain of chunks, used when decorating a chunk.
+type baseTerrain struct {
+	gen    WorldGenerator
+	chunks map[chunkdb.CC]*raw_chunk // The chunks used by this decoration
+}
+
+// Get the base terrain of a chunk. It must not be modified.
+func (t *baseTerrain) chunk(cc chunkdb.CC) *raw_chunk {
+	if rc, ok := t.chunks[cc]; ok {
+		return rc
+	}
+	useCache := t.gen == worldGen
+	var rc *raw_chunk
+	if useCache {
+		baseTerrainCache.Lock()
+		rc = baseTerrainCache.chunks[cc]
+		baseTerrainCache.Unlock()
+	}
+	if rc == nil {
+		// Generate it without the lock. Another process may do the same, but the result is the same.
+		rc = newAirChunk()
+		t.gen.Generate(cc, rc)
+		if useCache {
+			addBaseTerrain(cc, rc)
+		}
+	}
+	t.chunks[cc] = rc
+	return rc
+}
+
+// Save the base terrain of a chunk, throwing away the oldest if there are too many.
+func addBaseTerrain(cc chunkdb.CC, rc *raw_chunk) {
+	baseTerrainCache.Lock()
+	defer baseTerrainCache.Unlock()
+	if baseTerrainCache.chunks == nil {
+		baseTerrainCache.chunks = make(map[chunkdb.CC]*raw_chunk)
+	}
+	if _, ok := baseTerrainCache.chunks[cc]; ok {
+		return
+	}
+	baseTerrainCache.chunks[cc] = rc
+	baseTerrainCache.order = append(baseTerrainCache.order, cc)
+	if len(baseTerrainCache.order) > CnfgBaseTerrainCache {
+		delete(baseTerrainCache.chunks, baseTerrainCache.order[0])
+		baseTerrainCache.order = baseTerrainCache.order[1:]
+	}
+}
+
+// Get a block of the base terrain, relative to chunk 'cc'. The coordinates can be outside of the chunk,
+// in which case the neighbor chunk is used.
+func (t *baseTerrain) Block(cc chunkdb.CC, x, y, z int) block {
+	if x >= 0 && x < CHUNK_SIZE && y >= 0 && y < CHUNK_SIZE && z >= 0 && z < CHUNK_SIZE {
+		return t.chunk(cc)[x][y][z]
+	}
+	bc := blockCoord{int64(cc.X)*CHUNK_SIZE + int64(x), int64(cc.Y)*CHUNK_SIZE + int64(y), int64(cc.Z)*CHUNK_SIZE + int64(z)}
+	rc := t.chunk(bc.GetChunkCoord())
+	return rc[x&(CHUNK_SIZE-1)][y&(CHUNK_SIZE-1)][z&(CHUNK_SIZE-1)]
+}
+
+// A chunk with only air.
+func newAirChunk() *raw_chunk {
+	rc := new(raw_chunk)
+	for x := 0; x < CHUNK_SIZE; x++ {
+		for y := 0; y < CHUNK_SIZE; y++ {
+			for z := 0; z < CHUNK_SIZE; z++ {
+				rc[x][y][z] = BT_Air
+			}
+		}
+	}
+	return rc
+}
+
+// Generate the content of a chunk with a generator, in one or two phases.
+func generateChunk(gen WorldGenerator, cc chunkdb.CC) *raw_chunk {
+	d, ok := gen.(Decorator)
+	if !ok {
+		rc := newAirChunk()
+		gen.Generate(cc, rc)
+		return rc
+	}
+	base := &baseTerrain{gen: gen, chunks: make(map[chunkdb.CC]*raw_chunk)}
+	rc := new(raw_chunk)
+	*rc = *base.chunk(cc)
+	d.Decorate(cc, rc, base)
+	return rc
+}
+
+// The names of all world generators, sorted.
+func WorldGeneratorNames() []string {
+	var names []string
+	for name := range worldGenerators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A flat world, suitable for building. The ground is soil at level 0, with stone below.
+type flatGenerator struct{}
+
+func newFlatGenerator(params WorldParams) WorldGenerator {
+	return flatGenerator{}
+}
+
+func (flatGenerator) Generate(cc chunkdb.CC, rc *raw_chunk) {
+	const soilDepth = 4
+	z1 := int(cc.Z * CHUNK_SIZE)
+	for z := 0; z < CHUNK_SIZE; z++ {
+		var bl block
+		switch zf := z + z1; {
+		case zf > 0:
+			continue
+		case zf > -soilDepth:
+			bl = BT_Soil
+		default:
+			bl = BT_Stone
+		}
+		for x := 0; x < CHUNK_SIZE; x++ {
+			for y := 0; y < CHUNK_SIZE; y++ {
+				rc[x][y][z] = bl
+			}
+		}
+	}
+}
+
+// A world with nothing but air.
+type emptyGenerator struct{}
+
+func newEmptyGenerator(params WorldParams) WorldGenerator {
+	return emptyGenerator{}
+}
+
+func (emptyGenerator) Generate(cc chunkdb.CC, rc *raw_chunk) {}
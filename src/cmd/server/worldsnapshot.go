@@ -0,0 +1,112 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Take snapshots of the world while it is running. A snapshot contains all chunk files,
+// all super chunk files, and the database collections with avatars (including the scores)
+// and counters. Use the "restore" command to get the world back from a snapshot.
+//
+
+import (
+	"ephenationdb"
+	"log"
+	"os"
+	"score"
+	"snapshot"
+	"time"
+)
+
+// The collections that are saved in a snapshot
+var snapshotCollections = []string{"avatars", "counters"}
+
+// Take a snapshot of the world, and save it in the snapshot folder.
+// Return the file name of the snapshot.
+func TakeSnapshot() (string, error) {
+	// Make sure all players and scores are up to date in the database.
+	if n := SaveAllPlayersNow_RLaWLu(); n > 0 {
+		log.Printf("Snapshot: %d players saved\n", n)
+	}
+	score.Flush()
+
+	start := time.Now()
+	fn := snapshot.FileName(CnfgSnapshotFolder, start)
+	w, err := snapshot.Create(fn)
+	if err != nil {
+		return "", err
+	}
+
+	// No chunks or super chunks are saved while the files are copied, to make the snapshot consistent.
+	// Chunk files are always replaced, never changed, so hard links can be used for them. Super chunk
+	// files are copied. The archive is then made from the copies, while the server continues.
+	chunkCopy := CnfgChunkFolder + ".snapshot"
+	var superFolder, superCopy string
+	var numChunks, numSuper int
+	chunkFlushLock.Lock()
+	flushDirtyChunks()
+	numChunks, err = snapshot.CopyFolder(CnfgChunkFolder, chunkCopy, true)
+	if err == nil {
+		err = superChunkManager.Freeze(func(folder string) (err error) {
+			superFolder, superCopy = folder, folder+".snapshot"
+			numSuper, err = snapshot.CopyFolder(folder, superCopy, false)
+			return
+		})
+	}
+	chunkFlushLock.Unlock()
+	log.Printf("Snapshot: %d chunks, %d super chunks copied in %v\n", numChunks, numSuper, time.Now().Sub(start))
+	defer os.RemoveAll(chunkCopy)
+	if superCopy != "" {
+		defer os.RemoveAll(superCopy)
+	}
+
+	if err == nil {
+		_, err = w.AddFolderAs(chunkCopy, CnfgChunkFolder)
+	}
+	if err == nil {
+		_, err = w.AddFolderAs(superCopy, superFolder)
+	}
+	if err == nil {
+		err = addSnapshotCollections(w)
+	}
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		log.Println("Snapshot", fn, "failed:", err)
+		return "", err
+	}
+	log.Printf("Snapshot %s: %d chunks, %d super chunks in %v\n", fn, numChunks, numSuper, time.Now().Sub(start))
+	return fn, nil
+}
+
+// Add the database collections to the snapshot.
+func addSnapshotCollections(w *snapshot.Writer) error {
+	db := ephenationdb.New()
+	if db == nil {
+		log.Println("Snapshot: No database connection, avatars not saved")
+		return nil
+	}
+	for _, name := range snapshotCollections {
+		n, err := w.AddCollection(db.C(name))
+		if err != nil {
+			return err
+		}
+		log.Printf("Snapshot: %d documents from %s\n", n, name)
+	}
+	return nil
+}
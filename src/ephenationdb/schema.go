@@ -0,0 +1,56 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package ephenationdb
+
+//
+// Every avatar document has a schema version. Documents are updated to a new version by
+// migrations, in cmd/database. A document without a version has version 0.
+//
+
+import (
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	SchemaVersion      = 2               // The version of avatar documents created and understood by this code
+	SchemaVersionField = "schemaversion" // The name of the field in the avatar documents
+)
+
+// A query for all avatar documents with a version older than 'version'.
+func OlderThan(version int) bson.M {
+	return bson.M{"$or": []bson.M{
+		{SchemaVersionField: bson.M{"$lt": version}},
+		{SchemaVersionField: bson.M{"$exists": false}},
+	}}
+}
+
+// Verify that there are no avatar documents that are newer than this code understands.
+// Return the number of documents that are older, and need to be migrated.
+func CheckSchemaVersion(db *mgo.Database) (int, error) {
+	c := db.C("avatars")
+	newer, err := c.Find(bson.M{SchemaVersionField: bson.M{"$gt": SchemaVersion}}).Count()
+	if err != nil {
+		return 0, err
+	}
+	if newer > 0 {
+		return 0, fmt.Errorf("%d avatars have a schema version newer than %d", newer, SchemaVersion)
+	}
+	return c.Find(OlderThan(SchemaVersion)).Count()
+}
@@ -0,0 +1,238 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package schematic
+
+//
+// A schematic is a box shaped region of the world, saved in a self contained file. It is used
+// to move creations between servers. All positions are in blocks, relative to the lower corner
+// of the region.
+//
+// The file is compressed with gzip. All integers are unsigned, stored LSB first.
+//
+//	[8]byte  Magic "EPHSCHEM"
+//	uint32   Format version, currently 1
+//	uint32   Size of the region in X, Y and Z
+//	[]byte   One block type for every block, Z changing fastest, then Y, then X
+//	uint32   Number of text activators
+//	For every activator:
+//	  uint32  X, Y, Z position of the BT_Text block
+//	  uint32  Number of lines in the message
+//	  For every line:
+//	    uint32  Length of the line, in bytes
+//	    []byte  The line
+//	uint32   Number of teleports
+//	For every teleport:
+//	  uint32  X, Y, Z position of the teleport
+//
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	magic   = "EPHSCHEM"
+	Version = 1 // The format version used when saving
+
+	MaxVolume = 1 << 28           // Limit the size of a region, to protect against bad files
+	MaxData   = MaxVolume + 1<<24 // Limit the size of the uncompressed file
+)
+
+type Pos struct {
+	X, Y, Z uint32
+}
+
+// A text activator and the message it generates
+type Activator struct {
+	Pos
+	Message []string
+}
+
+type Schematic struct {
+	SizeX, SizeY, SizeZ uint32
+	Blocks              []uint8 // Use Get and Set to access the blocks
+	Activators          []Activator
+	Teleports           []Pos
+}
+
+// Create an empty schematic of the given size, in blocks.
+func New(sizeX, sizeY, sizeZ uint32) (*Schematic, error) {
+	vol := uint64(sizeX) * uint64(sizeY) * uint64(sizeZ)
+	if vol == 0 || vol > MaxVolume {
+		return nil, fmt.Errorf("schematic: bad size %dx%dx%d", sizeX, sizeY, sizeZ)
+	}
+	return &Schematic{SizeX: sizeX, SizeY: sizeY, SizeZ: sizeZ, Blocks: make([]uint8, vol)}, nil
+}
+
+func (s *Schematic) index(x, y, z uint32) int {
+	return int((x*s.SizeY+y)*s.SizeZ + z)
+}
+
+func (s *Schematic) Get(x, y, z uint32) uint8 {
+	return s.Blocks[s.index(x, y, z)]
+}
+
+func (s *Schematic) Set(x, y, z uint32, bl uint8) {
+	s.Blocks[s.index(x, y, z)] = bl
+}
+
+// Test if a position is inside the region
+func (s *Schematic) Inside(p Pos) bool {
+	return p.X < s.SizeX && p.Y < s.SizeY && p.Z < s.SizeZ
+}
+
+type writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *writer) uint32(v uint32) {
+	w.bytes([]byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)})
+}
+
+func (w *writer) bytes(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+func (w *writer) pos(p Pos) {
+	w.uint32(p.X)
+	w.uint32(p.Y)
+	w.uint32(p.Z)
+}
+
+// Save the schematic
+func (s *Schematic) Write(out io.Writer) error {
+	gz := gzip.NewWriter(out)
+	w := &writer{w: bufio.NewWriter(gz)}
+	w.bytes([]byte(magic))
+	w.uint32(Version)
+	w.uint32(s.SizeX)
+	w.uint32(s.SizeY)
+	w.uint32(s.SizeZ)
+	w.bytes(s.Blocks)
+	w.uint32(uint32(len(s.Activators)))
+	for _, act := range s.Activators {
+		w.pos(act.Pos)
+		w.uint32(uint32(len(act.Message)))
+		for _, line := range act.Message {
+			w.uint32(uint32(len(line)))
+			w.bytes([]byte(line))
+		}
+	}
+	w.uint32(uint32(len(s.Teleports)))
+	for _, tp := range s.Teleports {
+		w.pos(tp)
+	}
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	if err := gz.Close(); w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+var ErrTruncated = errors.New("schematic: data truncated")
+
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) bytes(n uint32) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if uint32(len(r.b)) < n {
+		r.err = ErrTruncated
+		return nil
+	}
+	ret := r.b[:n]
+	r.b = r.b[n:]
+	return ret
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+func (r *reader) pos() Pos {
+	return Pos{r.uint32(), r.uint32(), r.uint32()}
+}
+
+// Load a schematic
+func Read(in io.Reader) (*Schematic, error) {
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	// A small compressed file can expand to any size, so the uncompressed data is limited.
+	data, err := ioutil.ReadAll(io.LimitReader(gz, MaxData+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxData {
+		return nil, errors.New("schematic: file too big")
+	}
+	r := &reader{b: data}
+	if string(r.bytes(uint32(len(magic)))) != magic {
+		return nil, errors.New("schematic: not a schematic file")
+	}
+	if v := r.uint32(); v != Version {
+		return nil, fmt.Errorf("schematic: unsupported version %d", v)
+	}
+	s, err := New(r.uint32(), r.uint32(), r.uint32())
+	if err != nil {
+		return nil, err
+	}
+	copy(s.Blocks, r.bytes(uint32(len(s.Blocks))))
+	num := r.uint32()
+	for i := uint32(0); i < num && r.err == nil; i++ {
+		act := Activator{Pos: r.pos()}
+		lines := r.uint32()
+		for j := uint32(0); j < lines && r.err == nil; j++ {
+			act.Message = append(act.Message, string(r.bytes(r.uint32())))
+		}
+		if !s.Inside(act.Pos) {
+			return nil, fmt.Errorf("schematic: activator %v outside of region", act.Pos)
+		}
+		s.Activators = append(s.Activators, act)
+	}
+	num = r.uint32()
+	for i := uint32(0); i < num && r.err == nil; i++ {
+		tp := r.pos()
+		if !s.Inside(tp) {
+			return nil, fmt.Errorf("schematic: teleport %v outside of region", tp)
+		}
+		s.Teleports = append(s.Teleports, tp)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return s, nil
+}
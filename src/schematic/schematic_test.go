@@ -0,0 +1,69 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package schematic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+)
+
+func TestWriteRead(t *testing.T) {
+	s, err := New(3, 4, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set(2, 3, 4, 251)
+	s.Set(0, 1, 2, 7)
+	s.Activators = []Activator{{Pos{2, 3, 4}, []string{"Welcome", "to my castle"}}}
+	s.Teleports = []Pos{{1, 1, 1}}
+	var buf bytes.Buffer
+	if err = s.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	s2, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, s2) {
+		t.Error("Got", s2, "expected", s)
+	}
+	if s2.Get(0, 1, 2) != 7 {
+		t.Error("Bad block")
+	}
+}
+
+func TestBadSize(t *testing.T) {
+	if _, err := New(0, 1, 1); err == nil {
+		t.Error("Empty region shall fail")
+	}
+	if _, err := New(1<<16, 1<<16, 1<<16); err == nil {
+		t.Error("Too big region shall fail")
+	}
+}
+
+func TestTooBigFile(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(make([]byte, MaxData+1))
+	gz.Close()
+	if _, err := Read(&buf); err == nil {
+		t.Error("Too big file shall fail")
+	}
+}
@@ -75,6 +75,7 @@ var (
 	procStatus  tomb.Tomb                          // Used to monitor the state of the process
 	mutex       sync.RWMutex                       // Used to protect the map
 	chScoreList = make(chan *territoryScore, 100)
+	chFlush     = make(chan chan bool)
 	disableSave = flag.Bool("score.DisableSave", false, "Disable all updates with the database")
 )
 
@@ -136,6 +137,18 @@ func Pay(uid uint32, cost float64) bool {
 	return true
 }
 
+// Save all modified scores to the database now, and wait until it is done.
+// Return false if the update process is no longer running.
+func Flush() bool {
+	done := make(chan bool)
+	select {
+	case chFlush <- done:
+		return <-done
+	case <-procStatus.Dead():
+		return false
+	}
+}
+
 // Close the update process, and return the status
 func Close() (ret bool) {
 	// log.Println("score.Close initiating")
@@ -201,6 +214,10 @@ func maintainScore() {
 		case ts := <-chScoreList: // This is the way new entries are received
 			list = append(list, ts)
 			goto again // Don't start a new timer
+		case done := <-chFlush:
+			update(list)
+			done <- true
+			goto again // Don't start a new timer
 		case <-timer.C:
 			update(list)
 			elapsed = time.Now().Sub(start) // For statistics only
@@ -0,0 +1,266 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package snapshot
+
+//
+// This package manages snapshots of the world. A snapshot is a gzipped tar archive with
+// copies of the chunk and super chunk folders, and a dump of database collections.
+// Every collection is stored as "db/<collection>.bson", which is a sequence of BSON
+// documents. That is the same format as used by mongodump.
+//
+// The package doesn't know anything about locking. It is up to the caller to make sure
+// the files and collections don't change while they are being added. To keep that time
+// short, a folder can first be copied with CopyFolder, and the copy added to the archive.
+//
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	dbFolder = "db" // The folder inside the archive where collections are stored
+	suffix   = ".tar.gz"
+)
+
+type Writer struct {
+	file *os.File
+	gz   *gzip.Writer
+	tw   *tar.Writer
+	now  time.Time
+}
+
+// Get a file name for a snapshot, taken at time 't', stored in 'folder'.
+func FileName(folder string, t time.Time) string {
+	return filepath.Join(folder, "snapshot-"+t.Format("20060102-150405")+suffix)
+}
+
+// Create a new snapshot archive. The folder of the file is created if it doesn't exist.
+func Create(fileName string) (*Writer, error) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0777); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	return &Writer{file: f, gz: gz, tw: tar.NewWriter(gz), now: time.Now()}, nil
+}
+
+// Add one file to the archive, with the given content.
+func (w *Writer) AddFile(name string, data []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0666, Size: int64(len(data)), ModTime: w.now}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(data)
+	return err
+}
+
+// Add all regular files in a folder to the archive, using the same folder name.
+// Sub folders and temporary files ending with ".tmp" are ignored.
+// Return the number of files added.
+func (w *Writer) AddFolder(folder string) (int, error) {
+	return w.AddFolderAs(folder, folder)
+}
+
+// Add all regular files in 'folder' to the archive, as if they were stored in the folder 'name'.
+func (w *Writer) AddFolderAs(folder, name string) (int, error) {
+	dir, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, fi := range dir {
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), ".tmp") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(folder, fi.Name()))
+		if err != nil {
+			return n, err
+		}
+		if err = w.AddFile(path.Join(filepath.ToSlash(name), fi.Name()), data); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Copy all regular files in 'folder' to the folder 'to', which is created, or emptied if it exists.
+// If 'link', hard links are used instead, which is much faster. That can only be used for files that
+// are always replaced, never changed in place. A file is copied if the link can't be made.
+// Temporary files ending with ".tmp" are ignored. Return the number of files.
+func CopyFolder(folder, to string, link bool) (int, error) {
+	if err := os.RemoveAll(to); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(to, 0777); err != nil {
+		return 0, err
+	}
+	dir, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, fi := range dir {
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), ".tmp") {
+			continue
+		}
+		src, dst := filepath.Join(folder, fi.Name()), filepath.Join(to, fi.Name())
+		if !link || os.Link(src, dst) != nil {
+			data, err := ioutil.ReadFile(src)
+			if err != nil {
+				return n, err
+			}
+			if err = ioutil.WriteFile(dst, data, 0666); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Add all documents of a collection. Return the number of documents.
+func (w *Writer) AddCollection(c *mgo.Collection) (int, error) {
+	var data []byte
+	var n int
+	var doc bson.Raw
+	iter := c.Find(nil).Iter()
+	for iter.Next(&doc) {
+		// The raw data of a document is a complete BSON document
+		data = append(data, doc.Data...)
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return n, err
+	}
+	return n, w.AddFile(path.Join(dbFolder, c.Name+".bson"), data)
+}
+
+func (w *Writer) Close() error {
+	err := w.tw.Close()
+	if err2 := w.gz.Close(); err == nil {
+		err = err2
+	}
+	if err2 := w.file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Restore a snapshot. All files are created relative to the folder 'target', overwriting
+// existing files. If 'db' isn't nil, every collection in the snapshot will replace the
+// collection with the same name. If 'db' is nil, the collections are ignored.
+// The function 'report' is called for every restored file or collection, and can be nil.
+// For a collection, 'count' is the number of documents. For a file, it is -1.
+func Restore(fileName, target string, db *mgo.Database, report func(name string, count int)) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return errors.New("snapshot: illegal file name " + hdr.Name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if path.Dir(name) == dbFolder && path.Ext(name) == ".bson" {
+			if db == nil {
+				continue
+			}
+			collection := strings.TrimSuffix(path.Base(name), ".bson")
+			n, err := restoreCollection(db.C(collection), data)
+			if err != nil {
+				return fmt.Errorf("snapshot: collection %s: %v", collection, err)
+			}
+			if report != nil {
+				report(collection, n)
+			}
+			continue
+		}
+		fn := filepath.Join(target, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(fn, data, 0666); err != nil {
+			return err
+		}
+		if report != nil {
+			report(name, -1)
+		}
+	}
+}
+
+// Replace all documents in a collection with the ones in 'data'.
+// Return the number of documents restored.
+func restoreCollection(c *mgo.Collection, data []byte) (int, error) {
+	if _, err := c.RemoveAll(nil); err != nil {
+		return 0, err
+	}
+	var n int
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return n, errors.New("truncated document")
+		}
+		size := int(data[0]) | int(data[1])<<8 | int(data[2])<<16 | int(data[3])<<24
+		if size < 5 || size > len(data) {
+			return n, errors.New("bad document size")
+		}
+		var doc bson.D // Keep the order of the fields
+		if err := bson.Unmarshal(data[:size], &doc); err != nil {
+			return n, err
+		}
+		if err := c.Insert(doc); err != nil {
+			return n, err
+		}
+		data = data[size:]
+		n++
+	}
+	return n, nil
+}
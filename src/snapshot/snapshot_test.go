@@ -0,0 +1,97 @@
+// Copyright 2012 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	// Folders are stored with relative names, the same way as the server does.
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	const src = "DB"
+	os.Mkdir(src, 0777)
+	ioutil.WriteFile(filepath.Join(src, "1,2,3"), []byte("chunk"), 0666)
+	ioutil.WriteFile(filepath.Join(src, "1,2,4.tmp"), []byte("partial"), 0666)
+
+	fn := FileName("backup", time.Now())
+	w, err := Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := w.AddFolder(src)
+	if err != nil || n != 1 {
+		t.Error("AddFolder got", n, err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	const target = "restored"
+	if err = Restore(fn, target, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(target, src, "1,2,3"))
+	if err != nil || string(data) != "chunk" {
+		t.Error("Restored file got", string(data), err)
+	}
+	if _, err = os.Stat(filepath.Join(target, src, "1,2,4.tmp")); err == nil {
+		t.Error("Temporary file shall not be restored")
+	}
+}
+
+func TestCopyFolder(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src, copied := filepath.Join(tmp, "DB"), filepath.Join(tmp, "DB.snapshot")
+	os.Mkdir(src, 0777)
+	ioutil.WriteFile(filepath.Join(src, "1,2,3"), []byte("old"), 0666)
+	ioutil.WriteFile(filepath.Join(src, "1,2,4.tmp"), []byte("partial"), 0666)
+	for _, link := range []bool{true, false} {
+		n, err := CopyFolder(src, copied, link)
+		if err != nil || n != 1 {
+			t.Error("CopyFolder got", n, err)
+		}
+		// A file that is replaced after the copy shall not change the copy
+		ioutil.WriteFile(filepath.Join(src, "new"), []byte("new"), 0666)
+		os.Rename(filepath.Join(src, "new"), filepath.Join(src, "1,2,3"))
+		data, err := ioutil.ReadFile(filepath.Join(copied, "1,2,3"))
+		if err != nil || string(data) != "old" {
+			t.Error("Copied file got", string(data), err)
+		}
+		if _, err = os.Stat(filepath.Join(copied, "1,2,4.tmp")); err == nil {
+			t.Error("Temporary file shall not be copied")
+		}
+		ioutil.WriteFile(filepath.Join(src, "1,2,3"), []byte("old"), 0666)
+	}
+}
@@ -253,6 +253,14 @@ func (scm *superChunkManager) VerifyChecksum(cc *CC, checksum uint32) bool {
 	return sc.checksum == checksum
 }
 
+// Call 'f' with the name of the folder where super chunks are stored. No super chunks will be
+// saved while 'f' is executing, which makes it possible to take a consistent copy of the files.
+func (scm *superChunkManager) Freeze(f func(folder string) error) error {
+	scm.lock.Lock()
+	defer scm.lock.Unlock()
+	return f(scm.subFolder)
+}
+
 func (scm *superChunkManager) Size() int {
 	return len(scm.loaded)
 }